@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// auditBodyLimit of the request body kept in the audit log
+	auditBodyLimit = 1024
+	// adminBodyLimit of the admin requests, such as a config or a backend
+	adminBodyLimit = 1 << 20
+)
+
+var apiRejectedTotal = metrics.NewCounterVec("janus_api_rejected_total",
+	"Control api requests rejected by status.", "status")
+
+// Identity is the authenticated caller
+type Identity struct {
+	Name string
+	Role string
+	// Method token or certificate
+	Method string
+}
+
+// APIAuth authenticates the callers of the control api by bearer tokens or client
+// certificates, and writes the admin actions into the audit log
+type APIAuth struct {
+	lock   sync.Mutex
+	config config.APIAuthConfig
+	audit  *log.Logger
+	file   *os.File
+}
+
+func NewAPIAuth(cfg *config.APIAuthConfig) (*APIAuth, error) {
+	a := &APIAuth{}
+	if err := a.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetConfig replaces the callers, and reopens the audit log
+func (a *APIAuth) SetConfig(cfg *config.APIAuthConfig) error {
+	audit := log.StandardLogger()
+	var file *os.File
+	if len(cfg.AuditLog) > 0 {
+		f, err := os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		file = f
+		audit = &log.Logger{
+			Out:       f,
+			Formatter: &log.JSONFormatter{},
+			Hooks:     make(log.LevelHooks),
+			Level:     log.InfoLevel,
+		}
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.config = *cfg
+	a.audit = audit
+	a.file = file
+	return nil
+}
+
+// authenticate returns the caller, nil if unknown
+func (a *APIAuth) authenticate(r *http.Request) *Identity {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token := []byte(strings.TrimPrefix(h, "Bearer "))
+		for _, t := range a.config.Tokens {
+			if subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+				return &Identity{
+					Name:   t.Name,
+					Role:   t.Role,
+					Method: "token",
+				}
+			}
+		}
+		return nil
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, c := range a.config.Certificates {
+			if c.CommonName == cn {
+				return &Identity{
+					Name:   cn,
+					Role:   c.Role,
+					Method: "certificate",
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Require allows the callers of the role, admin could do everything read does.
+// The requests of admin are written into the audit log with the outcome.
+func (a *APIAuth) Require(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.lock.Lock()
+		enabled := a.config.Enabled()
+		id := a.authenticate(r)
+		audit := a.audit
+		a.lock.Unlock()
+
+		rec := &statusRecorder{
+			ResponseWriter: w,
+			code:           http.StatusOK,
+		}
+		start := time.Now()
+		// the body of the admin requests is read for the audit log once the
+		// caller is authenticated
+		var body []byte
+		switch {
+		case enabled && id == nil:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="janus"`)
+			http.Error(rec, "unauthorized", http.StatusUnauthorized)
+			apiRejectedTotal.Inc("401")
+		case enabled && role == config.RoleAdmin && id.Role != config.RoleAdmin:
+			http.Error(rec, "forbidden", http.StatusForbidden)
+			apiRejectedTotal.Inc("403")
+		case role == config.RoleAdmin && r.Body != nil:
+			b, err := ioutil.ReadAll(http.MaxBytesReader(rec, r.Body, adminBodyLimit))
+			if err != nil {
+				code := http.StatusBadRequest
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					code = http.StatusRequestEntityTooLarge
+				}
+				http.Error(rec, fmt.Sprintf("read body: %v", err), code)
+				apiRejectedTotal.Inc(strconv.Itoa(code))
+				break
+			}
+			body = b
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(rec, r)
+		default:
+			next.ServeHTTP(rec, r)
+		}
+		if role != config.RoleAdmin {
+			return
+		}
+
+		caller, method := "anonymous", "none"
+		if id != nil {
+			caller, method = id.Name, id.Method
+		}
+		if len(body) > auditBodyLimit {
+			body = append(body[:auditBodyLimit], "..."...)
+		}
+		audit.WithFields(log.Fields{
+			"audit":    true,
+			"caller":   caller,
+			"auth":     method,
+			"remote":   r.RemoteAddr,
+			"method":   r.Method,
+			"uri":      r.RequestURI,
+			"body":     string(body),
+			"status":   rec.code,
+			"duration": time.Since(start).String(),
+		}).Info("admin request")
+	})
+}
+
+// statusRecorder keeps the status code of the response, it flushes for the
+// event stream
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.code = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
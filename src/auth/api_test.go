@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mmpei/janus/src/config"
+)
+
+func TestAPIAuthRequire(t *testing.T) {
+	cfg := &config.APIAuthConfig{
+		Tokens: []config.APIToken{
+			{Name: "dashboard", Token: "read-token", Role: config.RoleRead},
+			{Name: "ops", Token: "admin-token", Role: config.RoleAdmin},
+		},
+	}
+	tests := []struct {
+		name   string
+		config *config.APIAuthConfig
+		role   string
+		token  string
+		body   string
+		status int
+	}{
+		{name: "open read", config: &config.APIAuthConfig{}, role: config.RoleRead, status: http.StatusOK},
+		{name: "open admin", config: &config.APIAuthConfig{}, role: config.RoleAdmin, body: "{}", status: http.StatusOK},
+		{name: "no token", config: cfg, role: config.RoleRead, status: http.StatusUnauthorized},
+		{name: "unknown token", config: cfg, role: config.RoleRead, token: "guess", status: http.StatusUnauthorized},
+		{name: "read by reader", config: cfg, role: config.RoleRead, token: "read-token", status: http.StatusOK},
+		{name: "read by admin", config: cfg, role: config.RoleRead, token: "admin-token", status: http.StatusOK},
+		{name: "admin by reader", config: cfg, role: config.RoleAdmin, token: "read-token", body: "{}", status: http.StatusForbidden},
+		{name: "admin by admin", config: cfg, role: config.RoleAdmin, token: "admin-token", body: "{}", status: http.StatusOK},
+		{
+			name:   "admin body too large",
+			config: cfg, role: config.RoleAdmin, token: "admin-token",
+			body:   strings.Repeat("a", adminBodyLimit+1),
+			status: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAPIAuth(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var received string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b := make([]byte, len(tt.body)+1)
+				n, _ := r.Body.Read(b)
+				received = string(b[:n])
+			})
+			r := httptest.NewRequest("POST", "/v1/reload", strings.NewReader(tt.body))
+			if len(tt.token) > 0 {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			a.Require(tt.role, next).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && received != tt.body {
+				t.Errorf("handler received %q, want %q", received, tt.body)
+			}
+			if tt.status != http.StatusOK && len(received) > 0 {
+				t.Errorf("handler called with %q when rejected", received)
+			}
+		})
+	}
+}
+
+func TestAPIAuthAudit(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	a, err := NewAPIAuth(&config.APIAuthConfig{
+		Tokens:   []config.APIToken{{Name: "ops", Token: "admin-token", Role: config.RoleAdmin}},
+		AuditLog: file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	requests := []struct {
+		role  string
+		token string
+		body  string
+	}{
+		{config.RoleRead, "admin-token", ""},
+		{config.RoleAdmin, "admin-token", `{"Addr":"127.0.0.1:9092"}`},
+		{config.RoleAdmin, "", strings.Repeat("a", auditBodyLimit+10)},
+		{config.RoleAdmin, "admin-token", strings.Repeat("a", auditBodyLimit+10)},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest("POST", "/v1/backends", strings.NewReader(req.body))
+		if len(req.token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+req.token)
+		}
+		a.Require(req.role, ok).ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	// the reads are not audited, the rejected body is not read, and the long one
+	// is cut
+	want := []struct {
+		caller string
+		status float64
+		body   string
+	}{
+		{"ops", 200, `{"Addr":"127.0.0.1:9092"}`},
+		{"anonymous", 401, ""},
+		{"ops", 200, strings.Repeat("a", auditBodyLimit) + "..."},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d audit entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e["caller"] != w.caller || e["status"] != w.status || e["body"] != w.body {
+			t.Errorf("audit entry %d = %v, want caller %s, status %v, body %q", i, e, w.caller, w.status, w.body)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+	"github.com/mmpei/janus/src/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	HeaderTimestamp = "X-Janus-Timestamp"
+	HeaderNonce     = "X-Janus-Nonce"
+	HeaderSignature = "X-Janus-Signature"
+)
+
+// syncBodyLimit of the sync requests, the status and the backends of a node are
+// far smaller
+const syncBodyLimit = 1 << 20
+
+var syncRejectedTotal = metrics.NewCounterVec("janus_sync_rejected_total",
+	"Sync requests rejected as unauthenticated by reason.", "reason")
+
+// PeerAuth authenticates the sync messages between the janus nodes, by the
+// certificates verified by TLS, or by the HMAC of the shared secret
+type PeerAuth struct {
+	config    config.PeerAuthConfig
+	serverTLS *tls.Config
+	client    *http.Client
+	nonces    *nonceCache
+	// peerNames the client certificate on /sync should be issued to
+	peerNames []string
+}
+
+// NewPeerAuth authenticates the peer, the address in cluster of the other node
+func NewPeerAuth(cfg *config.PeerAuthConfig, peer string) (*PeerAuth, error) {
+	pa := &PeerAuth{
+		config:    *cfg,
+		client:    &http.Client{},
+		nonces:    newNonceCache(time.Duration(cfg.MaxSkew)),
+		peerNames: cfg.PeerNames,
+	}
+	if len(pa.peerNames) == 0 {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			host = peer
+		}
+		pa.peerNames = []string{host}
+	}
+	if !cfg.TLS() {
+		return pa, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate: %v", err)
+	}
+	pool, err := LoadCertPool(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	// the client certificate is verified if given, /sync requires it by the
+	// middleware, the other routes do not
+	pa.serverTLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	pa.client.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+	return pa, nil
+}
+
+// LoadCertPool reads the pem certificates of the file
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buffer) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig is used to serve the control port, nil for plain http
+func (pa *PeerAuth) ServerTLSConfig() *tls.Config {
+	return pa.serverTLS
+}
+
+// Client is used to sync with the peer
+func (pa *PeerAuth) Client() *http.Client {
+	return pa.client
+}
+
+// Scheme of the control port of the peer
+func (pa *PeerAuth) Scheme() string {
+	if pa.serverTLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (pa *PeerAuth) enabled() bool {
+	return pa.config.TLS() || len(pa.config.Secret) > 0
+}
+
+// SignRequest signs the request when the secret is set, it returns the nonce to
+// verify the response
+func (pa *PeerAuth) SignRequest(r *http.Request, body []byte) string {
+	if len(pa.config.Secret) == 0 {
+		return ""
+	}
+	nonce := newNonce()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(HeaderTimestamp, timestamp)
+	r.Header.Set(HeaderNonce, nonce)
+	r.Header.Set(HeaderSignature, pa.sign(timestamp, nonce, body))
+	return nonce
+}
+
+// VerifyResponse checks the response is signed for the request of the nonce
+func (pa *PeerAuth) VerifyResponse(resp *http.Response, nonce string, body []byte) error {
+	if len(pa.config.Secret) == 0 {
+		return nil
+	}
+	if !hmac.Equal([]byte(resp.Header.Get(HeaderSignature)), []byte(pa.sign("", nonce, body))) {
+		return errors.New("invalid response signature")
+	}
+	return nil
+}
+
+// sign returns the hex HMAC-SHA256 of "timestamp.nonce.body"
+func (pa *PeerAuth) sign(timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(pa.config.Secret))
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Middleware rejects the unauthenticated sync requests, and signs the responses
+// of the signed ones
+func (pa *PeerAuth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pa.enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// the unverified connections with TLS on, and the requests neither
+		// certified nor signed are rejected before reading the body, which is
+		// limited anyway
+		certified := r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+		signed := len(r.Header.Get(HeaderSignature)) > 0 && len(pa.config.Secret) > 0
+		switch {
+		case pa.config.TLS() && !certified:
+			pa.reject(w, r, "no_certificate", "no verified client certificate")
+			return
+		case certified && !pa.isPeer(r.TLS.VerifiedChains[0][0]):
+			pa.reject(w, r, "not_peer", fmt.Sprintf("certificate of %q is not the peer", r.TLS.VerifiedChains[0][0].Subject.CommonName))
+			return
+		case !certified && !signed:
+			pa.reject(w, r, "unsigned", "request not signed")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, syncBodyLimit)
+		if !signed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			pa.reject(w, r, "read_error", err.Error())
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if reason, err := pa.verifyRequest(r, body); err != nil {
+			pa.reject(w, r, reason, err.Error())
+			return
+		}
+
+		// the response is buffered to be signed
+		rec := &recorder{
+			header: w.Header(),
+			code:   http.StatusOK,
+		}
+		next.ServeHTTP(rec, r)
+		w.Header().Set(HeaderSignature, pa.sign("", r.Header.Get(HeaderNonce), rec.body.Bytes()))
+		w.WriteHeader(rec.code)
+		w.Write(rec.body.Bytes())
+	})
+}
+
+// isPeer returns whether the certificate is issued to the peer, the other
+// certificates of the ca such as the api callers are refused
+func (pa *PeerAuth) isPeer(cert *x509.Certificate) bool {
+	for _, name := range pa.peerNames {
+		if cert.Subject.CommonName == name || cert.VerifyHostname(name) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyRequest checks the signature, the timestamp and the nonce, it returns
+// the reason of the failure for the metric
+func (pa *PeerAuth) verifyRequest(r *http.Request, body []byte) (string, error) {
+	timestamp, nonce := r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderNonce)
+	if !hmac.Equal([]byte(r.Header.Get(HeaderSignature)), []byte(pa.sign(timestamp, nonce, body))) {
+		return "bad_signature", errors.New("invalid signature")
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "bad_timestamp", fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(pa.config.MaxSkew) {
+		return "bad_timestamp", fmt.Errorf("timestamp skewed by %v", skew)
+	}
+	if len(nonce) == 0 || !pa.nonces.add(nonce) {
+		return "replayed", fmt.Errorf("nonce %q replayed", nonce)
+	}
+	return "", nil
+}
+
+func (pa *PeerAuth) reject(w http.ResponseWriter, r *http.Request, reason, message string) {
+	log.Warningf("reject sync from %s: %s", r.RemoteAddr, message)
+	syncRejectedTotal.Inc(reason)
+	event.Publish(event.EventSyncRejected, r.RemoteAddr, "reject sync from "+r.RemoteAddr+": "+message, map[string]string{
+		"reason": reason,
+	})
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// recorder buffers the response
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	return rec.body.Write(b)
+}
+
+func (rec *recorder) WriteHeader(code int) {
+	rec.code = code
+}
+
+// nonceCache remembers the nonces seen within the ttl
+type nonceCache struct {
+	lock   sync.Mutex
+	ttl    time.Duration
+	nonces map[string]time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		ttl:    ttl,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// add returns false if the nonce is seen, the expired ones are removed. A nonce
+// older than the ttl is refused by its timestamp, so it is not kept longer.
+func (nc *nonceCache) add(nonce string) bool {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	now := time.Now()
+	for n, expire := range nc.nonces {
+		if now.After(expire) {
+			delete(nc.nonces, n)
+		}
+	}
+	if _, ok := nc.nonces[nonce]; ok {
+		return false
+	}
+	// twice the ttl, the timestamp could be skewed to the future as well
+	nc.nonces[nonce] = now.Add(2 * nc.ttl)
+	return true
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
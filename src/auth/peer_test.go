@@ -0,0 +1,186 @@
+package auth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+)
+
+func newTestPeerAuth(t *testing.T, secret string) *PeerAuth {
+	cfg := config.NewDefaultPeerAuth()
+	cfg.Secret = secret
+	pa, err := NewPeerAuth(cfg, "127.0.0.1:9001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pa
+}
+
+// echo answers the body of the request
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(body)
+})
+
+func TestPeerAuthMiddleware(t *testing.T) {
+	secret := "0123456789abcdef"
+	body := []byte(`{"PeerId":"127.0.0.1:9001"}`)
+	tests := []struct {
+		name string
+		// sign the request, it returns the nonce to verify the response
+		sign   func(pa *PeerAuth, r *http.Request) string
+		body   []byte
+		status int
+	}{
+		{
+			name:   "signed",
+			sign:   func(pa *PeerAuth, r *http.Request) string { return pa.SignRequest(r, body) },
+			status: http.StatusOK,
+		},
+		{
+			name:   "unsigned",
+			sign:   func(pa *PeerAuth, r *http.Request) string { return "" },
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "signed by another secret",
+			sign: func(pa *PeerAuth, r *http.Request) string {
+				return newTestPeerAuth(t, "fedcba9876543210").SignRequest(r, body)
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "body changed",
+			sign: func(pa *PeerAuth, r *http.Request) string {
+				return pa.SignRequest(r, []byte(`{"PeerId":"127.0.0.1:9002"}`))
+			},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "skewed",
+			sign:   signedAt(time.Now().Add(-time.Minute), body),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "skewed to the future",
+			sign:   signedAt(time.Now().Add(time.Minute), body),
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "within the skew",
+			sign:   signedAt(time.Now().Add(-20*time.Second), body),
+			status: http.StatusOK,
+		},
+		{
+			name: "too large",
+			sign: func(pa *PeerAuth, r *http.Request) string {
+				return pa.SignRequest(r, bytes.Repeat([]byte("a"), syncBodyLimit+1))
+			},
+			body:   bytes.Repeat([]byte("a"), syncBodyLimit+1),
+			status: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pa := newTestPeerAuth(t, secret)
+			b := body
+			if tt.body != nil {
+				b = tt.body
+			}
+			r := httptest.NewRequest("POST", "/sync", bytes.NewReader(b))
+			nonce := tt.sign(pa, r)
+			w := httptest.NewRecorder()
+			pa.Middleware(echo).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if err := pa.VerifyResponse(w.Result(), nonce, w.Body.Bytes()); err != nil {
+				t.Errorf("verify response: %v", err)
+			}
+			if err := pa.VerifyResponse(w.Result(), newNonce(), w.Body.Bytes()); err == nil {
+				t.Error("response verified by another nonce")
+			}
+		})
+	}
+}
+
+// signedAt signs the request with the timestamp
+func signedAt(at time.Time, body []byte) func(pa *PeerAuth, r *http.Request) string {
+	return func(pa *PeerAuth, r *http.Request) string {
+		nonce, timestamp := newNonce(), strconv.FormatInt(at.Unix(), 10)
+		r.Header.Set(HeaderTimestamp, timestamp)
+		r.Header.Set(HeaderNonce, nonce)
+		r.Header.Set(HeaderSignature, pa.sign(timestamp, nonce, body))
+		return nonce
+	}
+}
+
+func TestPeerAuthReplay(t *testing.T) {
+	pa := newTestPeerAuth(t, "0123456789abcdef")
+	body := []byte(`{}`)
+	first := httptest.NewRequest("POST", "/sync", bytes.NewReader(body))
+	pa.SignRequest(first, body)
+	replayed := httptest.NewRequest("POST", "/sync", bytes.NewReader(body))
+	replayed.Header = first.Header.Clone()
+
+	for _, tt := range []struct {
+		r      *http.Request
+		status int
+	}{
+		{first, http.StatusOK},
+		{replayed, http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		pa.Middleware(echo).ServeHTTP(w, tt.r)
+		if w.Code != tt.status {
+			t.Fatalf("status %d, want %d", w.Code, tt.status)
+		}
+	}
+}
+
+func TestPeerAuthDisabled(t *testing.T) {
+	pa := newTestPeerAuth(t, "")
+	r := httptest.NewRequest("POST", "/sync", bytes.NewReader([]byte(`{}`)))
+	if nonce := pa.SignRequest(r, []byte(`{}`)); len(nonce) > 0 || len(r.Header.Get(HeaderSignature)) > 0 {
+		t.Fatal("signed without a secret")
+	}
+	w := httptest.NewRecorder()
+	pa.Middleware(echo).ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != `{}` {
+		t.Fatalf("status %d, body %q, want passed through", w.Code, w.Body.String())
+	}
+	if err := pa.VerifyResponse(w.Result(), "", w.Body.Bytes()); err != nil {
+		t.Errorf("verify response: %v", err)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	nc := newNonceCache(20 * time.Millisecond)
+	if !nc.add("a") || !nc.add("b") {
+		t.Fatal("new nonces refused")
+	}
+	if nc.add("a") {
+		t.Fatal("nonce replayed")
+	}
+	// kept twice the ttl, then expired
+	time.Sleep(50 * time.Millisecond)
+	if !nc.add("a") {
+		t.Fatal("expired nonce refused")
+	}
+	if len(nc.nonces) != 1 {
+		t.Errorf("%d nonces kept, want the expired ones removed", len(nc.nonces))
+	}
+}
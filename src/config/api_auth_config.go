@@ -0,0 +1,42 @@
+package config
+
+const (
+	// RoleRead reads the status, the metrics and the events
+	RoleRead = "read"
+	// RoleAdmin changes the cluster as well, such as reloading and the backends
+	RoleAdmin = "admin"
+)
+
+// APIAuthConfig authenticates the callers of the control api by bearer tokens or
+// client certificates, none of them leaves the api open. The certificates are
+// verified by peer_auth.ca_file, so peer_auth TLS is required for them.
+type APIAuthConfig struct {
+	Tokens       []APIToken       `yaml:"tokens"`
+	Certificates []APICertificate `yaml:"certificates"`
+	// AuditLog the file the admin actions are appended to as json lines, empty
+	// writes them into the log
+	AuditLog string `yaml:"audit_log"`
+}
+
+// APIToken is a caller identified by the bearer token
+type APIToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// String hides the token, the config changes are logged when reloading
+func (t APIToken) String() string {
+	return t.Name + ":" + t.Role
+}
+
+// APICertificate is a caller identified by the common name of its certificate
+type APICertificate struct {
+	CommonName string `yaml:"common_name"`
+	Role       string `yaml:"role"`
+}
+
+// Enabled returns whether the api requires authentication
+func (c *APIAuthConfig) Enabled() bool {
+	return len(c.Tokens) > 0 || len(c.Certificates) > 0
+}
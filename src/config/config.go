@@ -1,9 +1,19 @@
 package config
 
-import "fmt"
+var ProxyConfig = *NewDefaultConfiguration()
 
-var ProxyConfig = Configuration{
-	Sync: *NewDefaultSync(),
+// NewDefaultConfiguration returns the configuration before reading the file
+func NewDefaultConfiguration() *Configuration {
+	return &Configuration{
+		Sync: *NewDefaultSync(),
+		Monitor: *NewDefaultSync(),
+		Hooks: *NewDefaultHook(),
+		VIP: *NewDefaultVIP(),
+		DNS: *NewDefaultDNS(),
+		RedisSentinel: *NewDefaultRedisSentinel(),
+		PeerAuth: *NewDefaultPeerAuth(),
+		Proxy: *NewDefaultProxyServer(),
+	}
 }
 
 type Configuration struct {
@@ -19,9 +29,17 @@ type Configuration struct {
 	Port              int         `yaml:"port"`
 	// ProxyPort
 	ProxyPort              int         `yaml:"proxy_port"`
+	// Proxy the mode and TLS of the proxy on proxy_port
+	Proxy ProxyServerConfig `yaml:"proxy"`
+	// ReplicaProxyPort load balances the connections across the replicas
+	ReplicaProxyPort int `yaml:"replica_proxy_port"`
 
     // Sync
 	Sync SyncConfig `yaml:"sync"`
+	// PeerAuth authenticates the janus nodes to each other
+	PeerAuth PeerAuthConfig `yaml:"peer_auth"`
+	// APIAuth authenticates the callers of the control api
+	APIAuth APIAuthConfig `yaml:"api_auth"`
 
 	// Monitor for backend
 	Monitor SyncConfig `yaml:"monitor"`
@@ -29,24 +47,52 @@ type Configuration struct {
 	Backends        []string    `yaml:"backends"`
 	// the port backend listening on for server
 	BackendProxiedPort int `yaml:"backend_proxied_port"`
+	// BackendProxiedScheme http or https for http proxy, tcp or tls for tcp proxy,
+	// https and tls re-encrypt to the backend
+	BackendProxiedScheme string `yaml:"backend_proxied_scheme"`
+	// BackendsFile keeps the backends changed at runtime across restarts
+	BackendsFile string `yaml:"backends_file"`
+	// Discovery finds the backends by a provider
+	Discovery DiscoveryConfig `yaml:"discovery"`
+	// Notifications posts the events to webhooks
+	Notifications NotificationConfig `yaml:"notifications"`
+	// Hooks runs commands on role transitions
+	Hooks HookConfig `yaml:"hooks"`
+	// VIP floats an address to the sentinel master
+	VIP VIPConfig `yaml:"vip"`
+	// DNS answers the backend master and replicas
+	DNS DNSConfig `yaml:"dns"`
+	// RedisSentinel answers the clients of Redis Sentinel
+	RedisSentinel RedisSentinelConfig `yaml:"redis_sentinel"`
 	// ToMaster
 	ToMaster                string  `yaml:"to_master"`
 	// ToSlave
 	ToSlave                string  `yaml:"to_slave"`
 }
 
-func (cfg *Configuration) Validate() error {
-	if len(cfg.IP) == 0 {
-		return fmt.Errorf("Invalid ip address ")
+// Redacted returns a copy with the secrets hidden, to be printed
+func (c *Configuration) Redacted() *Configuration {
+	r := *c
+	r.PeerAuth.Secret = redact(c.PeerAuth.Secret)
+	r.APIAuth.Tokens = append([]APIToken(nil), c.APIAuth.Tokens...)
+	for i := range r.APIAuth.Tokens {
+		r.APIAuth.Tokens[i].Token = redact(r.APIAuth.Tokens[i].Token)
 	}
-	if len(cfg.Cluster) != 2 {
-		return fmt.Errorf("Invalid cluster, now we only support 2 ep ")
+	r.Notifications.Webhooks = append([]WebhookConfig(nil), c.Notifications.Webhooks...)
+	for i := range r.Notifications.Webhooks {
+		r.Notifications.Webhooks[i].Secret = redact(r.Notifications.Webhooks[i].Secret)
 	}
-	if len(cfg.Backends) == 0 {
-		return fmt.Errorf("Invalid backends ")
+	r.Proxy.MySQL.Users = append([]MySQLUser(nil), c.Proxy.MySQL.Users...)
+	for i := range r.Proxy.MySQL.Users {
+		r.Proxy.MySQL.Users[i].Password = redact(r.Proxy.MySQL.Users[i].Password)
 	}
-	if cfg.Port == 0 {
-		return fmt.Errorf("Invalid listening port ")
+	return &r
+}
+
+// redact hides a secret, the empty one is kept to show it is not set
+func redact(secret string) string {
+	if len(secret) == 0 {
+		return secret
 	}
-	return nil
+	return "***"
 }
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// liveFields could be changed by reloading, the others need a restart
+var liveFields = []string{
+	"log_level",
+	"sync",
+	"monitor",
+	"backends",
+	"to_master",
+	"to_slave",
+	"notifications",
+	"hooks",
+	"api_auth",
+}
+
+// secretFields are hidden in the changes, they are logged and returned by reloading
+var secretFields = []string{
+	"peer_auth.secret",
+}
+
+// Change is a field changed between two configurations
+type Change struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// Diff compares the configurations field by field. It returns the changes when
+// all of them could be applied live, otherwise an error listing the fields which
+// need a restart.
+func Diff(old, new *Configuration) ([]Change, error) {
+	var changes []Change
+	o, n := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for _, f := range fields(o.Type()) {
+		ov, nv := o.FieldByIndex(f.index).Interface(), n.FieldByIndex(f.index).Interface()
+		if reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		c := Change{
+			Field: f.path,
+			Old: fmt.Sprint(ov),
+			New: fmt.Sprint(nv),
+		}
+		if contains(secretFields, f.path) {
+			c.Old, c.New = "***", "***"
+		}
+		changes = append(changes, c)
+	}
+
+	var restart []string
+	for _, c := range changes {
+		if !IsLive(c.Field) {
+			restart = append(restart, c.Field)
+		}
+	}
+	if len(restart) > 0 {
+		return changes, fmt.Errorf("changes need a restart: %s", strings.Join(restart, ", "))
+	}
+	return changes, nil
+}
+
+// IsLive returns whether the field could be changed by reloading
+func IsLive(field string) bool {
+	for _, f := range liveFields {
+		if field == f || strings.HasPrefix(field, f+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Changed returns whether the field or any field under it is in changes
+func Changed(changes []Change, field string) bool {
+	for _, c := range changes {
+		if c.Field == field || strings.HasPrefix(c.Field, field+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// field is a leaf of the configuration, named by the yaml path such as monitor.failure.count
+type field struct {
+	path  string
+	index []int
+	typ   reflect.Type
+}
+
+// fields lists the leaves of a config struct type in order
+func fields(t reflect.Type) []field {
+	var fs []field
+	var walk func(t reflect.Type, path string, index []int)
+	walk = func(t reflect.Type, path string, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name := strings.Split(sf.Tag.Get("yaml"), ",")[0]
+			if len(name) == 0 || name == "-" || len(sf.PkgPath) > 0 {
+				continue
+			}
+			if len(path) > 0 {
+				name = path + "." + name
+			}
+			idx := append(append([]int(nil), index...), i)
+			if sf.Type.Kind() == reflect.Struct {
+				walk(sf.Type, name, idx)
+				continue
+			}
+			fs = append(fs, field{
+				path: name,
+				index: idx,
+				typ: sf.Type,
+			})
+		}
+	}
+	walk(t, "", nil)
+	return fs
+}
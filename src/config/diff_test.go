@@ -0,0 +1,115 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Configuration)
+		want   []Change
+		// the fields need a restart
+		restart string
+	}{
+		{
+			name:   "none",
+			change: func(c *Configuration) {},
+		},
+		{
+			name: "live",
+			change: func(c *Configuration) {
+				c.LogLevel = "debug"
+				c.Monitor.Failure.Count = 5
+				c.Backends = append(c.Backends, "127.0.0.1:9091")
+			},
+			want: []Change{
+				{Field: "log_level", Old: "info", New: "debug"},
+				{Field: "monitor.failure.count", Old: "3", New: "5"},
+				{Field: "backends", Old: "[127.0.0.1:9090]", New: "[127.0.0.1:9090 127.0.0.1:9091]"},
+			},
+		},
+		{
+			name: "restart",
+			change: func(c *Configuration) {
+				c.Sync.Interval = Duration(2 * time.Second)
+				c.BackendsFile = "/var/lib/janus/backends.yaml"
+				c.Port = 9002
+			},
+			want: []Change{
+				{Field: "port", Old: "9000", New: "9002"},
+				{Field: "sync.interval", Old: "4s", New: "2s"},
+				{Field: "backends_file", Old: "", New: "/var/lib/janus/backends.yaml"},
+			},
+			restart: "port, backends_file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := NewDefaultConfiguration()
+			old.LogLevel = "info"
+			old.Port = 9000
+			old.Backends = []string{"127.0.0.1:9090"}
+			old.Sync.Interval = Duration(4 * time.Second)
+			old.Monitor.Failure.Count = 3
+			c := NewDefaultConfiguration()
+			*c = *old
+			tt.change(c)
+			changes, err := Diff(old, c)
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("changes = %+v, want %+v", changes, tt.want)
+			}
+			if len(tt.restart) == 0 {
+				if err != nil {
+					t.Errorf("error = %v, want nil", err)
+				}
+			} else if err == nil || !strings.HasSuffix(err.Error(), tt.restart) {
+				t.Errorf("error = %v, want restart of %s", err, tt.restart)
+			}
+		})
+	}
+}
+
+func TestChanged(t *testing.T) {
+	changes := []Change{{Field: "monitor.failure.count"}, {Field: "log_level"}}
+	tests := []struct {
+		field string
+		want  bool
+	}{
+		{"monitor", true},
+		{"monitor.failure", true},
+		{"monitor.failure.count", true},
+		{"monitor.recover", false},
+		{"mon", false},
+		{"log_level", true},
+		{"sync", false},
+	}
+	for _, tt := range tests {
+		if changed := Changed(changes, tt.field); changed != tt.want {
+			t.Errorf("Changed(%s) = %v, want %v", tt.field, changed, tt.want)
+		}
+	}
+}
+
+func TestIsLive(t *testing.T) {
+	tests := []struct {
+		field string
+		want  bool
+	}{
+		{"log_level", true},
+		{"sync.interval", true},
+		{"monitor.failure.count", true},
+		{"backends", true},
+		{"backends_file", false},
+		{"port", false},
+		{"cluster", false},
+	}
+	for _, tt := range tests {
+		if live := IsLive(tt.field); live != tt.want {
+			t.Errorf("IsLive(%s) = %v, want %v", tt.field, live, tt.want)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package config
+
+const (
+	DiscoveryFile   = "file"
+	DiscoveryDNSSRV = "dns_srv"
+)
+
+// DiscoveryConfig feeds the backends from a provider instead of the static list
+type DiscoveryConfig struct {
+	// Provider file or dns_srv, empty disables discovery
+	Provider string `yaml:"provider"`
+	// Interval of polling the file or resolving the record
+	Interval Duration `yaml:"interval"`
+	// File the json or yaml file listing the backends, for file provider
+	File string `yaml:"file"`
+	// Name the SRV record, such as _janus._tcp.db.example.com, for dns_srv provider
+	Name string `yaml:"name"`
+	// Resolver the dns server address host:port, empty uses the system resolver
+	Resolver string `yaml:"resolver"`
+}
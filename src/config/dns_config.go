@@ -0,0 +1,17 @@
+package config
+
+// DNSConfig answers the backend master and replicas by dns, port 0 disables it
+type DNSConfig struct {
+	// Port of both udp and tcp, on the ip of janus
+	Port int `yaml:"port"`
+	// Cluster names the zone <cluster>.janus., such as master.db.janus.
+	Cluster string `yaml:"cluster"`
+	// TTL of the answers in seconds, short so that clients follow failovers
+	TTL int `yaml:"ttl"`
+}
+
+func NewDefaultDNS() *DNSConfig {
+	return &DNSConfig{
+		TTL: 5,
+	}
+}
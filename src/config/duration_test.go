@@ -0,0 +1,56 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestDurationUnmarshal(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want time.Duration
+		err  bool
+	}{
+		{"d: 3", 3 * time.Second, false},
+		{"d: 0", 0, false},
+		{"d: 500ms", 500 * time.Millisecond, false},
+		{"d: 1m30s", 90 * time.Second, false},
+		{`d: "2s"`, 2 * time.Second, false},
+		{"d: 1.5", 1500 * time.Millisecond, false},
+		{"d: fast", 0, true},
+		{"d: [1]", 0, true},
+	}
+	for _, tt := range tests {
+		var v struct {
+			D Duration `yaml:"d"`
+		}
+		err := yaml.Unmarshal([]byte(tt.yaml), &v)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: parsed as %v, want error", tt.yaml, v.D)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.yaml, err)
+			continue
+		}
+		if time.Duration(v.D) != tt.want {
+			t.Errorf("%q: %v, want %v", tt.yaml, v.D, tt.want)
+		}
+	}
+}
+
+func TestDurationMarshal(t *testing.T) {
+	out, err := yaml.Marshal(struct {
+		D Duration `yaml:"d"`
+	}{Duration(1500 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "d: 1.5s\n" {
+		t.Errorf("marshaled %q, want %q", out, "d: 1.5s\n")
+	}
+}
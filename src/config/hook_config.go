@@ -0,0 +1,24 @@
+package config
+
+import "time"
+
+// HookConfig runs commands on role transitions, like the notify scripts of
+// keepalived. The commands run by sh -c, empty ones are skipped.
+type HookConfig struct {
+	// Timeout kills the command running longer
+	Timeout Duration `yaml:"timeout"`
+	// OnSentinelMaster runs when this janus takes the sentinel master duty
+	OnSentinelMaster string `yaml:"on_sentinel_master"`
+	// OnSentinelSlave runs when this janus gives up the sentinel master duty
+	OnSentinelSlave string `yaml:"on_sentinel_slave"`
+	// OnBackendPromoted runs when a backend is changed to master
+	OnBackendPromoted string `yaml:"on_backend_promoted"`
+	// OnBackendDemoted runs when a backend is changed to slave
+	OnBackendDemoted string `yaml:"on_backend_demoted"`
+}
+
+func NewDefaultHook() *HookConfig {
+	return &HookConfig{
+		Timeout: Duration(10*time.Second),
+	}
+}
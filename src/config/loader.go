@@ -0,0 +1,177 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvPrefix of the environment variables, JANUS_MONITOR_FAILURE_COUNT sets monitor.failure.count
+	EnvPrefix = "JANUS_"
+	// DefaultConfigPath is read when no config file is specified, it is fine if it does not exist
+	DefaultConfigPath = "conf.yaml"
+)
+
+// usages of the flags, the others are described by their yaml path
+var usages = map[string]string{
+	"log_level":  "log level:debug info warn error",
+	"ip":         "ip where the server listen on",
+	"port":       "port where the server listen on",
+	"proxy_port": "port where the proxy server listen on",
+	"replica_proxy_port": "port where the replica proxy server listen on",
+}
+
+// Loader builds the configuration from the defaults, the yaml file, the JANUS_*
+// environment variables and the flags, the later one wins:
+// flag > env > file > defaults.
+//
+// Every field could be set by a flag named by its yaml path, such as
+// -monitor.failure.count, or by the environment variable JANUS_MONITOR_FAILURE_COUNT.
+// Lists are separated by comma, durations are like 500ms or seconds.
+type Loader struct {
+	configPath string
+	// values of the flags set on the command line, by yaml path
+	flags map[string]string
+}
+
+// NewLoader registers the config flag and the flags of all fields into fs
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{
+		flags: make(map[string]string),
+	}
+	fs.StringVar(&l.configPath, "config", "", "specify the config file with formatter yaml, env JANUS_CONFIG")
+	t := reflect.TypeOf(Configuration{})
+	for _, f := range fields(t) {
+		usage, ok := usages[f.path]
+		if !ok {
+			usage = "set " + f.path
+		}
+		fs.Var(&flagValue{
+			path: f.path,
+			flags: l.flags,
+			bool: f.typ.Kind() == reflect.Bool,
+		}, f.path, fmt.Sprintf("%s, env %s", usage, EnvName(f.path)))
+	}
+	return l
+}
+
+// EnvName returns the environment variable of the field
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+// ConfigPath returns the config file path, and whether it is specified
+func (l *Loader) ConfigPath() (string, bool) {
+	if len(l.configPath) > 0 {
+		return l.configPath, true
+	}
+	if p := os.Getenv(EnvPrefix + "CONFIG"); len(p) > 0 {
+		return p, true
+	}
+	return DefaultConfigPath, false
+}
+
+// Load builds a new configuration, it could be called again to reload
+func (l *Loader) Load() (*Configuration, error) {
+	cfg := NewDefaultConfiguration()
+
+	path, specified := l.ConfigPath()
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil && (specified || !os.IsNotExist(err)) {
+		return nil, fmt.Errorf("read config file %s: %v", path, err)
+	}
+	if err == nil {
+		if err := yaml.Unmarshal(buffer, cfg); err != nil {
+			return nil, fmt.Errorf("parse config file %s: %v", path, err)
+		}
+	}
+
+	v := reflect.ValueOf(cfg).Elem()
+	fs := fields(v.Type())
+	for _, f := range fs {
+		name := EnvName(f.path)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.FieldByIndex(f.index), s); err != nil {
+			return nil, fmt.Errorf("env %s: %v", name, err)
+		}
+	}
+	// flags are applied in a stable order so the errors are reproducible
+	paths := make([]string, 0, len(l.flags))
+	for path := range l.flags {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		for _, f := range fs {
+			if f.path != path {
+				continue
+			}
+			if err := setField(v.FieldByIndex(f.index), l.flags[path]); err != nil {
+				return nil, fmt.Errorf("flag -%s: %v", path, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// setField parses s into the field, strings are taken as they are, lists of
+// strings are separated by comma, and the others are parsed as yaml
+func setField(v reflect.Value, s string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(s), "["):
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list).Convert(v.Type()))
+		return nil
+	}
+	ptr := reflect.New(v.Type())
+	if err := yaml.UnmarshalStrict([]byte(s), ptr.Interface()); err != nil {
+		if _, ok := err.(*yaml.TypeError); ok {
+			return fmt.Errorf("invalid value %q for %s", s, v.Type())
+		}
+		return fmt.Errorf("invalid value %q for %s: %v", s, v.Type(), err)
+	}
+	v.Set(ptr.Elem())
+	return nil
+}
+
+// flagValue records the value set on the command line, it is applied after the
+// file and the environment variables
+type flagValue struct {
+	path  string
+	flags map[string]string
+	bool  bool
+}
+
+func (fv *flagValue) String() string {
+	if fv == nil || fv.flags == nil {
+		return ""
+	}
+	return fv.flags[fv.path]
+}
+
+func (fv *flagValue) Set(s string) error {
+	fv.flags[fv.path] = s
+	return nil
+}
+
+func (fv *flagValue) IsBoolFlag() bool {
+	return fv.bool
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoaderPrecedence(t *testing.T) {
+	file := `
+log_level: warn
+port: 9000
+backends: [127.0.0.1:9090]
+sync:
+  interval: 2
+monitor:
+  failure:
+    count: 4
+`
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want func(c *Configuration)
+	}{
+		{
+			name: "file over defaults",
+			want: func(c *Configuration) {},
+		},
+		{
+			name: "env over file",
+			env: map[string]string{
+				"JANUS_LOG_LEVEL":             "error",
+				"JANUS_MONITOR_FAILURE_COUNT": "5",
+				"JANUS_BACKENDS":              "127.0.0.1:9091, 127.0.0.1:9092",
+				"JANUS_SYNC_INTERVAL":         "1500ms",
+			},
+			want: func(c *Configuration) {
+				c.LogLevel = "error"
+				c.Monitor.Failure.Count = 5
+				c.Backends = []string{"127.0.0.1:9091", "127.0.0.1:9092"}
+				c.Sync.Interval = Duration(1500 * time.Millisecond)
+			},
+		},
+		{
+			name: "flag over env",
+			env: map[string]string{
+				"JANUS_LOG_LEVEL": "error",
+				"JANUS_PORT":      "9001",
+			},
+			args: []string{"-log_level=debug", "-backends", "[127.0.0.1:9093]", "-sync.interval", "3s"},
+			want: func(c *Configuration) {
+				c.LogLevel = "debug"
+				c.Port = 9001
+				c.Backends = []string{"127.0.0.1:9093"}
+				c.Sync.Interval = Duration(3 * time.Second)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "conf.yaml")
+			if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("JANUS_CONFIG", path)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs := flag.NewFlagSet("janus", flag.ContinueOnError)
+			l := NewLoader(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := l.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := NewDefaultConfiguration()
+			want.LogLevel = "warn"
+			want.Port = 9000
+			want.Backends = []string{"127.0.0.1:9090"}
+			want.Sync.Interval = Duration(2 * time.Second)
+			want.Monitor.Failure.Count = 4
+			tt.want(want)
+			if !reflect.DeepEqual(cfg, want) {
+				changes, _ := Diff(want, cfg)
+				t.Errorf("loaded config differs: %+v", changes)
+			}
+		})
+	}
+}
+
+func TestLoaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{
+			name: "specified file missing",
+			args: []string{"-config", filepath.Join(dir, "missing.yaml")},
+			err:  "read config file",
+		},
+		{
+			name: "invalid file",
+			file: "port: [",
+			err:  "parse config file",
+		},
+		{
+			name: "invalid env",
+			env:  map[string]string{"JANUS_PORT": "ninety"},
+			err:  "env JANUS_PORT: invalid value",
+		},
+		{
+			name: "invalid flag",
+			args: []string{"-sync.interval", "soon"},
+			err:  "flag -sync.interval: invalid value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.file) > 0 {
+				path := filepath.Join(t.TempDir(), "conf.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("JANUS_CONFIG", path)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			fs := flag.NewFlagSet("janus", flag.ContinueOnError)
+			l := NewLoader(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := l.Load(); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoaderDefaultPath(t *testing.T) {
+	// conf.yaml is not required in the working directory of the test
+	l := NewLoader(flag.NewFlagSet("janus", flag.ContinueOnError))
+	if path, specified := l.ConfigPath(); path != DefaultConfigPath || specified {
+		t.Fatalf("config path = %s, %v, want %s not specified", path, specified, DefaultConfigPath)
+	}
+	cfg, err := l.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, NewDefaultConfiguration()) {
+		t.Error("loaded without a file differs from the defaults")
+	}
+}
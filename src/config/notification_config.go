@@ -0,0 +1,40 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NotificationConfig posts the events to the webhooks
+type NotificationConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+}
+
+// WebhookConfig is a target of notifications, the zero timeout, retries and
+// backoff take the defaults
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// Events the types of events posted, empty posts the elections, health
+	// changes, sentinel role changes and split brain suspects
+	Events []string `yaml:"events"`
+	// Secret signs the payload by HMAC-SHA256 into the X-Janus-Signature header
+	Secret string `yaml:"secret"`
+	// Timeout of each attempt, 5s by default
+	Timeout Duration `yaml:"timeout"`
+	// Retries after the first attempt failed, 3 by default, -1 disables retrying
+	Retries int `yaml:"retries"`
+	// Backoff before the first retry, doubled for each of the next, 1s by default
+	Backoff Duration `yaml:"backoff"`
+}
+
+// String hides the secret, the config changes are logged when reloading
+func (wc WebhookConfig) String() string {
+	s := wc.URL
+	if len(wc.Events) > 0 {
+		s += " events=" + strings.Join(wc.Events, ",")
+	}
+	if len(wc.Secret) > 0 {
+		s += " secret=***"
+	}
+	return s + fmt.Sprintf(" timeout=%v retries=%d backoff=%v", wc.Timeout, wc.Retries, wc.Backoff)
+}
@@ -0,0 +1,38 @@
+package config
+
+import "time"
+
+// PeerAuthConfig authenticates the janus nodes to each other on /sync. With the
+// certificates the control port is served by https and the peer presents its
+// client certificate, with the secret the sync requests and responses are signed
+// by HMAC. Both are required when both are set, none leaves /sync open.
+type PeerAuthConfig struct {
+	// CertFile and KeyFile of this node, used as both server and client
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// CAFile verifies the certificates of the peer
+	CAFile string `yaml:"ca_file"`
+	// PeerNames the certificate of the peer should be issued to, matched by the
+	// common name or a subject alternative name. Empty uses the host of the peer
+	// in cluster, the api certificates are issued by the same ca.
+	PeerNames []string `yaml:"peer_names"`
+	// Secret shared by the nodes to sign the sync messages
+	Secret string `yaml:"secret"`
+	// MaxSkew of the timestamp of signed requests, the nonces are kept this long
+	// to refuse replaying
+	MaxSkew Duration `yaml:"max_skew"`
+}
+
+// MinSecretLength of the shared secret
+const MinSecretLength = 16
+
+func NewDefaultPeerAuth() *PeerAuthConfig {
+	return &PeerAuthConfig{
+		MaxSkew: Duration(30*time.Second),
+	}
+}
+
+// TLS returns whether the certificates are set
+func (c *PeerAuthConfig) TLS() bool {
+	return len(c.CertFile) > 0
+}
@@ -0,0 +1,203 @@
+package config
+
+import "time"
+
+const (
+	ProxyModeHTTP  = "http"
+	ProxyModeTCP   = "tcp"
+	ProxyModeMySQL = "mysql"
+	ProxyModeRedis = "redis"
+
+	TLSModeNone        = "none"
+	TLSModeTerminate   = "terminate"
+	TLSModePassthrough = "passthrough"
+
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+	BalanceWeighted   = "weighted"
+)
+
+// ProxyServerConfig is the proxy on proxy_port forwarding to the backend master
+type ProxyServerConfig struct {
+	// Mode http proxies the requests, tcp copies the bytes of connections, mysql
+	// follows the mysql protocol to move the idle sessions on failover, redis
+	// follows RESP to retry the commands on the new master
+	Mode string `yaml:"mode"`
+	// DialTimeout of connecting the backend master
+	DialTimeout Duration `yaml:"dial_timeout"`
+	// ReadHeaderTimeout of the request headers in http mode, so that slow clients
+	// could not hold the connections
+	ReadHeaderTimeout Duration `yaml:"read_header_timeout"`
+	// IdleTimeout of the keep-alive connections between the requests in http mode
+	IdleTimeout Duration `yaml:"idle_timeout"`
+	// TLS of the clients
+	TLS TLSConfig `yaml:"tls"`
+	// BackendTLS verifies the backend when backend_proxied_scheme is https or tls
+	BackendTLS BackendTLSConfig `yaml:"backend_tls"`
+	// ProxyProtocol keeps the client addresses behind load balancers
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+	// ReadRouting sends the reads to the replicas in http mode
+	ReadRouting ReadRoutingConfig `yaml:"read_routing"`
+	// Replicas of the proxy on replica_proxy_port
+	Replicas ReplicaProxyConfig `yaml:"replicas"`
+	// MySQL of the mysql mode
+	MySQL MySQLConfig `yaml:"mysql"`
+	// Redis of the redis mode
+	Redis RedisConfig `yaml:"redis"`
+}
+
+// TLSConfig terminates or passes through the TLS of the clients
+type TLSConfig struct {
+	// Mode none, terminate by the certificates, or passthrough to the backend
+	// without terminating, only for tcp mode
+	Mode string `yaml:"mode"`
+	// Certificates served by the SNI of clients, the first one is the default
+	Certificates []CertificateConfig `yaml:"certificates"`
+	// ReloadInterval of checking the certificate files, changed ones are reloaded
+	ReloadInterval Duration `yaml:"reload_interval"`
+}
+
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// BackendTLSConfig re-encrypts to the backend
+type BackendTLSConfig struct {
+	// CAFile verifies the backend certificate, empty uses the system roots
+	CAFile string `yaml:"ca_file"`
+	// ServerName verified instead of the host of the backend
+	ServerName string `yaml:"server_name"`
+}
+
+// ProxyProtocolConfig of the HAProxy PROXY protocol
+type ProxyProtocolConfig struct {
+	// Accept requires the header of v1 or v2 from the clients, such as a L4 load balancer
+	Accept bool `yaml:"accept"`
+	// TrustedNetworks in CIDR allowed to connect when accepting, empty allows all
+	TrustedNetworks []string `yaml:"trusted_networks"`
+	// Send the header of v1 or v2 to the backend master, only for tcp mode
+	Send string `yaml:"send"`
+}
+
+// ReadRoutingConfig load balances the reads across the healthy backends which are
+// not the master, the others and the reads without any replica go to the master.
+// Only the sentinel master checks the backends, a sentinel slave routes by the
+// health it knew and never knows the lag.
+type ReadRoutingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Methods of the reads
+	Methods []string `yaml:"methods"`
+	// PathPrefixes limit the reads to the paths, empty for all the paths
+	PathPrefixes []string `yaml:"path_prefixes"`
+	// Header overrides the rules by its value, replica or master
+	Header string `yaml:"header"`
+	// MaxLag excludes the replicas lagging more or not reporting the lag by the
+	// check, 0 for no cap
+	MaxLag Duration `yaml:"max_lag"`
+}
+
+// ReplicaProxyConfig load balances the connections on replica_proxy_port across
+// the healthy backends which are not the master. The connections to a backend
+// are closed once it becomes the master or unhealthy.
+type ReplicaProxyConfig struct {
+	// Strategy round_robin, least_conn or weighted
+	Strategy string `yaml:"strategy"`
+	// Weights of the backends by id for the weighted strategy, 1 if not set and
+	// 0 takes no connection
+	Weights map[string]int `yaml:"weights"`
+	// MaxLag excludes the replicas lagging more or not reporting the lag by the
+	// check, 0 for no cap
+	MaxLag Duration `yaml:"max_lag"`
+	// FallbackToMaster proxies to the master when no replica is available
+	FallbackToMaster bool `yaml:"fallback_to_master"`
+}
+
+// MySQLConfig moves the sessions to the new master on failover. A session is moved
+// when it is not in a transaction or a command, by authenticating again as its
+// user and replaying its schema and SET statements. The sessions of unknown users,
+// or with prepared statements, locks or temporary tables are closed as the tcp
+// proxy does.
+type MySQLConfig struct {
+	// Users whose sessions could be moved, the passwords authenticate them again
+	Users []MySQLUser `yaml:"users"`
+	// FailoverTimeout of waiting for a new master after losing the backend
+	FailoverTimeout Duration `yaml:"failover_timeout"`
+	// DrainTimeout of waiting for the running command before moving the session
+	DrainTimeout Duration `yaml:"drain_timeout"`
+}
+
+type MySQLUser struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+// String hides the password
+func (u MySQLUser) String() string {
+	return u.User + ":***"
+}
+
+// Password returns the password of the user and whether the user is known
+func (c *MySQLConfig) Password(user string) (string, bool) {
+	for _, u := range c.Users {
+		if u.User == user {
+			return u.Password, true
+		}
+	}
+	return "", false
+}
+
+// RedisConfig retries the commands answered READONLY or LOADING by a demoted or
+// loading master once the master changes. The sessions in MULTI, WATCH or pub/sub
+// are closed on failover as the tcp proxy does.
+type RedisConfig struct {
+	// FailoverTimeout of waiting for a new master before answering the error
+	FailoverTimeout Duration `yaml:"failover_timeout"`
+	// AnswerSentinel answers SENTINEL get-master-addr-by-name with the backend
+	// master instead of forwarding it
+	AnswerSentinel bool `yaml:"answer_sentinel"`
+	// MasterName of the master answered to SENTINEL, other names are unknown
+	MasterName string `yaml:"master_name"`
+}
+
+func NewDefaultProxyServer() *ProxyServerConfig {
+	return &ProxyServerConfig{
+		Mode: ProxyModeHTTP,
+		DialTimeout: Duration(5*time.Second),
+		ReadHeaderTimeout: Duration(10*time.Second),
+		IdleTimeout: Duration(90*time.Second),
+		TLS: TLSConfig{
+			Mode: TLSModeNone,
+			ReloadInterval: Duration(10*time.Second),
+		},
+		ReadRouting: ReadRoutingConfig{
+			Methods: []string{"GET", "HEAD"},
+		},
+		Replicas: ReplicaProxyConfig{
+			Strategy: BalanceRoundRobin,
+		},
+		MySQL: MySQLConfig{
+			FailoverTimeout: Duration(30*time.Second),
+			DrainTimeout: Duration(5*time.Second),
+		},
+		Redis: RedisConfig{
+			FailoverTimeout: Duration(30*time.Second),
+			MasterName: "mymaster",
+		},
+	}
+}
+
+// ProxiedScheme returns the scheme of the backend proxied address, it defaults
+// to the plain one of the proxy mode
+func (cfg *Configuration) ProxiedScheme() string {
+	if len(cfg.BackendProxiedScheme) > 0 {
+		return cfg.BackendProxiedScheme
+	}
+	if cfg.Proxy.Mode == ProxyModeHTTP {
+		return "http"
+	}
+	return "tcp"
+}
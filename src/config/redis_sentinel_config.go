@@ -0,0 +1,16 @@
+package config
+
+// RedisSentinelConfig answers the clients of Redis Sentinel with the backend master
+// and replicas, port 0 disables it
+type RedisSentinelConfig struct {
+	// Port on the ip of janus
+	Port int `yaml:"port"`
+	// MasterName the clients ask for, such as mymaster
+	MasterName string `yaml:"master_name"`
+}
+
+func NewDefaultRedisSentinel() *RedisSentinelConfig {
+	return &RedisSentinelConfig{
+		MasterName: "mymaster",
+	}
+}
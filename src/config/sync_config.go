@@ -1,22 +1,60 @@
 package config
 
+import "time"
+
 type SyncConfig struct {
-	Interval int `yaml:"interval"`
-	Timeout int `yaml:"timeout"`
+	Interval Duration `yaml:"interval"`
+	Timeout Duration `yaml:"timeout"`
 	Failure MonitorConfig  `yaml:"failure"`
 	Recover MonitorConfig  `yaml:"recover"`
 	URL string `yaml:"url"`
 	CheckCode bool `yaml:"check_code"`
+	Flap FlapConfig `yaml:"flap"`
+	Degrade DegradeConfig `yaml:"degrade"`
+	// Jitter randomizes each interval by up to this fraction, e.g. 0.1 for 10%
+	Jitter float64 `yaml:"jitter"`
+	Adaptive AdaptiveConfig `yaml:"adaptive"`
 }
 
 type MonitorConfig struct {
 	Count int `yaml:"count"`
 }
 
+// FlapConfig detects peers whose check result keeps flipping, window 0 disables it
+type FlapConfig struct {
+	// Window the number of latest check results kept
+	Window int `yaml:"window"`
+	// High starts flapping when results flip at least High times in the window
+	High int `yaml:"high"`
+	// Low stops flapping when results flip at most Low times in the window
+	Low int `yaml:"low"`
+}
+
+// DegradeConfig marks peers degraded when checks are slow, threshold 0 disables it
+type DegradeConfig struct {
+	// ThresholdMs checks slower than it in milliseconds are slow
+	ThresholdMs int `yaml:"threshold_ms"`
+	// Count continuous slow checks to be degraded, and fast checks to recover
+	Count int `yaml:"count"`
+	// FailMasterAfter treats the master as failed when it keeps degraded for
+	// this many checks, 0 means never
+	FailMasterAfter int `yaml:"fail_master_after"`
+}
+
+// AdaptiveConfig checks faster while a peer is suspect and slower while it is stable
+type AdaptiveConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// FastInterval used after a failed check until the peer succeeds again
+	FastInterval Duration `yaml:"fast_interval"`
+	// SlowInterval used after StableCount continuous successful checks
+	SlowInterval Duration `yaml:"slow_interval"`
+	StableCount int `yaml:"stable_count"`
+}
+
 func NewDefaultSync() *SyncConfig {
 	return &SyncConfig{
-		Interval: 2,
-		Timeout: 3,
+		Interval: Duration(4*time.Second),
+		Timeout: Duration(3*time.Second),
 		Failure: MonitorConfig{
 			Count: 3,
 		},
@@ -25,5 +63,15 @@ func NewDefaultSync() *SyncConfig {
 		},
 		URL: "/health",
 		CheckCode: false,
+		Flap: FlapConfig{
+			Window: 20,
+			High: 6,
+			Low: 2,
+		},
+		Adaptive: AdaptiveConfig{
+			FastInterval: Duration(500*time.Millisecond),
+			SlowInterval: Duration(5*time.Second),
+			StableCount: 10,
+		},
 	}
 }
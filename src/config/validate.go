@@ -0,0 +1,497 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmpei/janus/src/event"
+)
+
+// FieldError is a problem of a config field
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (fe FieldError) String() string {
+	return fmt.Sprintf("%s: %s", fe.Field, fe.Message)
+}
+
+// ValidationError lists all the problems found in the config
+type ValidationError []FieldError
+
+func (ve ValidationError) Error() string {
+	problems := make([]string, 0, len(ve))
+	for _, fe := range ve {
+		problems = append(problems, fe.String())
+	}
+	return fmt.Sprintf("%d config problems: %s", len(ve), strings.Join(problems, "; "))
+}
+
+// validator collects the problems
+type validator struct {
+	errs ValidationError
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errs = append(v.errs, FieldError{
+		Field: field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) port(field string, port int, required bool) {
+	if port == 0 && !required {
+		return
+	}
+	if port < 1 || port > 65535 {
+		v.add(field, "port %d out of range 1-65535", port)
+	}
+}
+
+func (v *validator) positive(field string, d Duration) {
+	if d <= 0 {
+		v.add(field, "should be positive, got %v", d)
+	}
+}
+
+func (v *validator) count(field string, n int) {
+	if n < 1 {
+		v.add(field, "should be at least 1, got %d", n)
+	}
+}
+
+func (v *validator) path(field, p string) {
+	if len(p) == 0 {
+		v.add(field, "is required")
+	} else if !strings.HasPrefix(p, "/") {
+		v.add(field, "should start with /, got %q", p)
+	}
+}
+
+func (v *validator) addresses(field string, addrs []string) {
+	seen := make(map[string]bool, len(addrs))
+	for i, addr := range addrs {
+		f := fmt.Sprintf("%s[%d]", field, i)
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			v.add(f, "invalid address %q, should be host:port", addr)
+		} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			v.add(f, "invalid port in %q", addr)
+		}
+		if seen[addr] {
+			v.add(f, "duplicated %q", addr)
+		}
+		seen[addr] = true
+	}
+}
+
+func (v *validator) sync(field string, c *SyncConfig) {
+	v.positive(field+".interval", c.Interval)
+	v.positive(field+".timeout", c.Timeout)
+	if c.Interval > 0 && c.Timeout >= c.Interval {
+		v.add(field+".timeout", "should be less than interval %v, got %v", c.Interval, c.Timeout)
+	}
+	v.count(field+".failure.count", c.Failure.Count)
+	v.count(field+".recover.count", c.Recover.Count)
+	if c.Jitter < 0 || c.Jitter >= 1 {
+		v.add(field+".jitter", "should be in [0, 1), got %v", c.Jitter)
+	}
+	if c.Flap.Window > 0 {
+		if c.Flap.Window < 2 {
+			v.add(field+".flap.window", "should be at least 2, got %d", c.Flap.Window)
+		}
+		v.count(field+".flap.high", c.Flap.High)
+		if c.Flap.Low < 0 || c.Flap.Low >= c.Flap.High {
+			v.add(field+".flap.low", "should be in [0, high %d), got %d", c.Flap.High, c.Flap.Low)
+		}
+	}
+	if c.Degrade.ThresholdMs < 0 {
+		v.add(field+".degrade.threshold_ms", "should not be negative, got %d", c.Degrade.ThresholdMs)
+	}
+	if c.Degrade.ThresholdMs > 0 {
+		v.count(field+".degrade.count", c.Degrade.Count)
+	}
+	if c.Degrade.FailMasterAfter < 0 {
+		v.add(field+".degrade.fail_master_after", "should not be negative, got %d", c.Degrade.FailMasterAfter)
+	}
+	if c.Adaptive.Enabled {
+		v.positive(field+".adaptive.fast_interval", c.Adaptive.FastInterval)
+		v.positive(field+".adaptive.slow_interval", c.Adaptive.SlowInterval)
+		v.count(field+".adaptive.stable_count", c.Adaptive.StableCount)
+	}
+}
+
+func (v *validator) webhook(field string, c *WebhookConfig) {
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		v.add(field+".url", "should be an http or https url, got %q", c.URL)
+	}
+	for i, e := range c.Events {
+		known := false
+		for _, t := range event.Types {
+			if event.Type(e) == t {
+				known = true
+			}
+		}
+		if !known {
+			v.add(fmt.Sprintf("%s.events[%d]", field, i), "unknown event %q", e)
+		}
+	}
+	if c.Timeout < 0 {
+		v.add(field+".timeout", "should not be negative, got %v", c.Timeout)
+	}
+	if c.Retries < -1 {
+		v.add(field+".retries", "should be at least -1, got %d", c.Retries)
+	}
+	if c.Backoff < 0 {
+		v.add(field+".backoff", "should not be negative, got %v", c.Backoff)
+	}
+}
+
+// Validate checks the whole config, it returns a ValidationError with all the
+// problems found, each of them names the field by its yaml path
+func (cfg *Configuration) Validate() error {
+	v := &validator{}
+
+	if len(cfg.IP) == 0 {
+		v.add("ip", "is required")
+	}
+	v.port("port", cfg.Port, true)
+
+	if len(cfg.Cluster) != 2 {
+		v.add("cluster", "should have 2 nodes, got %d", len(cfg.Cluster))
+	}
+	v.addresses("cluster", cfg.Cluster)
+	self := fmt.Sprintf("%s:%d", cfg.IP, cfg.Port)
+	found := false
+	for _, p := range cfg.Cluster {
+		if p == self || p == cfg.IP {
+			found = true
+		}
+	}
+	if len(cfg.IP) > 0 && cfg.Port > 0 && !found {
+		v.add("cluster", "self %s is not in the cluster", self)
+	}
+
+	// the proxy needs both its own port and the port of backends
+	v.port("proxy_port", cfg.ProxyPort, false)
+	v.port("backend_proxied_port", cfg.BackendProxiedPort, false)
+	if cfg.ProxyPort != 0 && cfg.BackendProxiedPort == 0 {
+		v.add("backend_proxied_port", "is required when proxy_port is set")
+	}
+	if cfg.ProxyPort == 0 && cfg.BackendProxiedPort != 0 {
+		v.add("proxy_port", "is required when backend_proxied_port is set")
+	}
+	v.port("replica_proxy_port", cfg.ReplicaProxyPort, false)
+	if cfg.ReplicaProxyPort != 0 && cfg.BackendProxiedPort == 0 {
+		v.add("backend_proxied_port", "is required when replica_proxy_port is set")
+	}
+	v.proxy(cfg)
+	ports := map[string]int{
+		"port": cfg.Port,
+		"proxy_port": cfg.ProxyPort,
+		"replica_proxy_port": cfg.ReplicaProxyPort,
+		"dns.port": cfg.DNS.Port,
+		"redis_sentinel.port": cfg.RedisSentinel.Port,
+	}
+	v.distinct(ports)
+
+	if len(cfg.Backends) == 0 && len(cfg.Discovery.Provider) == 0 {
+		v.add("backends", "is required unless discovery is enabled")
+	}
+	v.addresses("backends", cfg.Backends)
+	switch cfg.Discovery.Provider {
+	case "":
+	case DiscoveryFile:
+		if len(cfg.Discovery.File) == 0 {
+			v.add("discovery.file", "is required for file provider")
+		}
+	case DiscoveryDNSSRV:
+		if len(cfg.Discovery.Name) == 0 {
+			v.add("discovery.name", "is required for dns_srv provider")
+		}
+	default:
+		v.add("discovery.provider", "should be %s or %s, got %q", DiscoveryFile, DiscoveryDNSSRV, cfg.Discovery.Provider)
+	}
+	if cfg.Discovery.Interval < 0 {
+		v.add("discovery.interval", "should not be negative, got %v", time.Duration(cfg.Discovery.Interval))
+	}
+
+	v.sync("sync", &cfg.Sync)
+	v.peerAuth("peer_auth", &cfg.PeerAuth)
+	v.apiAuth("api_auth", &cfg.APIAuth)
+	if len(cfg.APIAuth.Certificates) > 0 && !cfg.PeerAuth.TLS() {
+		v.add("api_auth.certificates", "need peer_auth.cert_file to serve by https")
+	}
+	v.sync("monitor", &cfg.Monitor)
+	v.path("monitor.url", cfg.Monitor.URL)
+	v.path("to_master", cfg.ToMaster)
+	v.path("to_slave", cfg.ToSlave)
+
+	v.port("dns.port", cfg.DNS.Port, false)
+	if cfg.DNS.Port != 0 {
+		if !validLabel(cfg.DNS.Cluster) {
+			v.add("dns.cluster", "should be a dns label of letters, digits and hyphens, got %q", cfg.DNS.Cluster)
+		}
+		if cfg.DNS.TTL < 0 {
+			v.add("dns.ttl", "should not be negative, got %d", cfg.DNS.TTL)
+		}
+	}
+
+	v.port("redis_sentinel.port", cfg.RedisSentinel.Port, false)
+	if cfg.RedisSentinel.Port != 0 {
+		if len(cfg.RedisSentinel.MasterName) == 0 || strings.ContainsAny(cfg.RedisSentinel.MasterName, " \r\n") {
+			v.add("redis_sentinel.master_name", "should be a name without spaces, got %q", cfg.RedisSentinel.MasterName)
+		}
+		if cfg.BackendProxiedPort == 0 {
+			v.add("backend_proxied_port", "is required when redis_sentinel.port is set")
+		}
+	}
+
+	v.positive("hooks.timeout", cfg.Hooks.Timeout)
+	if len(cfg.VIP.Address) > 0 {
+		if _, _, err := net.ParseCIDR(cfg.VIP.Address); err != nil {
+			v.add("vip.address", "should be an address with prefix length such as 192.168.1.100/24, got %q", cfg.VIP.Address)
+		}
+		if len(cfg.VIP.Interface) == 0 {
+			v.add("vip.interface", "is required when vip.address is set")
+		}
+		if cfg.VIP.ARPCount < 0 {
+			v.add("vip.arp_count", "should not be negative, got %d", cfg.VIP.ARPCount)
+		}
+		if cfg.VIP.SplitBrainHold < 0 {
+			v.add("vip.split_brain_hold", "should not be negative, got %v", cfg.VIP.SplitBrainHold)
+		}
+	}
+	for i := range cfg.Notifications.Webhooks {
+		v.webhook(fmt.Sprintf("notifications.webhooks[%d]", i), &cfg.Notifications.Webhooks[i])
+	}
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+func (v *validator) proxy(cfg *Configuration) {
+	c := &cfg.Proxy
+	schemes := map[string][]string{
+		ProxyModeHTTP: {"http", "https"},
+		ProxyModeTCP: {"tcp", "tls"},
+		// the TLS of mysql is negotiated in the protocol
+		ProxyModeMySQL: {"tcp"},
+		ProxyModeRedis: {"tcp", "tls"},
+	}
+	allowed, ok := schemes[c.Mode]
+	if !ok {
+		v.add("proxy.mode", "should be %s, %s, %s or %s, got %q", ProxyModeHTTP, ProxyModeTCP, ProxyModeMySQL, ProxyModeRedis, c.Mode)
+	} else if scheme := cfg.ProxiedScheme(); !contains(allowed, scheme) {
+		v.add("backend_proxied_scheme", "should be %s for %s proxy, got %q", strings.Join(allowed, " or "), c.Mode, scheme)
+	}
+	v.positive("proxy.dial_timeout", c.DialTimeout)
+	if c.Mode == ProxyModeHTTP {
+		v.positive("proxy.read_header_timeout", c.ReadHeaderTimeout)
+		v.positive("proxy.idle_timeout", c.IdleTimeout)
+	}
+
+	switch c.TLS.Mode {
+	case TLSModeNone:
+	case TLSModeTerminate:
+		if c.Mode == ProxyModeMySQL {
+			v.add("proxy.tls.mode", "mysql mode does not terminate TLS")
+		}
+		if len(c.TLS.Certificates) == 0 {
+			v.add("proxy.tls.certificates", "is required to terminate TLS")
+		}
+		v.positive("proxy.tls.reload_interval", c.TLS.ReloadInterval)
+	case TLSModePassthrough:
+		if c.Mode != ProxyModeTCP {
+			v.add("proxy.tls.mode", "passthrough needs tcp mode")
+		} else if cfg.ProxiedScheme() != "tcp" {
+			v.add("backend_proxied_scheme", "should be tcp to pass TLS through, got %q", cfg.ProxiedScheme())
+		}
+	default:
+		v.add("proxy.tls.mode", "should be %s, %s or %s, got %q", TLSModeNone, TLSModeTerminate, TLSModePassthrough, c.TLS.Mode)
+	}
+	for i, cert := range c.TLS.Certificates {
+		f := fmt.Sprintf("proxy.tls.certificates[%d]", i)
+		v.file(f+".cert_file", cert.CertFile)
+		v.file(f+".key_file", cert.KeyFile)
+	}
+	if len(c.BackendTLS.CAFile) > 0 {
+		v.file("proxy.backend_tls.ca_file", c.BackendTLS.CAFile)
+	}
+
+	for i, network := range c.ProxyProtocol.TrustedNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			v.add(fmt.Sprintf("proxy.proxy_protocol.trusted_networks[%d]", i), "invalid CIDR %q", network)
+		}
+	}
+	switch c.ProxyProtocol.Send {
+	case "":
+	case ProxyProtocolV1, ProxyProtocolV2:
+		if c.Mode == ProxyModeHTTP {
+			v.add("proxy.proxy_protocol.send", "is not supported by http mode")
+		}
+	default:
+		v.add("proxy.proxy_protocol.send", "should be %s or %s, got %q", ProxyProtocolV1, ProxyProtocolV2, c.ProxyProtocol.Send)
+	}
+
+	if c.ReadRouting.Enabled {
+		if c.Mode != ProxyModeHTTP {
+			v.add("proxy.read_routing.enabled", "needs http mode")
+		}
+		if len(c.ReadRouting.Methods) == 0 && len(c.ReadRouting.Header) == 0 {
+			v.add("proxy.read_routing.methods", "is required without a header")
+		}
+	}
+	for i, method := range c.ReadRouting.Methods {
+		if len(method) == 0 || strings.ToUpper(method) != method {
+			v.add(fmt.Sprintf("proxy.read_routing.methods[%d]", i), "should be an upper case method, got %q", method)
+		}
+	}
+	for i, prefix := range c.ReadRouting.PathPrefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			v.add(fmt.Sprintf("proxy.read_routing.path_prefixes[%d]", i), "should start with /, got %q", prefix)
+		}
+	}
+	if c.ReadRouting.MaxLag < 0 {
+		v.add("proxy.read_routing.max_lag", "should not be negative")
+	}
+
+	switch c.Replicas.Strategy {
+	case BalanceRoundRobin, BalanceLeastConn, BalanceWeighted:
+	default:
+		v.add("proxy.replicas.strategy", "should be %s, %s or %s, got %q", BalanceRoundRobin, BalanceLeastConn, BalanceWeighted, c.Replicas.Strategy)
+	}
+	for id, weight := range c.Replicas.Weights {
+		if weight < 0 {
+			v.add(fmt.Sprintf("proxy.replicas.weights[%s]", id), "should not be negative")
+		}
+	}
+	if c.Replicas.MaxLag < 0 {
+		v.add("proxy.replicas.max_lag", "should not be negative")
+	}
+
+	users := make(map[string]bool)
+	for i, u := range c.MySQL.Users {
+		f := fmt.Sprintf("proxy.mysql.users[%d].user", i)
+		if len(u.User) == 0 {
+			v.add(f, "is required")
+		} else if users[u.User] {
+			v.add(f, "duplicate user %s", u.User)
+		}
+		users[u.User] = true
+	}
+	v.positive("proxy.mysql.failover_timeout", c.MySQL.FailoverTimeout)
+	v.positive("proxy.mysql.drain_timeout", c.MySQL.DrainTimeout)
+
+	v.positive("proxy.redis.failover_timeout", c.Redis.FailoverTimeout)
+	if c.Redis.AnswerSentinel && len(c.Redis.MasterName) == 0 {
+		v.add("proxy.redis.master_name", "is required to answer SENTINEL")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *validator) peerAuth(field string, c *PeerAuthConfig) {
+	if len(c.CertFile) > 0 || len(c.KeyFile) > 0 || len(c.CAFile) > 0 {
+		v.file(field+".cert_file", c.CertFile)
+		v.file(field+".key_file", c.KeyFile)
+		v.file(field+".ca_file", c.CAFile)
+	}
+	if len(c.Secret) > 0 && len(c.Secret) < MinSecretLength {
+		v.add(field+".secret", "should be at least %d characters", MinSecretLength)
+	}
+	v.positive(field+".max_skew", c.MaxSkew)
+}
+
+func (v *validator) apiAuth(field string, c *APIAuthConfig) {
+	names := make(map[string]bool, len(c.Tokens))
+	for i, t := range c.Tokens {
+		f := fmt.Sprintf("%s.tokens[%d]", field, i)
+		if len(t.Name) == 0 {
+			v.add(f+".name", "is required")
+		} else if names[t.Name] {
+			v.add(f+".name", "duplicated %q", t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Token) < MinSecretLength {
+			v.add(f+".token", "should be at least %d characters", MinSecretLength)
+		}
+		v.role(f+".role", t.Role)
+	}
+	for i, c := range c.Certificates {
+		f := fmt.Sprintf("%s.certificates[%d]", field, i)
+		if len(c.CommonName) == 0 {
+			v.add(f+".common_name", "is required")
+		}
+		v.role(f+".role", c.Role)
+	}
+}
+
+func (v *validator) role(field, role string) {
+	if role != RoleRead && role != RoleAdmin {
+		v.add(field, "should be %s or %s, got %q", RoleRead, RoleAdmin, role)
+	}
+}
+
+// file checks the file is set and readable
+func (v *validator) file(field, name string) {
+	if len(name) == 0 {
+		v.add(field, "is required")
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		v.add(field, "%v", err)
+		return
+	}
+	f.Close()
+}
+
+// validLabel returns whether s is a dns label
+func validLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// distinct checks the ports which are set do not conflict with each other
+func (v *validator) distinct(ports map[string]int) {
+	names := []string{}
+	for name := range ports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	used := make(map[int]string, len(ports))
+	for _, name := range names {
+		port := ports[name]
+		if port == 0 {
+			continue
+		}
+		if other, ok := used[port]; ok {
+			v.add(name, "port %d is already used by %s", port, other)
+			continue
+		}
+		used[port] = name
+	}
+}
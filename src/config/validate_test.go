@@ -0,0 +1,105 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func validConfig() *Configuration {
+	c := NewDefaultConfiguration()
+	c.IP = "127.0.0.1"
+	c.Port = 9000
+	c.Cluster = []string{"127.0.0.1:9000", "127.0.0.1:9001"}
+	c.Backends = []string{"127.0.0.1:9090"}
+	c.Monitor.URL = "/status"
+	c.ToMaster = "/master"
+	c.ToSlave = "/slave"
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Configuration)
+		// fields of the problems in order
+		want []string
+	}{
+		{
+			name:   "valid",
+			change: func(c *Configuration) {},
+		},
+		{
+			name:   "defaults",
+			change: func(c *Configuration) { *c = *NewDefaultConfiguration() },
+			want:   []string{"ip", "port", "cluster", "backends", "to_master", "to_slave"},
+		},
+		{
+			name: "self not in cluster",
+			change: func(c *Configuration) {
+				c.Port = 9002
+			},
+			want: []string{"cluster"},
+		},
+		{
+			name: "ports",
+			change: func(c *Configuration) {
+				c.ProxyPort = 9000
+				c.Cluster = []string{"127.0.0.1:9000", "127.0.0.1:70000"}
+			},
+			want: []string{"cluster[1]", "backend_proxied_port", "proxy_port"},
+		},
+		{
+			name: "sync",
+			change: func(c *Configuration) {
+				c.Sync.Interval = Duration(2 * time.Second)
+				c.Sync.Timeout = Duration(2 * time.Second)
+				c.Sync.Failure.Count = 0
+				c.Monitor.Interval = 0
+				c.Monitor.Jitter = 1
+			},
+			want: []string{"sync.timeout", "sync.failure.count", "monitor.interval", "monitor.jitter"},
+		},
+		{
+			name: "discovery",
+			change: func(c *Configuration) {
+				c.Backends = nil
+				c.Discovery.Provider = DiscoveryDNSSRV
+				c.Discovery.Interval = Duration(-time.Second)
+			},
+			want: []string{"discovery.name", "discovery.interval"},
+		},
+		{
+			name: "paths",
+			change: func(c *Configuration) {
+				c.Monitor.URL = "status"
+				c.ToSlave = ""
+			},
+			want: []string{"monitor.url", "to_slave"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig()
+			tt.change(c)
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("error = %v", err)
+				}
+				return
+			}
+			ve, ok := err.(ValidationError)
+			if !ok {
+				t.Fatalf("error = %#v, want a ValidationError", err)
+			}
+			var fields []string
+			for _, fe := range ve {
+				fields = append(fields, fe.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.want) {
+				t.Errorf("problems %v, want fields %v", ve, tt.want)
+			}
+		})
+	}
+}
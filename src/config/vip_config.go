@@ -0,0 +1,23 @@
+package config
+
+import "time"
+
+// VIPConfig floats an address to the sentinel master janus, empty address disables it
+type VIPConfig struct {
+	// Address with the prefix length, such as 192.168.1.100/24
+	Address string `yaml:"address"`
+	// Interface the address is added on, such as eth0
+	Interface string `yaml:"interface"`
+	// ARPCount gratuitous ARP sent after taking the address
+	ARPCount int `yaml:"arp_count"`
+	// SplitBrainHold refuses taking the address for this long after the split
+	// brain is cleared, it is refused all the time it is suspected
+	SplitBrainHold Duration `yaml:"split_brain_hold"`
+}
+
+func NewDefaultVIP() *VIPConfig {
+	return &VIPConfig{
+		ARPCount: 3,
+		SplitBrainHold: Duration(30*time.Second),
+	}
+}
@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultInterval = 10 * time.Second
+
+// Provider discovers the backends. It sends the full list of backend control
+// addresses to updates whenever it is read, until ctx is done.
+type Provider interface {
+	Name() string
+	Run(ctx context.Context, updates chan<- []string) error
+}
+
+// NewProvider creates the provider configured
+func NewProvider(c *config.DiscoveryConfig) (Provider, error) {
+	interval := time.Duration(c.Interval)
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	switch c.Provider {
+	case config.DiscoveryFile:
+		if len(c.File) == 0 {
+			return nil, fmt.Errorf("discovery file is required for file provider")
+		}
+		return NewFileProvider(c.File, interval), nil
+	case config.DiscoveryDNSSRV:
+		if len(c.Name) == 0 {
+			return nil, fmt.Errorf("discovery name is required for dns_srv provider")
+		}
+		return NewDNSSRVProvider(c.Name, c.Resolver, interval), nil
+	}
+	return nil, fmt.Errorf("unknown discovery provider %q", c.Provider)
+}
+
+// Watch runs the provider and calls apply whenever the backends change
+func Watch(ctx context.Context, p Provider, apply func(backends []string)) {
+	updates := make(chan []string)
+	go func() {
+		if err := p.Run(ctx, updates); err != nil {
+			log.Errorf("discovery %s stopped: %v", p.Name(), err)
+		}
+	}()
+
+	var last []string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case backends := <-updates:
+			if len(backends) == 0 {
+				log.Warningf("discovery %s found no backends, ignore it", p.Name())
+				continue
+			}
+			sort.Strings(backends)
+			if equal(last, backends) {
+				continue
+			}
+			log.Infof("discovery %s found backends: %v", p.Name(), backends)
+			last = backends
+			apply(backends)
+		}
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// send delivers the backends unless ctx is done
+func send(ctx context.Context, updates chan<- []string, backends []string) {
+	select {
+	case updates <- backends:
+	case <-ctx.Done():
+	}
+}
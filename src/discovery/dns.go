@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DNSSRVProvider resolves a SRV record periodically, each target and port of it
+// is a backend control address
+type DNSSRVProvider struct {
+	name     string
+	interval time.Duration
+	resolver *net.Resolver
+}
+
+// NewDNSSRVProvider resolves name by the dns server at resolver, or by the system
+// resolver if it is empty
+func NewDNSSRVProvider(name, resolver string, interval time.Duration) *DNSSRVProvider {
+	r := net.DefaultResolver
+	if len(resolver) > 0 {
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	return &DNSSRVProvider{
+		name: name,
+		interval: interval,
+		resolver: r,
+	}
+}
+
+func (p *DNSSRVProvider) Name() string {
+	return "dns_srv:" + p.name
+}
+
+func (p *DNSSRVProvider) Run(ctx context.Context, updates chan<- []string) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		backends, err := p.resolve(ctx)
+		if err != nil {
+			log.Errorf("discovery resolve %s error: %v", p.name, err)
+		} else {
+			send(ctx, updates, backends)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *DNSSRVProvider) resolve(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+	_, records, err := p.resolver.LookupSRV(ctx, "", "", p.name)
+	if err != nil {
+		return nil, err
+	}
+	backends := make([]string, 0, len(records))
+	for _, record := range records {
+		host := strings.TrimSuffix(record.Target, ".")
+		backends = append(backends, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return backends, nil
+}
@@ -0,0 +1,163 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const typeSRV uint16 = 33
+
+type srv struct {
+	target string
+	port   uint16
+}
+
+// appendName appends the name in the dns wire format
+func appendName(b []byte, name string) []byte {
+	for _, label := range append(strings.Split(strings.TrimSuffix(name, "."), "."), "") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return b
+}
+
+// parseQuestion returns the name and the type asked, and the end of the question
+func parseQuestion(msg []byte) (string, uint16, int, bool) {
+	var labels []string
+	i := 12
+	for i < len(msg) && msg[i] != 0 {
+		n := int(msg[i])
+		if n&0xc0 != 0 || i+1+n > len(msg) {
+			return "", 0, 0, false
+		}
+		labels = append(labels, string(msg[i+1:i+1+n]))
+		i += 1 + n
+	}
+	if i+5 > len(msg) {
+		return "", 0, 0, false
+	}
+	return strings.Join(labels, ".") + ".", binary.BigEndian.Uint16(msg[i+1:]), i + 5, true
+}
+
+// stubDNS answers the SRV queries of name on a local udp port until the test ends
+func stubDNS(t *testing.T, name string, records func() []srv) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 12 {
+				continue
+			}
+			qname, qtype, end, ok := parseQuestion(buf[:n])
+			if !ok {
+				continue
+			}
+			var answers []srv
+			rcode := uint16(3) // NXDOMAIN
+			if strings.EqualFold(qname, name) && qtype == typeSRV {
+				answers = records()
+				rcode = 0
+			}
+			resp := append([]byte(nil), buf[:2]...)
+			resp = binary.BigEndian.AppendUint16(resp, 0x8180|rcode)
+			resp = binary.BigEndian.AppendUint16(resp, 1)
+			resp = binary.BigEndian.AppendUint16(resp, uint16(len(answers)))
+			resp = binary.BigEndian.AppendUint16(resp, 0)
+			resp = binary.BigEndian.AppendUint16(resp, 0)
+			resp = append(resp, buf[12:end]...)
+			for _, r := range answers {
+				data := binary.BigEndian.AppendUint16(nil, 10)
+				data = binary.BigEndian.AppendUint16(data, 100)
+				data = binary.BigEndian.AppendUint16(data, r.port)
+				data = appendName(data, r.target)
+				resp = append(resp, 0xc0, 12) // the name asked
+				resp = binary.BigEndian.AppendUint16(resp, typeSRV)
+				resp = binary.BigEndian.AppendUint16(resp, 1)
+				resp = binary.BigEndian.AppendUint32(resp, 5)
+				resp = binary.BigEndian.AppendUint16(resp, uint16(len(data)))
+				resp = append(resp, data...)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDNSSRVProviderResolve(t *testing.T) {
+	server := stubDNS(t, "_janus._tcp.db.example.", func() []srv {
+		return []srv{{"db-1.example.", 9090}, {"db-2.example", 9091}}
+	})
+	p := NewDNSSRVProvider("_janus._tcp.db.example.", server, time.Second)
+	backends, err := p.resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(backends)
+	if want := []string{"db-1.example:9090", "db-2.example:9091"}; !reflect.DeepEqual(backends, want) {
+		t.Errorf("backends = %v, want %v", backends, want)
+	}
+
+	p = NewDNSSRVProvider("_other._tcp.db.example.", server, time.Second)
+	if backends, err := p.resolve(context.Background()); err == nil {
+		t.Errorf("unknown name resolved to %v", backends)
+	}
+}
+
+func TestWatchDNSSRV(t *testing.T) {
+	records := make(chan []srv, 1)
+	current := []srv{{"db-1.example", 9090}}
+	server := stubDNS(t, "_janus._tcp.db.example.", func() []srv {
+		select {
+		case current = <-records:
+		default:
+		}
+		return current
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	applied := make(chan []string, 10)
+	go Watch(ctx, NewDNSSRVProvider("_janus._tcp.db.example.", server, 20*time.Millisecond), func(backends []string) {
+		applied <- backends
+	})
+
+	wait := func(want []string) {
+		t.Helper()
+		select {
+		case backends := <-applied:
+			if !reflect.DeepEqual(backends, want) {
+				t.Fatalf("applied %v, want %v", backends, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%v not applied", want)
+		}
+	}
+	wait([]string{"db-1.example:9090"})
+
+	// an empty answer is ignored, the same backends are applied once
+	records <- nil
+	time.Sleep(100 * time.Millisecond)
+	records <- []srv{{"db-1.example", 9090}}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case backends := <-applied:
+		t.Fatalf("applied %v again", backends)
+	default:
+	}
+
+	records <- []srv{{"db-2.example", 9091}, {"db-1.example", 9090}}
+	wait([]string{"db-1.example:9090", "db-2.example:9091"})
+}
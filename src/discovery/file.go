@@ -0,0 +1,91 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// FileProvider reads the backends from a json or yaml file. The file could be a
+// list of addresses, or a map with the list under "backends". It is watched by
+// inotify where supported, and polled as well in case the events are lost.
+type FileProvider struct {
+	file     string
+	interval time.Duration
+}
+
+func NewFileProvider(file string, interval time.Duration) *FileProvider {
+	return &FileProvider{
+		file: file,
+		interval: interval,
+	}
+}
+
+func (p *FileProvider) Name() string {
+	return "file:" + p.file
+}
+
+func (p *FileProvider) Run(ctx context.Context, updates chan<- []string) error {
+	changed, err := watchFile(ctx, p.file)
+	if err != nil {
+		log.Warningf("watch %s error: %v, polling only", p.file, err)
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	var modTime time.Time
+	load := func() {
+		if info, err := os.Stat(p.file); err == nil {
+			modTime = info.ModTime()
+		}
+		backends, err := p.read()
+		if err != nil {
+			log.Errorf("discovery read %s error: %v", p.file, err)
+			return
+		}
+		send(ctx, updates, backends)
+	}
+
+	load()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+			load()
+		case <-ticker.C:
+			info, err := os.Stat(p.file)
+			if err != nil {
+				log.Errorf("discovery stat %s error: %v", p.file, err)
+				continue
+			}
+			if !info.ModTime().Equal(modTime) {
+				load()
+			}
+		}
+	}
+}
+
+func (p *FileProvider) read() ([]string, error) {
+	buffer, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return nil, err
+	}
+	// json is valid yaml, so both are parsed as yaml
+	var list []string
+	if err := yaml.Unmarshal(buffer, &list); err == nil {
+		return list, nil
+	}
+	doc := struct {
+		Backends []string `yaml:"backends"`
+	}{}
+	if err := yaml.Unmarshal(buffer, &doc); err != nil {
+		return nil, fmt.Errorf("neither a list nor a map with backends: %v", err)
+	}
+	return doc.Backends, nil
+}
@@ -0,0 +1,61 @@
+//go:build linux
+// +build linux
+
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchFile signals when the file is written, created, moved or removed. The
+// directory is watched, so replacing the file by rename is noticed as well.
+func watchFile(ctx context.Context, file string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, filepath.Dir(file), mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// non-blocking fd is served by the runtime poller, closing it unblocks the read
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	name := []byte(filepath.Base(file))
+	changed := make(chan struct{}, 1)
+	go func() {
+		buffer := make([]byte, 4096)
+		for {
+			n, err := f.Read(buffer)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				start := offset + syscall.SizeofInotifyEvent
+				end := start + int(event.Len)
+				if end > n {
+					break
+				}
+				if bytes.Equal(bytes.TrimRight(buffer[start:end], "\x00"), name) {
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+				offset = end
+			}
+		}
+	}()
+	return changed, nil
+}
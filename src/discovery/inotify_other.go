@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package discovery
+
+import (
+	"context"
+	"fmt"
+)
+
+// watchFile is not supported, the file is polled only
+func watchFile(ctx context.Context, file string) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("inotify is not supported")
+}
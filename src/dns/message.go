@@ -0,0 +1,181 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// the subset of RFC 1035 needed to answer A and AAAA queries authoritatively
+const (
+	TypeA    uint16 = 1
+	TypeNS   uint16 = 2
+	TypeSOA  uint16 = 6
+	TypeAAAA uint16 = 28
+	TypeANY  uint16 = 255
+
+	ClassIN uint16 = 1
+
+	RcodeSuccess  = 0
+	RcodeFormErr  = 1
+	RcodeServFail = 2
+	RcodeNXDomain = 3
+	RcodeNotImp   = 4
+	RcodeRefused  = 5
+
+	headerSize = 12
+	// MaxUDPSize of the responses without EDNS, the larger ones are truncated
+	MaxUDPSize = 512
+)
+
+var errFormat = errors.New("malformed dns message")
+
+// Question is the only question of a query
+type Question struct {
+	// Name in lower case with the trailing dot
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Query is a parsed request
+type Query struct {
+	Id        uint16
+	Opcode    int
+	Recursion bool
+	Question  Question
+	// raw question section, echoed in the response
+	raw []byte
+}
+
+// Record is a resource record of the answer or authority section
+type Record struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+// ParseQuery parses a request with exactly one question
+func ParseQuery(b []byte) (*Query, error) {
+	if len(b) < headerSize {
+		return nil, errFormat
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	q := &Query{
+		Id:        binary.BigEndian.Uint16(b),
+		Opcode:    int(flags>>11) & 0xf,
+		Recursion: flags&0x100 != 0,
+	}
+	// responses are never answered, so that two servers could not loop
+	if flags&0x8000 != 0 {
+		return nil, errFormat
+	}
+	if binary.BigEndian.Uint16(b[4:]) != 1 {
+		return q, errFormat
+	}
+	var labels []string
+	offset := headerSize
+	for {
+		if offset >= len(b) {
+			return q, errFormat
+		}
+		n := int(b[offset])
+		offset++
+		if n == 0 {
+			break
+		}
+		// compression is not expected in the question
+		if n > 63 || offset+n > len(b) {
+			return q, errFormat
+		}
+		labels = append(labels, string(b[offset:offset+n]))
+		offset += n
+	}
+	if offset+4 > len(b) {
+		return q, errFormat
+	}
+	q.Question = Question{
+		Name:  strings.ToLower(strings.Join(labels, ".")) + ".",
+		Type:  binary.BigEndian.Uint16(b[offset:]),
+		Class: binary.BigEndian.Uint16(b[offset+2:]),
+	}
+	q.raw = b[headerSize : offset+4]
+	return q, nil
+}
+
+// Response builds the authoritative response of the query, the records larger
+// than limit are dropped with the truncated flag set
+func (q *Query) Response(rcode int, answers, authority []Record, limit int) []byte {
+	flags := uint16(0x8000|0x0400) | uint16(q.Opcode)<<11 | uint16(rcode)
+	if q.Recursion {
+		flags |= 0x0100
+	}
+	b := make([]byte, headerSize, MaxUDPSize)
+	binary.BigEndian.PutUint16(b, q.Id)
+	if q.raw != nil {
+		binary.BigEndian.PutUint16(b[4:], 1)
+		b = append(b, q.raw...)
+	}
+	header := len(b)
+	for _, r := range answers {
+		b = r.append(b)
+	}
+	for _, r := range authority {
+		b = r.append(b)
+	}
+	if limit > 0 && len(b) > limit {
+		b = b[:header]
+		flags |= 0x0200
+		answers, authority = nil, nil
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(authority)))
+	return b
+}
+
+func (r Record) append(b []byte) []byte {
+	b = appendName(b, r.Name)
+	b = binary.BigEndian.AppendUint16(b, r.Type)
+	b = binary.BigEndian.AppendUint16(b, ClassIN)
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+	return append(b, r.Data...)
+}
+
+func appendName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// AddressRecord returns the A or AAAA record of the ip
+func AddressRecord(name string, ttl uint32, ip net.IP) Record {
+	if ip4 := ip.To4(); ip4 != nil {
+		return Record{Name: name, Type: TypeA, TTL: ttl, Data: ip4}
+	}
+	return Record{Name: name, Type: TypeAAAA, TTL: ttl, Data: ip.To16()}
+}
+
+// SOARecord returns the start of authority of the zone, the minimum is the ttl of
+// the negative answers
+func SOARecord(zone, ns string, ttl uint32, serial uint32) Record {
+	data := appendName(nil, ns)
+	data = appendName(data, "hostmaster."+zone)
+	for _, v := range []uint32{serial, 60, 10, 600, ttl} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return Record{Name: zone, Type: TypeSOA, TTL: ttl, Data: data}
+}
+
+// NSRecord returns the name server of the zone
+func NSRecord(zone, ns string, ttl uint32) Record {
+	return Record{Name: zone, Type: TypeNS, TTL: ttl, Data: appendName(nil, ns)}
+}
@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// query builds a request of the header fields and the question labels
+func query(id, flags, qdcount uint16, labels []string, qtype, qclass uint16) []byte {
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], qdcount)
+	for _, label := range labels {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	return binary.BigEndian.AppendUint16(b, qclass)
+}
+
+func TestParseQuery(t *testing.T) {
+	master := []string{"master", "db", "janus"}
+	long := make([]byte, 64)
+	for i := range long {
+		long[i] = 'a'
+	}
+	tests := []struct {
+		name    string
+		request []byte
+		// nil is expected when the request should be ignored
+		query *Query
+		err   bool
+	}{
+		{
+			name:    "a query",
+			request: query(0x1234, 0x0100, 1, master, TypeA, ClassIN),
+			query: &Query{Id: 0x1234, Recursion: true, Question: Question{
+				Name: "master.db.janus.", Type: TypeA, Class: ClassIN,
+			}},
+		},
+		{
+			name:    "lower cased name",
+			request: query(1, 0, 1, []string{"Replicas", "DB", "janus"}, TypeAAAA, ClassIN),
+			query: &Query{Id: 1, Question: Question{
+				Name: "replicas.db.janus.", Type: TypeAAAA, Class: ClassIN,
+			}},
+		},
+		{
+			name:    "root name",
+			request: query(2, 0, 1, nil, TypeNS, ClassIN),
+			query:   &Query{Id: 2, Question: Question{Name: ".", Type: TypeNS, Class: ClassIN}},
+		},
+		{
+			name:    "opcode",
+			request: query(3, 2<<11, 1, master, TypeA, ClassIN),
+			query: &Query{Id: 3, Opcode: 2, Question: Question{
+				Name: "master.db.janus.", Type: TypeA, Class: ClassIN,
+			}},
+		},
+		{
+			name:    "short header",
+			request: []byte{0, 1, 0, 0},
+			err:     true,
+		},
+		{
+			name:    "response ignored",
+			request: query(4, 0x8000, 1, master, TypeA, ClassIN),
+			err:     true,
+		},
+		{
+			name:    "no question",
+			request: query(5, 0, 0, master, TypeA, ClassIN),
+			query:   &Query{Id: 5},
+			err:     true,
+		},
+		{
+			name:    "two questions",
+			request: query(6, 0, 2, master, TypeA, ClassIN),
+			query:   &Query{Id: 6},
+			err:     true,
+		},
+		{
+			name:    "label too long",
+			request: query(7, 0, 1, []string{string(long)}, TypeA, ClassIN),
+			query:   &Query{Id: 7},
+			err:     true,
+		},
+		{
+			name:    "compressed name",
+			request: append(query(8, 0, 1, nil, TypeA, ClassIN)[:headerSize], 0xc0, 0x0c, 0, 1, 0, 1),
+			query:   &Query{Id: 8},
+			err:     true,
+		},
+		{
+			name:    "truncated label",
+			request: query(9, 0, 1, master, TypeA, ClassIN)[:headerSize+4],
+			query:   &Query{Id: 9},
+			err:     true,
+		},
+		{
+			name:    "no type",
+			request: query(10, 0, 1, master, TypeA, ClassIN)[:headerSize+18],
+			query:   &Query{Id: 10},
+			err:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := ParseQuery(tt.request)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if tt.query == nil {
+				if q != nil {
+					t.Fatalf("query = %+v, want nil", q)
+				}
+				return
+			}
+			if q == nil {
+				t.Fatalf("query = nil, want %+v", tt.query)
+			}
+			if q.Id != tt.query.Id || q.Opcode != tt.query.Opcode || q.Recursion != tt.query.Recursion {
+				t.Errorf("header = %d %d %v, want %d %d %v", q.Id, q.Opcode, q.Recursion, tt.query.Id, tt.query.Opcode, tt.query.Recursion)
+			}
+			if !tt.err && q.Question != tt.query.Question {
+				t.Errorf("question = %+v, want %+v", q.Question, tt.query.Question)
+			}
+		})
+	}
+}
+
+func TestResponseEchoesQuestion(t *testing.T) {
+	request := query(0x4242, 0x0100, 1, []string{"master", "db", "janus"}, TypeA, ClassIN)
+	q, err := ParseQuery(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := q.Response(RcodeSuccess, []Record{AddressRecord(q.Question.Name, 5, []byte{10, 0, 0, 1})}, nil, MaxUDPSize)
+	if got := binary.BigEndian.Uint16(resp); got != 0x4242 {
+		t.Errorf("id = %#x, want 0x4242", got)
+	}
+	flags := binary.BigEndian.Uint16(resp[2:])
+	if flags&0x8000 == 0 || flags&0x0400 == 0 || flags&0x0100 == 0 {
+		t.Errorf("flags = %#x, want response, authoritative and recursion desired", flags)
+	}
+	if got := string(resp[headerSize : len(request)]); got != string(request[headerSize:]) {
+		t.Errorf("question = %q, want %q", got, request[headerSize:])
+	}
+	if an := binary.BigEndian.Uint16(resp[6:]); an != 1 {
+		t.Errorf("answers = %d, want 1", an)
+	}
+
+	// a response over the limit is truncated to the question
+	resp = q.Response(RcodeSuccess, []Record{AddressRecord(q.Question.Name, 5, []byte{10, 0, 0, 1})}, nil, len(request))
+	if flags := binary.BigEndian.Uint16(resp[2:]); flags&0x0200 == 0 {
+		t.Errorf("flags = %#x, want truncated", flags)
+	}
+	if len(resp) != len(request) || binary.BigEndian.Uint16(resp[6:]) != 0 {
+		t.Errorf("truncated response has %d bytes and %d answers", len(resp), binary.BigEndian.Uint16(resp[6:]))
+	}
+}
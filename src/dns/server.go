@@ -0,0 +1,315 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/metrics"
+	jsync "github.com/mmpei/janus/src/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Domain of the zones, the zone of a cluster is <cluster>.janus.
+	Domain = "janus."
+	// lookupTimeout of resolving the backends named by host names
+	lookupTimeout = time.Second
+	// resolveInterval the host names of the backends are resolved again by
+	resolveInterval = 10 * time.Second
+	// tcpTimeout closes the idle tcp connections
+	tcpTimeout = 10 * time.Second
+)
+
+var queriesTotal = metrics.NewCounterVec("janus_dns_queries_total",
+	"Dns queries by name and response code.", "name", "rcode")
+
+var rcodeNames = map[int]string{
+	RcodeSuccess:  "NOERROR",
+	RcodeFormErr:  "FORMERR",
+	RcodeServFail: "SERVFAIL",
+	RcodeNXDomain: "NXDOMAIN",
+	RcodeNotImp:   "NOTIMP",
+	RcodeRefused:  "REFUSED",
+}
+
+// Server answers master.<cluster>.janus. with the backend master and
+// replicas.<cluster>.janus. with the healthy others. The answers are computed from
+// the sentinel on each query, so they follow an election right away. A sentinel
+// slave answers the master learned by syncing. The backends named by host names
+// are resolved in the background, a query never waits for it.
+type Server struct {
+	addr      string
+	ttl       uint32
+	sentinel  *jsync.Sentinel
+	epMonitor *jsync.MonitorManager
+
+	zone     string
+	ns       string
+	master   string
+	replicas string
+	// serial of the zone, the start time
+	serial uint32
+
+	// hosts are the ips of the backend host names
+	lock  sync.Mutex
+	hosts map[string][]net.IP
+}
+
+func NewServer(ip string, cfg *config.DNSConfig, s *jsync.Sentinel, mm *jsync.MonitorManager) *Server {
+	zone := strings.ToLower(cfg.Cluster) + "." + Domain
+	return &Server{
+		addr:      net.JoinHostPort(ip, strconv.Itoa(cfg.Port)),
+		ttl:       uint32(cfg.TTL),
+		sentinel:  s,
+		epMonitor: mm,
+		zone:      zone,
+		ns:        "ns." + zone,
+		master:    "master." + zone,
+		replicas:  "replicas." + zone,
+		serial:    uint32(time.Now().Unix()),
+		hosts:     make(map[string][]net.IP),
+	}
+}
+
+// ListenAndServe serves both udp and tcp, it returns when either fails
+func (s *Server) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Infof("dns responder of zone %s listen on %s", s.zone, s.addr)
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.resolve(done)
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- s.serveUDP(pc)
+	}()
+	go func() {
+		errs <- s.serveTCP(l)
+	}()
+	return <-errs
+}
+
+func (s *Server) serveUDP(pc net.PacketConn) error {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if resp := s.handle(buffer[:n], MaxUDPSize); resp != nil {
+			if _, err := pc.WriteTo(resp, addr); err != nil {
+				log.Debugf("dns write to %s error: %v", addr, err)
+			}
+		}
+	}
+}
+
+func (s *Server) serveTCP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the length prefixed queries until the client closes
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(tcpTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		request := make([]byte, length)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		resp := s.handle(request, 0)
+		if resp == nil {
+			return
+		}
+		prefix := make([]byte, 2)
+		binary.BigEndian.PutUint16(prefix, uint16(len(resp)))
+		if _, err := conn.Write(append(prefix, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the response of the request, nil if it should be ignored
+func (s *Server) handle(request []byte, limit int) []byte {
+	q, err := ParseQuery(request)
+	if q == nil {
+		return nil
+	}
+	if err != nil {
+		queriesTotal.Inc("other", rcodeNames[RcodeFormErr])
+		return q.Response(RcodeFormErr, nil, nil, limit)
+	}
+	if q.Opcode != 0 {
+		queriesTotal.Inc("other", rcodeNames[RcodeNotImp])
+		return q.Response(RcodeNotImp, nil, nil, limit)
+	}
+	rcode, answers, authority := s.Answer(q.Question)
+	queriesTotal.Inc(s.label(q.Question.Name), rcodeNames[rcode])
+	return q.Response(rcode, answers, authority, limit)
+}
+
+func (s *Server) label(name string) string {
+	switch name {
+	case s.master:
+		return "master"
+	case s.replicas:
+		return "replicas"
+	}
+	return "other"
+}
+
+// Answer returns the response code and records of the question
+func (s *Server) Answer(q Question) (int, []Record, []Record) {
+	if q.Class != ClassIN {
+		return RcodeNotImp, nil, nil
+	}
+	if q.Name != s.zone && !strings.HasSuffix(q.Name, "."+s.zone) {
+		return RcodeRefused, nil, nil
+	}
+	soa := []Record{SOARecord(s.zone, s.ns, s.ttl, s.serial)}
+
+	var ips []net.IP
+	switch q.Name {
+	case s.zone:
+		var answers []Record
+		if q.Type == TypeSOA || q.Type == TypeANY {
+			answers = append(answers, soa[0])
+		}
+		if q.Type == TypeNS || q.Type == TypeANY {
+			answers = append(answers, NSRecord(s.zone, s.ns, s.ttl))
+		}
+		if len(answers) == 0 {
+			return RcodeSuccess, nil, soa
+		}
+		return RcodeSuccess, answers, nil
+	case s.ns:
+		if ip := net.ParseIP(config.ProxyConfig.IP); ip != nil {
+			ips = append(ips, ip)
+		}
+	case s.master:
+		if peer := s.sentinel.GetMasterPeer(); peer != nil {
+			ips = s.lookup(peer.PeerAddr)
+		}
+	case s.replicas:
+		master := s.sentinel.GetMaster()
+		for _, peer := range s.epMonitor.Snapshot() {
+			if peer.Alive && peer.PeerId != master && !peer.Flapping && !peer.Degraded {
+				ips = append(ips, s.lookup(peer.PeerAddr)...)
+			}
+		}
+	default:
+		return RcodeNXDomain, nil, soa
+	}
+
+	var answers []Record
+	for _, ip := range ips {
+		r := AddressRecord(q.Name, s.ttl, ip)
+		if r.Type == q.Type || q.Type == TypeANY {
+			answers = append(answers, r)
+		}
+	}
+	if len(answers) == 0 {
+		// no master elected yet, or no address of the type
+		return RcodeSuccess, nil, soa
+	}
+	return RcodeSuccess, answers, nil
+}
+
+// resolve resolves the host names of the backends periodically until done
+func (s *Server) resolve(done <-chan struct{}) {
+	ticker := time.NewTicker(resolveInterval)
+	defer ticker.Stop()
+	for {
+		hosts := make(map[string][]net.IP)
+		for _, peer := range s.epMonitor.Snapshot() {
+			host := hostOf(peer.PeerAddr)
+			if net.ParseIP(host) != nil {
+				continue
+			}
+			ips, err := lookup(host)
+			if err != nil {
+				log.Warningf("dns lookup backend %s error: %v", host, err)
+				// keep the last ips while the resolver fails
+				ips, _ = s.resolved(host)
+			}
+			if len(ips) > 0 {
+				hosts[host] = ips
+			}
+		}
+		s.lock.Lock()
+		s.hosts = hosts
+		s.lock.Unlock()
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) resolved(host string) ([]net.IP, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ips, ok := s.hosts[host]
+	return ips, ok
+}
+
+// lookup returns the ips of the host of the address, the host names are the
+// ones resolved in the background
+func (s *Server) lookup(addr string) []net.IP {
+	host := hostOf(addr)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	ips, _ := s.resolved(host)
+	return ips
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func lookup(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
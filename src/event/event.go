@@ -0,0 +1,226 @@
+package event
+
+import (
+	"sync"
+	"time"
+)
+
+// Type of the events
+type Type string
+
+const (
+	// EventElection the sentinel elected a backend master, or failed to
+	EventElection Type = "election"
+	// EventRoleChange this janus took or gave up the sentinel master duty
+	EventRoleChange Type = "role_change"
+	// EventBackendRoleChange the sentinel asked a backend to be master or slave
+	EventBackendRoleChange Type = "backend_role_change"
+	// EventHealthChange a backend or the peer janus changed its health state
+	EventHealthChange Type = "health_change"
+	// EventSplitBrainSuspected two masters are seen at the same time
+	EventSplitBrainSuspected Type = "split_brain_suspected"
+	// EventSplitBrainCleared the two janus nodes agree on the master again
+	EventSplitBrainCleared Type = "split_brain_cleared"
+	// EventMembershipChange the backends are added or removed
+	EventMembershipChange Type = "membership_change"
+	// EventConfigReload the config is reloaded
+	EventConfigReload Type = "config_reload"
+	// EventHook a hook command finished, with its output
+	EventHook Type = "hook"
+	// EventVIP the virtual ip is taken, released or refused
+	EventVIP Type = "vip"
+	// EventSyncRejected an unauthenticated sync request is rejected
+	EventSyncRejected Type = "sync_rejected"
+)
+
+// Types lists all the types of events
+var Types = []Type{
+	EventElection,
+	EventRoleChange,
+	EventBackendRoleChange,
+	EventHealthChange,
+	EventSplitBrainSuspected,
+	EventSplitBrainCleared,
+	EventMembershipChange,
+	EventConfigReload,
+	EventHook,
+	EventVIP,
+	EventSyncRejected,
+}
+
+// HistorySize is the number of events kept in memory
+const HistorySize = 1024
+
+// Event is a transition worth following
+type Event struct {
+	Id   uint64
+	Time time.Time
+	Type Type
+	// Peer the backend or janus the event is about
+	Peer    string
+	Message string
+	Data    map[string]string
+}
+
+// Bus keeps the recent events and delivers the new ones to the subscribers
+type Bus struct {
+	lock        sync.Mutex
+	nextId      uint64
+	history     []Event
+	size        int
+	subscribers map[chan Event]bool
+	queues      map[*queue]bool
+}
+
+func NewBus(size int) *Bus {
+	return &Bus{
+		nextId:      1,
+		size:        size,
+		subscribers: make(map[chan Event]bool),
+		queues:      make(map[*queue]bool),
+	}
+}
+
+// Default is the bus janus publishes to
+var Default = NewBus(HistorySize)
+
+// Publish publishes an event to the default bus
+func Publish(t Type, peer, message string, data map[string]string) Event {
+	return Default.Publish(t, peer, message, data)
+}
+
+// Publish records the event and delivers it to the subscribers. It never blocks,
+// a subscriber too slow to receive misses the event unless it subscribed the
+// type by SubscribeTypes.
+func (b *Bus) Publish(t Type, peer, message string, data map[string]string) Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e := Event{
+		Id:      b.nextId,
+		Time:    time.Now(),
+		Type:    t,
+		Peer:    peer,
+		Message: message,
+		Data:    data,
+	}
+	b.nextId++
+	b.history = append(b.history, e)
+	if len(b.history) > b.size {
+		b.history = b.history[len(b.history)-b.size:]
+	}
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+	for q := range b.queues {
+		if q.types[t] {
+			q.push(e)
+		}
+	}
+	return e
+}
+
+// Since returns the events kept with id greater than since, oldest first
+func (b *Bus) Since(since uint64) []Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	events := []Event{}
+	for _, e := range b.history {
+		if e.Id > since {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Subscribe receives the events published from now on, cancel should be called
+// when done
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.lock.Lock()
+	b.subscribers[ch] = true
+	b.lock.Unlock()
+	return ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.subscribers[ch] {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// SubscribeTypes receives the events of the types published from now on without
+// missing any, they are queued while the subscriber is busy. It is for the rare
+// events acted on, such as the role changes. cancel should be called when done.
+func (b *Bus) SubscribeTypes(types ...Type) (<-chan Event, func()) {
+	q := &queue{
+		types: make(map[Type]bool, len(types)),
+		ready: make(chan struct{}, 1),
+		out:   make(chan Event),
+		done:  make(chan struct{}),
+	}
+	for _, t := range types {
+		q.types[t] = true
+	}
+	b.lock.Lock()
+	b.queues[q] = true
+	b.lock.Unlock()
+	go q.deliver()
+	return q.out, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.queues[q] {
+			delete(b.queues, q)
+			close(q.done)
+		}
+	}
+}
+
+// queue keeps the events until the subscriber receives them
+type queue struct {
+	types map[Type]bool
+	lock  sync.Mutex
+	// events waiting to be delivered, ready is signaled when one is pushed
+	events []Event
+	ready  chan struct{}
+	out    chan Event
+	done   chan struct{}
+}
+
+func (q *queue) push(e Event) {
+	q.lock.Lock()
+	q.events = append(q.events, e)
+	q.lock.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the events in order until cancelled, then closes out
+func (q *queue) deliver() {
+	defer close(q.out)
+	for {
+		q.lock.Lock()
+		if len(q.events) == 0 {
+			q.lock.Unlock()
+			select {
+			case <-q.ready:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		e := q.events[0]
+		q.events = q.events[1:]
+		q.lock.Unlock()
+		select {
+		case q.out <- e:
+		case <-q.done:
+			return
+		}
+	}
+}
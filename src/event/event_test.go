@@ -0,0 +1,96 @@
+package event
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestBusSince(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		published int
+		since     uint64
+		// ids returned
+		want []uint64
+	}{
+		{"empty", 4, 0, 0, []uint64{}},
+		{"all", 4, 3, 0, []uint64{1, 2, 3}},
+		{"after", 4, 3, 1, []uint64{2, 3}},
+		{"latest", 4, 3, 3, []uint64{}},
+		{"future", 4, 3, 10, []uint64{}},
+		// the oldest over the size are dropped
+		{"trimmed", 4, 6, 0, []uint64{3, 4, 5, 6}},
+		{"trimmed after", 4, 6, 4, []uint64{5, 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBus(tt.size)
+			for i := 1; i <= tt.published; i++ {
+				if e := b.Publish(EventHealthChange, "127.0.0.1:9090", fmt.Sprint(i), nil); e.Id != uint64(i) {
+					t.Fatalf("published id %d, want %d", e.Id, i)
+				}
+			}
+			ids := []uint64{}
+			for _, e := range b.Since(tt.since) {
+				if e.Message != fmt.Sprint(e.Id) {
+					t.Fatalf("event %d of message %q", e.Id, e.Message)
+				}
+				ids = append(ids, e.Id)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("since %d = %v, want %v", tt.since, ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestBusSubscribe(t *testing.T) {
+	b := NewBus(4)
+	b.Publish(EventElection, "", "before", nil)
+	events, cancel := b.Subscribe(2)
+	for _, message := range []string{"first", "second", "dropped"} {
+		b.Publish(EventElection, "", message, nil)
+	}
+	// a full subscriber misses the event, but does not block the others
+	for _, want := range []string{"first", "second"} {
+		if e := <-events; e.Message != want {
+			t.Fatalf("received %q, want %q", e.Message, want)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("received %q, want none", e.Message)
+	default:
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("received after cancelled")
+	}
+	b.Publish(EventElection, "", "after", nil)
+}
+
+func TestBusSubscribeTypes(t *testing.T) {
+	b := NewBus(4)
+	events, cancel := b.SubscribeTypes(EventRoleChange, EventBackendRoleChange)
+	// more than the history and not received meanwhile, none is missed
+	for i := 1; i <= 10; i++ {
+		b.Publish(EventRoleChange, "", fmt.Sprint(i), nil)
+		b.Publish(EventElection, "", "ignored", nil)
+	}
+	b.Publish(EventBackendRoleChange, "", "11", nil)
+	for i := 1; i <= 11; i++ {
+		if e := <-events; e.Message != fmt.Sprint(i) {
+			t.Fatalf("received %q, want %q", e.Message, fmt.Sprint(i))
+		}
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("received after cancelled")
+	}
+}
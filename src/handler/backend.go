@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mmpei/janus/src/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+type BackendRequest struct {
+	// Backend the control address of the backend, host:port
+	Backend string
+}
+
+// Backends returns the current backends membership
+func (h *Handler) Backends(w http.ResponseWriter, r *http.Request) {
+	h.writeMembership(w, http.StatusOK)
+}
+
+// AddBackend adds a backend at runtime, the change is synced to the other node
+func (h *Handler) AddBackend(w http.ResponseWriter, r *http.Request) {
+	req := BackendRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, err := net.SplitHostPort(req.Backend); err != nil {
+		http.Error(w, "invalid backend: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.sentinel.AddBackend(req.Backend); err != nil {
+		http.Error(w, err.Error(), backendErrorCode(err))
+		return
+	}
+	h.writeMembership(w, http.StatusCreated)
+}
+
+// RemoveBackend removes a backend at runtime, the master is refused
+func (h *Handler) RemoveBackend(w http.ResponseWriter, r *http.Request) {
+	if err := h.sentinel.RemoveBackend(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, err.Error(), backendErrorCode(err))
+		return
+	}
+	h.writeMembership(w, http.StatusOK)
+}
+
+func (h *Handler) writeMembership(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(h.epMonitor.Membership()); err != nil {
+		log.Errorf("json encode response: %s", err)
+	}
+}
+
+func backendErrorCode(err error) int {
+	switch {
+	case errors.Is(err, sync.ErrPeerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sync.ErrPeerExists), errors.Is(err, sync.ErrRemoveMaster):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mmpei/janus/src/event"
+	log "github.com/sirupsen/logrus"
+)
+
+// keepAliveInterval of the event stream, so that proxies do not close it
+const keepAliveInterval = 15 * time.Second
+
+// Events returns the recent events after the since id, oldest first
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request) {
+	since, err := sinceId(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(event.Default.Since(since)); err != nil {
+		log.Errorf("json encode response: %s", err)
+	}
+}
+
+// EventStream streams the events as server-sent events. The events kept after
+// the since id or Last-Event-ID are sent first, so a reconnecting client misses
+// nothing still in the history.
+func (h *Handler) EventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	s := r.URL.Query().Get("since")
+	if id := r.Header.Get("Last-Event-ID"); len(id) > 0 {
+		s = id
+	}
+	since, err := sinceId(s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// subscribe before reading the history, the duplicates are skipped by id
+	events, cancel := event.Default.Subscribe(64)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	last := since
+	if len(s) > 0 {
+		for _, e := range event.Default.Since(since) {
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+			last = e.Id
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if e.Id <= last {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+			last = e.Id
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e event.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("json encode event: %s", err)
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+	return err
+}
+
+func sinceId(s string) (uint64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	since, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid since %q", s)
+	}
+	return since, nil
+}
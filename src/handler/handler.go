@@ -4,20 +4,33 @@ import (
 	"net/http"
 	"encoding/json"
 	"fmt"
+	"time"
 	"github.com/mmpei/janus/src/sync"
+	"github.com/mmpei/janus/src/config"
 	log "github.com/sirupsen/logrus"
+	"github.com/gorilla/mux"
 )
 
 type Handler struct {
 	syncManager *sync.SyncManager
+	sentinel    *sync.Sentinel
+	epMonitor   *sync.MonitorManager
+
+	reloadFunc  func() ([]config.Change, error)
 }
 
-func NewHandler(sm *sync.SyncManager) *Handler {
+func NewHandler(sm *sync.SyncManager, s *sync.Sentinel, mm *sync.MonitorManager) *Handler {
 	return &Handler{
 		syncManager: sm,
+		sentinel: s,
+		epMonitor: mm,
 	}
 }
 
+func (h *Handler) SetReloadFunc(f func() ([]config.Change, error)) {
+	h.reloadFunc = f
+}
+
 func (h *Handler) Sync(w http.ResponseWriter, r *http.Request) {
 	req := sync.ElectPeer{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -36,6 +49,21 @@ func (h *Handler) Sync(w http.ResponseWriter, r *http.Request) {
 type Peer struct {
 	ElectPeer sync.ElectPeer
 	IsMaster  bool
+	Endpoints []Endpoint
+}
+
+// Endpoint is the monitoring status of a backend, latency in milliseconds
+type Endpoint struct {
+	PeerId    string
+	State     string
+	Alive     bool
+	Degraded  bool
+	LatencyMs float64
+	P50Ms     float64
+	P90Ms     float64
+	P99Ms     float64
+	// replication lag, negative if not reported
+	LagMs     float64
 }
 
 func (h *Handler) Info(w http.ResponseWriter, r *http.Request) {
@@ -43,6 +71,24 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request) {
 		ElectPeer: *h.syncManager.Get(),
 		IsMaster: h.syncManager.IsMaster(),
 	}
+	for _, peer := range h.epMonitor.Snapshot() {
+		stats := h.epMonitor.LatencyStats(peer.PeerId)
+		lagMs := float64(-1)
+		if peer.Lag >= 0 {
+			lagMs = milliseconds(peer.Lag)
+		}
+		res.Endpoints = append(res.Endpoints, Endpoint{
+			PeerId: peer.PeerId,
+			State: peer.State(),
+			Alive: peer.Alive,
+			Degraded: peer.Degraded,
+			LatencyMs: milliseconds(peer.Latency),
+			P50Ms: milliseconds(stats.P50),
+			P90Ms: milliseconds(stats.P90),
+			P99Ms: milliseconds(stats.P99),
+			LagMs: lagMs,
+		})
+	}
 
 	res.ElectPeer.EPMasterId = h.syncManager.GetEPMaster()
 
@@ -50,3 +96,40 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request) {
 		log.Errorf("json encode response: %s", err)
 	}
 }
+
+// PeerHistory returns the recent state transitions of an endpoint
+func (h *Handler) PeerHistory(w http.ResponseWriter, r *http.Request) {
+	peerId := mux.Vars(r)["id"]
+	res, err := h.epMonitor.History(peerId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorf("json encode response: %s", err)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type ReloadResult struct {
+	Changes []config.Change
+	Error   string
+}
+
+// ReloadConfig re-reads the config file and applies the changes
+func (h *Handler) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	res := ReloadResult{}
+	changes, err := h.reloadFunc()
+	res.Changes = changes
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		res.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorf("json encode response: %s", err)
+	}
+}
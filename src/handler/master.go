@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultWaitTimeout of the long polling
+	DefaultWaitTimeout = 30 * time.Second
+	// MaxWaitTimeout caps the timeout asked by the client
+	MaxWaitTimeout = 10 * time.Minute
+)
+
+// Master is the current backend master for clients, PeerId is empty when no
+// master is elected. Term is increased whenever the master changes.
+type Master struct {
+	PeerId         string
+	ProxiedAddress string
+	Term           uint64
+}
+
+// Master returns the backend master. With wait=<term> it blocks until the term
+// differs from it or the timeout expires, the term is also in the X-Janus-Index
+// header. Both nodes answer, the sentinel slave from what it learned by syncing.
+func (h *Handler) Master(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if s := query.Get("wait"); len(s) > 0 {
+		wait, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid wait %q", s), http.StatusBadRequest)
+			return
+		}
+		timeout := DefaultWaitTimeout
+		if s := query.Get("timeout"); len(s) > 0 {
+			if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+				http.Error(w, fmt.Sprintf("invalid timeout %q", s), http.StatusBadRequest)
+				return
+			}
+			if timeout > MaxWaitTimeout {
+				timeout = MaxWaitTimeout
+			}
+		}
+		_, term, changed := h.sentinel.WatchMaster()
+		if term == wait {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-changed:
+			case <-timer.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	peerId, term := h.sentinel.GetMasterTerm()
+	res := Master{
+		PeerId: peerId,
+		Term: term,
+	}
+	if len(peerId) > 0 {
+		if peer := h.epMonitor.Get(peerId); peer != nil {
+			res.ProxiedAddress = peer.ProxiedAddress
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Janus-Index", strconv.FormatUint(term, 10))
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Errorf("json encode response: %s", err)
+	}
+}
@@ -0,0 +1,108 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/sync"
+)
+
+func TestMaster(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		// whether the sentinel master reports change while waiting
+		report bool
+		change string
+		status int
+		want   Master
+		// at least how long it waits
+		waited time.Duration
+	}{
+		{
+			name:   "current",
+			status: http.StatusOK,
+			want:   Master{PeerId: "127.0.0.1:9090", ProxiedAddress: "http://127.0.0.1:8080", Term: 3},
+		},
+		{
+			name:   "other term",
+			query:  "wait=2",
+			status: http.StatusOK,
+			want:   Master{PeerId: "127.0.0.1:9090", ProxiedAddress: "http://127.0.0.1:8080", Term: 3},
+		},
+		{
+			name:   "timeout",
+			query:  "wait=3&timeout=50ms",
+			status: http.StatusOK,
+			want:   Master{PeerId: "127.0.0.1:9090", ProxiedAddress: "http://127.0.0.1:8080", Term: 3},
+			waited: 50 * time.Millisecond,
+		},
+		{
+			name:   "changed",
+			query:  "wait=3&timeout=10s",
+			report: true,
+			change: "127.0.0.1:9091",
+			status: http.StatusOK,
+			want:   Master{PeerId: "127.0.0.1:9091", ProxiedAddress: "http://127.0.0.1:8080", Term: 4},
+		},
+		{
+			name:   "no master",
+			query:  "wait=3&timeout=10s",
+			report: true,
+			status: http.StatusOK,
+			want:   Master{Term: 4},
+		},
+		{
+			name:   "invalid wait",
+			query:  "wait=first",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid timeout",
+			query:  "wait=3&timeout=-1s",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm := sync.NewMonitorManager([]string{"127.0.0.1:9090", "127.0.0.1:9091"}, 8080, config.NewDefaultSync())
+			s := sync.NewSentinel(mm)
+			s.HookReportMaster("127.0.0.1:9090", 3)
+			h := NewHandler(nil, s, mm)
+
+			if tt.report {
+				go func() {
+					time.Sleep(50 * time.Millisecond)
+					s.HookReportMaster(tt.change, 4)
+				}()
+			}
+			start := time.Now()
+			w := httptest.NewRecorder()
+			h.Master(w, httptest.NewRequest("GET", "/v1/master?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if elapsed := time.Since(start); elapsed < tt.waited || elapsed > 5*time.Second {
+				t.Errorf("answered in %v, want after %v", elapsed, tt.waited)
+			}
+			var res Master
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if res != tt.want {
+				t.Errorf("master = %+v, want %+v", res, tt.want)
+			}
+			if index := w.Header().Get("X-Janus-Index"); index != strconv.FormatUint(tt.want.Term, 10) {
+				t.Errorf("index %s, want %d", index, tt.want.Term)
+			}
+		})
+	}
+}
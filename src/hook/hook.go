@@ -0,0 +1,247 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	OnSentinelMaster  = "on_sentinel_master"
+	OnSentinelSlave   = "on_sentinel_slave"
+	OnBackendPromoted = "on_backend_promoted"
+	OnBackendDemoted  = "on_backend_demoted"
+
+	// OutputLimit of the stdout and stderr kept in the event log
+	OutputLimit = 4096
+	// QueueSize of the commands waiting to run, the events are not missed when
+	// it is full
+	QueueSize = 64
+)
+
+// Payload is written to the stdin of the command as json
+type Payload struct {
+	Hook  string
+	Node  string
+	Event event.Event
+}
+
+// Runner runs the hook commands for the events of the bus. The commands run one
+// at a time in the order of the events, so that moving a VIP away finishes
+// before moving it back. They run off the loop receiving the events, and none
+// of the role changes is missed while a command runs.
+type Runner struct {
+	lock   sync.Mutex
+	node   string
+	config config.HookConfig
+}
+
+func NewRunner(node string, cfg *config.HookConfig) *Runner {
+	r := &Runner{
+		node: node,
+	}
+	r.SetConfig(cfg)
+	return r
+}
+
+func (r *Runner) SetConfig(cfg *config.HookConfig) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.config = *cfg
+}
+
+// job is a command to run for an event
+type job struct {
+	name    string
+	command string
+	timeout time.Duration
+	event   event.Event
+}
+
+// Start subscribes to the bus before returning, and runs the hooks for the events
+// published from then on in the background until ctx is done
+func (r *Runner) Start(ctx context.Context, bus *event.Bus) {
+	events, cancel := bus.SubscribeTypes(event.EventRoleChange, event.EventBackendRoleChange)
+	go r.run(ctx, events, cancel)
+}
+
+func (r *Runner) run(ctx context.Context, events <-chan event.Event, cancel func()) {
+	defer cancel()
+	jobs := make(chan job, QueueSize)
+	go r.work(ctx, jobs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			name := Name(e)
+			if len(name) == 0 {
+				continue
+			}
+			// the config of the time of the event is used
+			r.lock.Lock()
+			cfg := r.config
+			r.lock.Unlock()
+			command := commandOf(&cfg, name)
+			if len(command) == 0 {
+				continue
+			}
+			select {
+			case jobs <- job{name: name, command: command, timeout: time.Duration(cfg.Timeout), event: e}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// work runs the commands one at a time until ctx is done
+func (r *Runner) work(ctx context.Context, jobs <-chan job) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case j := <-jobs:
+			r.exec(ctx, j.name, j.command, j.timeout, j.event)
+		}
+	}
+}
+
+// Name returns the hook of the event, empty if none
+func Name(e event.Event) string {
+	switch e.Type {
+	case event.EventRoleChange:
+		if e.Data["role"] == "master" {
+			return OnSentinelMaster
+		}
+		return OnSentinelSlave
+	case event.EventBackendRoleChange:
+		if e.Data["result"] != "success" {
+			return ""
+		}
+		if e.Data["role"] == "master" {
+			return OnBackendPromoted
+		}
+		return OnBackendDemoted
+	}
+	return ""
+}
+
+func commandOf(cfg *config.HookConfig, name string) string {
+	switch name {
+	case OnSentinelMaster:
+		return cfg.OnSentinelMaster
+	case OnSentinelSlave:
+		return cfg.OnSentinelSlave
+	case OnBackendPromoted:
+		return cfg.OnBackendPromoted
+	case OnBackendDemoted:
+		return cfg.OnBackendDemoted
+	}
+	return ""
+}
+
+// exec runs the command by sh -c, the details are passed by the environment
+// variables and the json payload on stdin, and the result is published as an event
+func (r *Runner) exec(ctx context.Context, name, command string, timeout time.Duration, e event.Event) {
+	input, err := json.Marshal(Payload{
+		Hook:  name,
+		Node:  r.node,
+		Event: e,
+	})
+	if err != nil {
+		log.Errorf("json encode event %d: %v", e.Id, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), Env(name, r.node, e)...)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout, stderr := &limitedBuffer{limit: OutputLimit}, &limitedBuffer{limit: OutputLimit}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// the children may keep the pipes open after sh is killed
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err = cmd.Run()
+	elapsed := time.Since(start)
+
+	data := map[string]string{
+		"hook":      name,
+		"command":   command,
+		"event_id":  strconv.FormatUint(e.Id, 10),
+		"duration":  elapsed.String(),
+		"exit_code": strconv.Itoa(cmd.ProcessState.ExitCode()),
+		"stdout":    stdout.String(),
+		"stderr":    stderr.String(),
+	}
+	message := fmt.Sprintf("hook %s succeeded", name)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout after %v", timeout)
+		}
+		data["error"] = err.Error()
+		message = fmt.Sprintf("hook %s failed: %v", name, err)
+		log.Errorf("%s, stderr: %s", message, stderr.String())
+	} else {
+		log.Infof("%s in %v", message, elapsed)
+	}
+	event.Publish(event.EventHook, e.Peer, message, data)
+}
+
+// Env returns the environment variables describing the event, the data of the
+// event are passed as JANUS_DATA_<KEY>
+func Env(name, node string, e event.Event) []string {
+	env := []string{
+		"JANUS_HOOK=" + name,
+		"JANUS_NODE=" + node,
+		"JANUS_EVENT=" + string(e.Type),
+		"JANUS_EVENT_ID=" + strconv.FormatUint(e.Id, 10),
+		"JANUS_EVENT_TIME=" + e.Time.Format(time.RFC3339Nano),
+		"JANUS_PEER=" + e.Peer,
+		"JANUS_MESSAGE=" + e.Message,
+	}
+	for k, v := range e.Data {
+		env = append(env, "JANUS_DATA_"+strings.ToUpper(k)+"="+v)
+	}
+	return env
+}
+
+// limitedBuffer keeps the first limit bytes written, the rest are discarded. The
+// buffer is not embedded, its ReadFrom would be taken by io.Copy over the limit.
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buffer.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buffer.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buffer.String() + "...(truncated)"
+	}
+	return b.buffer.String()
+}
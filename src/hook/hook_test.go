@@ -0,0 +1,161 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+)
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		t    event.Type
+		data map[string]string
+		want string
+	}{
+		{event.EventRoleChange, map[string]string{"role": "master"}, OnSentinelMaster},
+		{event.EventRoleChange, map[string]string{"role": "slave"}, OnSentinelSlave},
+		{event.EventBackendRoleChange, map[string]string{"role": "master", "result": "success"}, OnBackendPromoted},
+		{event.EventBackendRoleChange, map[string]string{"role": "slave", "result": "success"}, OnBackendDemoted},
+		{event.EventBackendRoleChange, map[string]string{"role": "master", "result": "failure"}, ""},
+		{event.EventElection, nil, ""},
+	}
+	for _, tt := range tests {
+		if name := Name(event.Event{Type: tt.t, Data: tt.data}); name != tt.want {
+			t.Errorf("Name(%s %v) = %q, want %q", tt.t, tt.data, name, tt.want)
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	e := event.Event{
+		Id:      12,
+		Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Type:    event.EventBackendRoleChange,
+		Peer:    "127.0.0.1:9090",
+		Message: "promoted",
+		Data:    map[string]string{"role": "master", "result": "success"},
+	}
+	env := Env(OnBackendPromoted, "janus-1", e)
+	sort.Strings(env)
+	want := []string{
+		"JANUS_DATA_RESULT=success",
+		"JANUS_DATA_ROLE=master",
+		"JANUS_EVENT=backend_role_change",
+		"JANUS_EVENT_ID=12",
+		"JANUS_EVENT_TIME=2026-01-02T03:04:05Z",
+		"JANUS_HOOK=on_backend_promoted",
+		"JANUS_MESSAGE=promoted",
+		"JANUS_NODE=janus-1",
+		"JANUS_PEER=127.0.0.1:9090",
+	}
+	if strings.Join(env, "\n") != strings.Join(want, "\n") {
+		t.Errorf("env = %v, want %v", env, want)
+	}
+}
+
+func TestExec(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		timeout time.Duration
+		// data of the hook event published
+		want map[string]string
+	}{
+		{
+			name:    "env",
+			command: `echo "$JANUS_HOOK $JANUS_NODE $JANUS_DATA_ROLE"`,
+			timeout: time.Second,
+			want:    map[string]string{"exit_code": "0", "stdout": "on_sentinel_master janus-1 master\n"},
+		},
+		{
+			name:    "stdin",
+			command: `cat`,
+			timeout: time.Second,
+			want:    map[string]string{"exit_code": "0"},
+		},
+		{
+			name:    "failed",
+			command: `echo broken >&2; exit 3`,
+			timeout: time.Second,
+			want:    map[string]string{"exit_code": "3", "stderr": "broken\n", "error": "exit status 3"},
+		},
+		{
+			name:    "timeout",
+			command: `sleep 10`,
+			timeout: 50 * time.Millisecond,
+			want:    map[string]string{"exit_code": "-1", "error": "timeout after 50ms"},
+		},
+		{
+			name:    "truncated",
+			command: `head -c 5000 /dev/zero | tr '\0' a`,
+			timeout: time.Second,
+			want:    map[string]string{"exit_code": "0", "stdout": strings.Repeat("a", OutputLimit) + "...(truncated)"},
+		},
+	}
+	events, cancel := event.Default.SubscribeTypes(event.EventHook)
+	defer cancel()
+	r := NewRunner("janus-1", config.NewDefaultHook())
+	e := event.Event{Id: 3, Type: event.EventRoleChange, Data: map[string]string{"role": "master"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			r.exec(context.Background(), OnSentinelMaster, tt.command, tt.timeout, e)
+			if elapsed := time.Since(start); elapsed > tt.timeout+2*time.Second {
+				t.Errorf("ran %v, over the timeout %v", elapsed, tt.timeout)
+			}
+			published := <-events
+			if published.Data["command"] != tt.command || published.Data["event_id"] != "3" {
+				t.Fatalf("published %+v", published.Data)
+			}
+			for k, v := range tt.want {
+				if published.Data[k] != v {
+					t.Errorf("%s = %.80q of %d bytes, want %.80q of %d bytes", k, published.Data[k], len(published.Data[k]), v, len(v))
+				}
+			}
+			if tt.name == "stdin" {
+				var payload Payload
+				if err := json.Unmarshal([]byte(published.Data["stdout"]), &payload); err != nil {
+					t.Fatal(err)
+				}
+				if payload.Hook != OnSentinelMaster || payload.Node != "janus-1" || payload.Event.Id != 3 {
+					t.Errorf("payload = %+v", payload)
+				}
+			}
+		})
+	}
+}
+
+func TestRunnerStart(t *testing.T) {
+	events, cancel := event.Default.SubscribeTypes(event.EventHook)
+	defer cancel()
+	cfg := config.NewDefaultHook()
+	cfg.OnSentinelMaster = "echo master"
+	cfg.OnBackendDemoted = "echo demoted"
+	r := NewRunner("janus-1", cfg)
+	bus := event.NewBus(16)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	r.Start(ctx, bus)
+
+	// no command of the slave, and the failed demotion runs no hook
+	bus.Publish(event.EventRoleChange, "", "become slave", map[string]string{"role": "slave"})
+	bus.Publish(event.EventBackendRoleChange, "127.0.0.1:9090", "demote", map[string]string{"role": "slave", "result": "failure"})
+	bus.Publish(event.EventRoleChange, "", "become master", map[string]string{"role": "master"})
+	bus.Publish(event.EventBackendRoleChange, "127.0.0.1:9090", "demote", map[string]string{"role": "slave", "result": "success"})
+	for _, want := range []string{"master\n", "demoted\n"} {
+		select {
+		case e := <-events:
+			if e.Data["stdout"] != want {
+				t.Fatalf("hook printed %q, want %q", e.Data["stdout"], want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("hook printing %q not run", want)
+		}
+	}
+}
@@ -2,62 +2,80 @@ package main
 
 import (
 	"flag"
-	"strings"
 	"net/http"
 	"github.com/gorilla/mux"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
 	"gopkg.in/yaml.v2"
 	"github.com/mmpei/janus/src/config"
 	"github.com/mmpei/janus/src/handler"
 	"github.com/mmpei/janus/src/sync"
+	"github.com/mmpei/janus/src/discovery"
+	"github.com/mmpei/janus/src/reload"
+	"github.com/mmpei/janus/src/metrics"
+	"github.com/mmpei/janus/src/event"
+	"github.com/mmpei/janus/src/notify"
+	"github.com/mmpei/janus/src/hook"
+	"github.com/mmpei/janus/src/vip"
+	"github.com/mmpei/janus/src/dns"
+	"github.com/mmpei/janus/src/auth"
+	"github.com/mmpei/janus/src/proxy"
+	"github.com/mmpei/janus/src/model"
+	"context"
+	"os"
 )
 
-type sliceFlagValue []string
-
-func (s *sliceFlagValue) Set(val string) error {
-	*s = sliceFlagValue(strings.Split(val, ","))
-	return nil
-}
-
-func (s *sliceFlagValue) String() string {
-	*s = sliceFlagValue(strings.Split("20202,20203", ","))
-	return ""
-}
-
 func main() {
-	var configPath string
-	var cfg = config.Configuration{}
-	flag.StringVar(&configPath, "config", "", "specify the config file with formatter yaml")
-	flag.StringVar(&cfg.LogLevel, "log_level", "", "log level:debug info warn error")
-	flag.StringVar(&cfg.IP, "ip", "", "ip where the server listen on")
-	flag.IntVar(&cfg.Port, "port", 0, "port where the server listen on")
-	flag.IntVar(&cfg.ProxyPort, "proxy_port", 0, "port where the proxy server listen on")
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+
+	loader := config.NewLoader(flag.CommandLine)
+	printConfig := flag.Bool("print-config", false, "print the effective config merged from defaults, file, env and flags, then exit")
 	flag.Parse()
 
-	if len(configPath) == 0 {
-		configPath = "conf.yaml"
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatalf("load config error: %v", err)
 	}
+	config.ProxyConfig = *cfg
 
-	readConfig(configPath, &config.ProxyConfig)
-
-	// parse args
-	parseArgs(&config.ProxyConfig, &cfg)
+	if *printConfig {
+		buffer, err := yaml.Marshal(config.ProxyConfig.Redacted())
+		if err != nil {
+			log.Fatalf("encode config error: %v", err)
+		}
+		fmt.Print(string(buffer))
+		return
+	}
 
 	// check config
 	if err := config.ProxyConfig.Validate(); err != nil {
-		log.Errorf("parse config error: %v ", err)
-		return
+		log.Fatalf("parse config error: %v ", err)
 	}
 
-	log.SetLevel(logLevel(config.ProxyConfig.LogLevel))
+	log.SetLevel(reload.LogLevel(config.ProxyConfig.LogLevel))
 
 	// endpoint monitor init
+	model.ProxiedScheme = config.ProxyConfig.ProxiedScheme()
 	epMonitor := sync.NewMonitorManager(config.ProxyConfig.Backends, config.ProxyConfig.BackendProxiedPort, &config.ProxyConfig.Monitor)
+	if len(config.ProxyConfig.BackendsFile) > 0 {
+		if err := epMonitor.LoadMembership(config.ProxyConfig.BackendsFile); err != nil {
+			log.Fatalf("load backends error: %v ", err)
+		}
+	}
 	// sentinel init
 	sentinel := sync.NewSentinel(epMonitor)
 
+	// backends discovery
+	if len(config.ProxyConfig.Discovery.Provider) > 0 {
+		provider, err := discovery.NewProvider(&config.ProxyConfig.Discovery)
+		if err != nil {
+			log.Fatalf("discovery init error: %v ", err)
+		}
+		go discovery.Watch(context.Background(), provider, sentinel.ReconcileBackends)
+	}
+
 	self := fmt.Sprintf("%s:%d", config.ProxyConfig.IP, config.ProxyConfig.Port)
 	var peer string
 	for _, p := range config.ProxyConfig.Cluster {
@@ -66,50 +84,155 @@ func main() {
 		}
 		peer = p
 	}
-	syncManager := sync.NewSyncManager(self, peer, &config.ProxyConfig.Sync, sentinel)
-	go syncManager.Run()
+	// notifications are posted by webhooks
+	notifier := notify.NewNotifier(self, &config.ProxyConfig.Notifications)
+	notifier.Start(context.Background(), event.Default)
+	// hook commands run on role transitions
+	hooks := hook.NewRunner(self, &config.ProxyConfig.Hooks)
+	hooks.Start(context.Background(), event.Default)
+	// the virtual ip follows the sentinel master
+	if len(config.ProxyConfig.VIP.Address) > 0 {
+		vipManager, err := vip.NewManager(&config.ProxyConfig.VIP, vip.IPCommand{})
+		if err != nil {
+			log.Fatalf("vip init error: %v ", err)
+		}
+		vipManager.Start(context.Background(), event.Default)
+	}
 
-	listenAddr := fmt.Sprintf("%s:%d", config.ProxyConfig.IP, config.ProxyConfig.Port)
-	router := mux.NewRouter()
-	h := handler.NewHandler(syncManager)
-	router.HandleFunc("/sync", h.Sync).Methods("POST")
-	router.HandleFunc("/info", h.Info).Methods("GET")
-	go http.ListenAndServe(listenAddr, router)
+	syncManager := sync.NewSyncManager(self, peer, &config.ProxyConfig.Sync, sentinel)
+	peerAuth, err := auth.NewPeerAuth(&config.ProxyConfig.PeerAuth, peer)
+	if err != nil {
+		log.Fatalf("peer auth init error: %v ", err)
+	}
+	syncManager.SetPeerAuth(peerAuth)
+	if err := syncManager.Run(); err != nil {
+		log.Fatalf("start syncing error: %v ", err)
+	}
 
-	// start proxy
-	select {
+	// dns responder of the backend master
+	if config.ProxyConfig.DNS.Port != 0 {
+		dnsServer := dns.NewServer(config.ProxyConfig.IP, &config.ProxyConfig.DNS, sentinel, epMonitor)
+		go func() {
+			if err := dnsServer.ListenAndServe(); err != nil {
+				log.Fatalf("dns responder error: %v ", err)
+			}
+		}()
 	}
-}
 
-func readConfig(file string, cfg *config.Configuration) error {
-	if len(file) == 0 {
-		return nil
+	// redis sentinel of the backend master
+	if config.ProxyConfig.RedisSentinel.Port != 0 {
+		sentinelServer := proxy.NewRedisSentinelServer(config.ProxyConfig.IP, &config.ProxyConfig.RedisSentinel, sentinel, epMonitor)
+		go func() {
+			log.Fatalf("redis sentinel error: %v ", sentinelServer.ListenAndServe(context.Background()))
+		}()
 	}
-	buffer, err := ioutil.ReadFile(file)
-	err = yaml.Unmarshal(buffer, cfg)
+
+	listenAddr := fmt.Sprintf("%s:%d", config.ProxyConfig.IP, config.ProxyConfig.Port)
+	router := mux.NewRouter()
+	h := handler.NewHandler(syncManager, sentinel, epMonitor)
+	router.Handle("/sync", peerAuth.Middleware(http.HandlerFunc(h.Sync))).Methods("POST")
+	apiAuth, err := auth.NewAPIAuth(&config.ProxyConfig.APIAuth)
 	if err != nil {
-		return err
+		log.Fatalf("api auth init error: %v ", err)
 	}
-	return nil
-}
+	read := func(f http.Handler) http.Handler {
+		return apiAuth.Require(config.RoleRead, f)
+	}
+	admin := func(f http.Handler) http.Handler {
+		return apiAuth.Require(config.RoleAdmin, f)
+	}
+	router.Handle("/info", read(http.HandlerFunc(h.Info))).Methods("GET")
+	sync.RegisterMetrics(syncManager, epMonitor)
+	router.Handle("/metrics", read(metrics.Handler())).Methods("GET")
+	router.Handle("/peers/{id}/history", read(http.HandlerFunc(h.PeerHistory))).Methods("GET")
+	router.Handle("/backends", read(http.HandlerFunc(h.Backends))).Methods("GET")
+	router.Handle("/backends", admin(http.HandlerFunc(h.AddBackend))).Methods("POST")
+	router.Handle("/backends/{id}", admin(http.HandlerFunc(h.RemoveBackend))).Methods("DELETE")
+	router.Handle("/events", read(http.HandlerFunc(h.Events))).Methods("GET")
+	router.Handle("/v1/master", read(http.HandlerFunc(h.Master))).Methods("GET")
+	router.Handle("/events/stream", read(http.HandlerFunc(h.EventStream))).Methods("GET")
+
+	// config reloading by SIGHUP or the admin api
+	reloader := reload.NewReloader(loader.Load, syncManager, sentinel, epMonitor)
+	reloader.OnChange("notifications", func(cfg *config.Configuration) {
+		notifier.SetConfig(&cfg.Notifications)
+	})
+	reloader.OnChange("hooks", func(cfg *config.Configuration) {
+		hooks.SetConfig(&cfg.Hooks)
+	})
+	reloader.OnChange("api_auth", func(cfg *config.Configuration) {
+		if err := apiAuth.SetConfig(&cfg.APIAuth); err != nil {
+			log.Errorf("apply api_auth error: %v", err)
+		}
+	})
+	h.SetReloadFunc(reloader.Reload)
+	router.Handle("/config/reload", admin(http.HandlerFunc(h.ReloadConfig))).Methods("POST")
+	go reloader.HandleSignals()
+
+	server := &http.Server{
+		Addr: listenAddr,
+		Handler: router,
+		TLSConfig: peerAuth.ServerTLSConfig(),
+	}
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		log.Fatalf("control server error: %v ", err)
+	}()
 
-func parseArgs(dest , src *config.Configuration) {
-	if len(src.LogLevel) > 0 {
-		dest.LogLevel = src.LogLevel
+	// start proxy
+	if config.ProxyConfig.ProxyPort != 0 {
+		proxyAddr := fmt.Sprintf("%s:%d", config.ProxyConfig.IP, config.ProxyConfig.ProxyPort)
+		proxyServer, err := proxy.NewServer(proxyAddr, &config.ProxyConfig.Proxy, config.ProxyConfig.ProxiedScheme(), sentinel, epMonitor)
+		if err != nil {
+			log.Fatalf("proxy init error: %v ", err)
+		}
+		go func() {
+			log.Fatalf("proxy error: %v ", proxyServer.ListenAndServe(context.Background()))
+		}()
 	}
-	if len(src.IP) > 0 {
-		dest.IP = src.IP
+	if config.ProxyConfig.ReplicaProxyPort != 0 {
+		replicaAddr := fmt.Sprintf("%s:%d", config.ProxyConfig.IP, config.ProxyConfig.ReplicaProxyPort)
+		replicaServer, err := proxy.NewReplicaServer(replicaAddr, &config.ProxyConfig.Proxy, config.ProxyConfig.ProxiedScheme(), sentinel, epMonitor)
+		if err != nil {
+			log.Fatalf("replica proxy init error: %v ", err)
+		}
+		go func() {
+			log.Fatalf("replica proxy error: %v ", replicaServer.ListenAndServe(context.Background()))
+		}()
 	}
-	if src.Port > 0 {
-		dest.Port = src.Port
+	select {
 	}
 }
 
-func logLevel(level string) log.Level {
-	l, err := log.ParseLevel(level)
+// validate checks the config and prints all the problems, for using in CI:
+// janus validate -config conf.yaml
+func validate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	loader := config.NewLoader(fs)
+	fs.Parse(args)
+
+	path, _ := loader.ConfigPath()
+	cfg, err := loader.Load()
 	if err != nil {
-		l = log.InfoLevel
-		log.Warnf("error parsing level %s: %v, using %q	", level, err, l)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n", path)
+		if ve, ok := err.(config.ValidationError); ok {
+			for _, fe := range ve {
+				fmt.Fprintf(os.Stderr, "  %s\n", fe)
+			}
+		} else {
+			fmt.Fprintf(os.Stderr, "  %v\n", err)
+		}
+		return 1
 	}
-	return l
+	fmt.Printf("%s is valid\n", path)
+	return 0
 }
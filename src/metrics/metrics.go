@@ -0,0 +1,328 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// collector writes its samples in the prometheus text format
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	registryLock sync.Mutex
+	registry     []collector
+)
+
+func register(c collector) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, c)
+}
+
+// Handler serves all the registered metrics in the prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryLock.Lock()
+		collectors := append([]collector(nil), registry...)
+		registryLock.Unlock()
+
+		buffer := &bytes.Buffer{}
+		for _, c := range collectors {
+			c.write(buffer)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := w.Write(buffer.Bytes()); err != nil {
+			log.Errorf("write metrics error: %v", err)
+		}
+	})
+}
+
+// desc describes a metric family
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+// sample writes one line, extra is an additional label such as le of histograms
+func (d *desc) sample(w io.Writer, suffix string, values []string, extra string, value float64) {
+	w.Write([]byte(d.name + suffix))
+	if len(d.labels) > 0 || len(extra) > 0 {
+		pairs := make([]string, 0, len(d.labels)+1)
+		for i, l := range d.labels {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l, escape(values[i])))
+		}
+		if len(extra) > 0 {
+			pairs = append(pairs, extra)
+		}
+		w.Write([]byte("{" + strings.Join(pairs, ",") + "}"))
+	}
+	w.Write([]byte(" " + formatFloat(value) + "\n"))
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// vec keeps a series for each combination of label values
+type vec struct {
+	desc
+	lock   sync.Mutex
+	series map[string]interface{}
+	values map[string][]string
+}
+
+func newVec(name, help, typ string, labels []string) vec {
+	return vec{
+		desc: desc{
+			name: name,
+			help: help,
+			typ: typ,
+			labels: labels,
+		},
+		series: make(map[string]interface{}),
+		values: make(map[string][]string),
+	}
+}
+
+// get returns the series of values, creates it by create if not exists
+func (v *vec) get(values []string, create func() interface{}) interface{} {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	k := key(values)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	s, ok := v.series[k]
+	if !ok {
+		s = create()
+		v.series[k] = s
+		v.values[k] = append([]string(nil), values...)
+	}
+	return s
+}
+
+// each visits the series in the order of label values
+func (v *vec) each(f func(values []string, s interface{})) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f(v.values[k], v.series[k])
+	}
+}
+
+// Delete removes the series of the label values, such as a removed backend
+func (v *vec) Delete(values ...string) {
+	k := key(values)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.series, k)
+	delete(v.values, k)
+}
+
+// value is a float guarded by a lock
+type value struct {
+	lock sync.Mutex
+	v    float64
+}
+
+func (v *value) add(delta float64) {
+	v.lock.Lock()
+	v.v += delta
+	v.lock.Unlock()
+}
+
+func (v *value) set(n float64) {
+	v.lock.Lock()
+	v.v = n
+	v.lock.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.v
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		vec: newVec(name, help, "counter", labels),
+	}
+	register(c)
+	return c
+}
+
+// Inc increases the counter of the label values by 1
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increases the counter of the label values by delta
+func (c *CounterVec) Add(delta float64, values ...string) {
+	c.get(values, func() interface{} { return &value{} }).(*value).add(delta)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w)
+	c.each(func(values []string, s interface{}) {
+		c.sample(w, "", values, "", s.(*value).get())
+	})
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	vec
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		vec: newVec(name, help, "gauge", labels),
+	}
+	register(g)
+	return g
+}
+
+// Set sets the gauge of the label values
+func (g *GaugeVec) Set(v float64, values ...string) {
+	g.get(values, func() interface{} { return &value{} }).(*value).set(v)
+}
+
+// Add changes the gauge of the label values by delta
+func (g *GaugeVec) Add(delta float64, values ...string) {
+	g.get(values, func() interface{} { return &value{} }).(*value).add(delta)
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.header(w)
+	g.each(func(values []string, s interface{}) {
+		g.sample(w, "", values, "", s.(*value).get())
+	})
+}
+
+// DefaultBuckets of histograms in seconds
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+type histogram struct {
+	lock   sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		vec: newVec(name, help, "histogram", labels),
+		buckets: buckets,
+	}
+	register(h)
+	return h
+}
+
+// Observe records v into the histogram of the label values
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	s := h.get(values, func() interface{} {
+		return &histogram{
+			counts: make([]uint64, len(h.buckets)),
+		}
+	}).(*histogram)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w)
+	h.each(func(values []string, series interface{}) {
+		s := series.(*histogram)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		for i, upper := range h.buckets {
+			h.sample(w, "_bucket", values, fmt.Sprintf("le=\"%s\"", formatFloat(upper)), float64(s.counts[i]))
+		}
+		h.sample(w, "_bucket", values, "le=\"+Inf\"", float64(s.count))
+		h.sample(w, "_sum", values, "", s.sum)
+		h.sample(w, "_count", values, "", float64(s.count))
+	})
+}
+
+// GaugeFunc computes its samples when scraped, for values kept elsewhere
+type GaugeFunc struct {
+	desc
+	collect func(emit func(v float64, values ...string))
+}
+
+// NewGaugeFunc registers a gauge whose samples are emitted by collect on scraping
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, values ...string))) *GaugeFunc {
+	g := &GaugeFunc{
+		desc: desc{
+			name: name,
+			help: help,
+			typ: "gauge",
+			labels: labels,
+		},
+		collect: collect,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	g.header(w)
+	g.collect(func(v float64, values ...string) {
+		g.sample(w, "", values, "", v)
+	})
+}
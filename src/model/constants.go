@@ -4,3 +4,13 @@ const (
 	TypeInit    = "init"
 	TypeElected = "elected"
 )
+
+const (
+	StateHealthy   = "healthy"
+	StateUnhealthy = "unhealthy"
+	StateFlapping  = "flapping"
+	StateDegraded  = "degraded"
+)
+
+// TransitionHistorySize is the number of transitions kept for each peer
+const TransitionHistorySize = 32
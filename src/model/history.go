@@ -0,0 +1,126 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Transition records a state change of a peer
+type Transition struct {
+	Time   time.Time
+	From   string
+	To     string
+	Reason string
+}
+
+// PeerHistory is the state of a peer with its recent transitions, taken at once
+type PeerHistory struct {
+	PeerId      string
+	State       string
+	Flapping    bool
+	Transitions []Transition
+}
+
+// checkWindow keeps the latest check results of a peer, oldest first
+type checkWindow struct {
+	results []bool
+}
+
+func (cw *checkWindow) add(success bool, size int) {
+	cw.results = append(cw.results, success)
+	if len(cw.results) > size {
+		cw.results = cw.results[len(cw.results)-size:]
+	}
+}
+
+// changes returns how many times the result flipped inside the window
+func (cw *checkWindow) changes() int {
+	n := 0
+	for i := 1; i < len(cw.results); i++ {
+		if cw.results[i] != cw.results[i-1] {
+			n++
+		}
+	}
+	return n
+}
+
+// transitionRing is a fixed size ring buffer of transitions
+type transitionRing struct {
+	items []Transition
+	next  int
+	full  bool
+}
+
+func newTransitionRing(size int) *transitionRing {
+	return &transitionRing{
+		items: make([]Transition, size),
+	}
+}
+
+func (tr *transitionRing) add(t Transition) {
+	tr.items[tr.next] = t
+	tr.next = (tr.next + 1) % len(tr.items)
+	if tr.next == 0 {
+		tr.full = true
+	}
+}
+
+// list returns the transitions, oldest first
+func (tr *transitionRing) list() []Transition {
+	if !tr.full {
+		return append([]Transition(nil), tr.items[:tr.next]...)
+	}
+	ts := make([]Transition, 0, len(tr.items))
+	ts = append(ts, tr.items[tr.next:]...)
+	return append(ts, tr.items[:tr.next]...)
+}
+
+// Observe puts the check result into the sliding window and updates the flapping
+// flag with hysteresis: a peer starts flapping when the result flips at least high
+// times inside the window, and stops flapping when it flips at most low times.
+// It returns a non-empty reason when the flapping flag changed.
+func (pi *PeerInfo) Observe(success bool, window, high, low int) string {
+	if window <= 1 || high <= 0 {
+		return ""
+	}
+	pi.window.add(success, window)
+	changes := pi.window.changes()
+	if !pi.Flapping && changes >= high {
+		pi.Flapping = true
+		return fmt.Sprintf("%d state changes in last %d checks", changes, len(pi.window.results))
+	}
+	if pi.Flapping && changes <= low {
+		pi.Flapping = false
+		return fmt.Sprintf("%d state changes in last %d checks", changes, len(pi.window.results))
+	}
+	return ""
+}
+
+// State returns the state name of the peer
+func (pi *PeerInfo) State() string {
+	if pi.Flapping {
+		return StateFlapping
+	}
+	if !pi.Alive {
+		return StateUnhealthy
+	}
+	if pi.Degraded {
+		return StateDegraded
+	}
+	return StateHealthy
+}
+
+// AddTransition records a state change into the history of the peer
+func (pi *PeerInfo) AddTransition(from, to, reason string) {
+	pi.transitions.add(Transition{
+		Time:   time.Now(),
+		From:   from,
+		To:     to,
+		Reason: reason,
+	})
+}
+
+// History returns the recent transitions of the peer, oldest first
+func (pi *PeerInfo) History() []Transition {
+	return pi.transitions.list()
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestObserveFlapping(t *testing.T) {
+	tests := []struct {
+		name              string
+		window, high, low int
+		results           []bool
+		// flapping after each result
+		want []bool
+	}{
+		{
+			name:   "hysteresis",
+			window: 6, high: 3, low: 1,
+			results: []bool{true, false, true, false, true, true, true, true, true, true},
+			want:    []bool{false, false, false, true, true, true, true, true, false, false},
+		},
+		{
+			name:   "steady",
+			window: 6, high: 3, low: 1,
+			results: []bool{true, true, false, false, false, true},
+			want:    []bool{false, false, false, false, false, false},
+		},
+		{
+			name:   "disabled by window",
+			window: 1, high: 1, low: 0,
+			results: []bool{true, false, true, false},
+			want:    []bool{false, false, false, false},
+		},
+		{
+			name:   "disabled by threshold",
+			window: 6, high: 0, low: 0,
+			results: []bool{true, false, true, false},
+			want:    []bool{false, false, false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pi := NewPeer("127.0.0.1:9090", 0)
+			for i, success := range tt.results {
+				was := pi.Flapping
+				reason := pi.Observe(success, tt.window, tt.high, tt.low)
+				if pi.Flapping != tt.want[i] {
+					t.Fatalf("check %d: flapping = %v, want %v", i, pi.Flapping, tt.want[i])
+				}
+				if changed := was != pi.Flapping; changed != (len(reason) > 0) {
+					t.Fatalf("check %d: reason %q when changed is %v", i, reason, changed)
+				}
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		added int
+		// reasons kept, oldest first
+		want []string
+	}{
+		{0, nil},
+		{2, []string{"0", "1"}},
+		{TransitionHistorySize, reasons(0, TransitionHistorySize)},
+		{TransitionHistorySize + 3, reasons(3, TransitionHistorySize+3)},
+	}
+	for _, tt := range tests {
+		pi := NewPeer("127.0.0.1:9090", 0)
+		for i := 0; i < tt.added; i++ {
+			pi.AddTransition(StateHealthy, StateUnhealthy, fmt.Sprint(i))
+		}
+		var got []string
+		for _, transition := range pi.History() {
+			got = append(got, transition.Reason)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d added: history %v, want %v", tt.added, got, tt.want)
+		}
+	}
+}
+
+func reasons(from, to int) []string {
+	var rs []string
+	for i := from; i < to; i++ {
+		rs = append(rs, fmt.Sprint(i))
+	}
+	return rs
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LatencySampleSize is the number of check round trip times kept for each peer
+const LatencySampleSize = 128
+
+// LatencyStats summarizes the recent check round trip times of a peer
+type LatencyStats struct {
+	Samples int
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+// ObserveLatency records the round trip time of a successful check and updates the
+// degraded flag: a peer becomes degraded after count continuous checks slower than
+// threshold, and recovers after count continuous checks within it.
+// It returns a non-empty reason when the degraded flag changed.
+func (pi *PeerInfo) ObserveLatency(latency, threshold time.Duration, count int) string {
+	pi.Latency = latency
+	pi.latencies = append(pi.latencies, latency)
+	if len(pi.latencies) > LatencySampleSize {
+		pi.latencies = pi.latencies[len(pi.latencies)-LatencySampleSize:]
+	}
+	if pi.Degraded {
+		pi.DegradedCount++
+	}
+	if threshold <= 0 {
+		return ""
+	}
+	if count < 1 {
+		count = 1
+	}
+
+	slow := latency > threshold
+	if slow == pi.slow {
+		pi.slowCount++
+	} else {
+		pi.slow = slow
+		pi.slowCount = 1
+	}
+	if pi.slowCount < count || slow == pi.Degraded {
+		return ""
+	}
+	pi.Degraded = slow
+	pi.DegradedCount = 0
+	if slow {
+		return fmt.Sprintf("latency over %v for %d checks", threshold, pi.slowCount)
+	}
+	return fmt.Sprintf("latency within %v for %d checks", threshold, pi.slowCount)
+}
+
+// LatencyStats returns the percentiles of the recent check round trip times
+func (pi *PeerInfo) LatencyStats() LatencyStats {
+	stats := LatencyStats{
+		Samples: len(pi.latencies),
+	}
+	if stats.Samples == 0 {
+		return stats
+	}
+	sorted := append([]time.Duration(nil), pi.latencies...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	stats.P50 = percentile(50)
+	stats.P90 = percentile(90)
+	stats.P99 = percentile(99)
+	stats.Max = sorted[len(sorted)-1]
+	return stats
+}
@@ -0,0 +1,107 @@
+package model
+
+import (
+	"testing"
+	"time"
+)
+
+func TestObserveLatency(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		count     int
+		latencies []time.Duration
+		// degraded after each latency
+		want []bool
+	}{
+		{
+			name:      "continuous",
+			threshold: 10 * ms, count: 2,
+			latencies: []time.Duration{20 * ms, 20 * ms, 5 * ms, 20 * ms, 5 * ms, 5 * ms},
+			want:      []bool{false, true, true, true, true, false},
+		},
+		{
+			name:      "count at least one",
+			threshold: 10 * ms, count: 0,
+			latencies: []time.Duration{20 * ms, 5 * ms},
+			want:      []bool{true, false},
+		},
+		{
+			name:      "at the threshold",
+			threshold: 10 * ms, count: 1,
+			latencies: []time.Duration{10 * ms},
+			want:      []bool{false},
+		},
+		{
+			name:      "disabled",
+			threshold: 0, count: 1,
+			latencies: []time.Duration{time.Second, time.Second},
+			want:      []bool{false, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pi := NewPeer("127.0.0.1:9090", 0)
+			for i, latency := range tt.latencies {
+				was := pi.Degraded
+				reason := pi.ObserveLatency(latency, tt.threshold, tt.count)
+				if pi.Degraded != tt.want[i] {
+					t.Fatalf("check %d: degraded = %v, want %v", i, pi.Degraded, tt.want[i])
+				}
+				if changed := was != pi.Degraded; changed != (len(reason) > 0) {
+					t.Fatalf("check %d: reason %q when changed is %v", i, reason, changed)
+				}
+				if pi.Latency != latency {
+					t.Fatalf("check %d: latency = %v, want %v", i, pi.Latency, latency)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		// samples of 1ms to n ms
+		n    int
+		want LatencyStats
+	}{
+		{"none", 0, LatencyStats{}},
+		{"one", 1, LatencyStats{Samples: 1, P50: ms, P90: ms, P99: ms, Max: ms}},
+		{"hundred", 100, LatencyStats{Samples: 100, P50: 50 * ms, P90: 90 * ms, P99: 99 * ms, Max: 100 * ms}},
+		// the oldest over the sample size are dropped, 73ms to 200ms are kept
+		{"over the sample size", 200, LatencyStats{Samples: LatencySampleSize, P50: 136 * ms, P90: 187 * ms, P99: 198 * ms, Max: 200 * ms}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pi := NewPeer("127.0.0.1:9090", 0)
+			for i := 1; i <= tt.n; i++ {
+				pi.ObserveLatency(time.Duration(i)*ms, 0, 1)
+			}
+			if stats := pi.LatencyStats(); stats != tt.want {
+				t.Errorf("stats = %+v, want %+v", stats, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerState(t *testing.T) {
+	tests := []struct {
+		alive, flapping, degraded bool
+		want                      string
+	}{
+		{true, false, false, StateHealthy},
+		{true, false, true, StateDegraded},
+		{false, false, true, StateUnhealthy},
+		{false, true, false, StateFlapping},
+		{true, true, true, StateFlapping},
+	}
+	for _, tt := range tests {
+		pi := &PeerInfo{Alive: tt.alive, Flapping: tt.flapping, Degraded: tt.degraded}
+		if state := pi.State(); state != tt.want {
+			t.Errorf("alive %v, flapping %v, degraded %v: state = %s, want %s", tt.alive, tt.flapping, tt.degraded, state, tt.want)
+		}
+	}
+}
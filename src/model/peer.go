@@ -3,10 +3,14 @@ package model
 import (
 	"strings"
 	"fmt"
+	"time"
 )
 
 var Self *PeerInfo
 
+// ProxiedScheme of the ProxiedAddress of endpoints, such as http or tls
+var ProxiedScheme = "http"
+
 type PeerInfo struct {
 	PeerId   string
 	// for endpoint this is the control address, not the proxy address
@@ -19,13 +23,30 @@ type PeerInfo struct {
 	Success     bool
 	//
 	Alive bool
+	// the result flips too often in the check window, should not be elected
+	Flapping bool
+	// round trip time of the last successful check
+	Latency time.Duration
+	// checks are continuously slower than the threshold
+	Degraded bool
+	// continuous checks since the peer became degraded
+	DegradedCount int
+	// replication lag reported by the last check, negative if not reported
+	Lag time.Duration
+
+	window      checkWindow
+	transitions *transitionRing
+	latencies   []time.Duration
+	// whether the last check is slow, and the continuous count of it
+	slow      bool
+	slowCount int
 }
 
 func NewPeer(peerAddr string, proxiedPort int) *PeerInfo {
 	var proxiedAddress string
 	if proxiedPort != 0 {
 		ipPort := strings.Split(peerAddr, ":")
-		proxiedAddress = fmt.Sprintf("http://%s:%d", ipPort[0], proxiedPort)
+		proxiedAddress = fmt.Sprintf("%s://%s:%d", ProxiedScheme, ipPort[0], proxiedPort)
 	}
 	return &PeerInfo{
 		PeerId: peerAddr,
@@ -34,6 +55,8 @@ func NewPeer(peerAddr string, proxiedPort int) *PeerInfo {
 		Count: 0,
 		Success: true,
 		Alive: true,
+		Lag: -1,
+		transitions: newTransitionRing(TransitionHistorySize),
 	}
 }
 
@@ -0,0 +1,249 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+	"github.com/mmpei/janus/src/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTimeout = 5 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = time.Second
+	// MaxBackoff caps the doubled backoff
+	MaxBackoff = time.Minute
+	// QueueSize of the events waiting for a webhook, the new ones are dropped when full
+	QueueSize = 64
+)
+
+// DefaultEvents are posted by the webhooks without an event filter
+var DefaultEvents = []event.Type{
+	event.EventElection,
+	event.EventHealthChange,
+	event.EventRoleChange,
+	event.EventSplitBrainSuspected,
+	event.EventSplitBrainCleared,
+}
+
+var notificationsTotal = metrics.NewCounterVec("janus_notifications_total",
+	"Webhook notifications by target and result.", "target", "result")
+
+// Payload is posted to the webhooks as json
+type Payload struct {
+	// Node the janus sending the notification
+	Node  string
+	Event event.Event
+}
+
+// Notifier posts the events of the bus to the webhooks. Each webhook has its own
+// queue and goroutine, so a slow one never delays the others, and publishing
+// never waits for the delivery.
+type Notifier struct {
+	lock    sync.Mutex
+	node    string
+	targets []*target
+}
+
+// target is a webhook being delivered to
+type target struct {
+	config config.WebhookConfig
+	name   string
+	events map[event.Type]bool
+	queue  chan event.Event
+	cancel context.CancelFunc
+	client *http.Client
+}
+
+func NewNotifier(node string, cfg *config.NotificationConfig) *Notifier {
+	n := &Notifier{
+		node: node,
+	}
+	n.SetConfig(cfg)
+	return n
+}
+
+// SetConfig replaces the webhooks, the events queued for the old ones are dropped
+func (n *Notifier) SetConfig(cfg *config.NotificationConfig) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, t := range n.targets {
+		t.cancel()
+	}
+	n.targets = nil
+	for _, wc := range cfg.Webhooks {
+		t := newTarget(wc)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.cancel = cancel
+		go t.run(ctx, n.node)
+		n.targets = append(n.targets, t)
+	}
+	log.Infof("notifications to %d webhooks", len(n.targets))
+}
+
+// Start subscribes to the bus before returning, and posts the events published
+// from then on in the background until ctx is done
+func (n *Notifier) Start(ctx context.Context, bus *event.Bus) {
+	events, cancel := bus.Subscribe(QueueSize)
+	go n.run(ctx, events, cancel)
+}
+
+func (n *Notifier) run(ctx context.Context, events <-chan event.Event, cancel func()) {
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			n.dispatch(e)
+		}
+	}
+}
+
+func (n *Notifier) dispatch(e event.Event) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for _, t := range n.targets {
+		if !t.events[e.Type] {
+			continue
+		}
+		select {
+		case t.queue <- e:
+		default:
+			log.Warningf("webhook %s is too slow, drop event %d", t.name, e.Id)
+			notificationsTotal.Inc(t.name, "dropped")
+		}
+	}
+}
+
+func newTarget(wc config.WebhookConfig) *target {
+	t := &target{
+		config: wc,
+		name:   wc.URL,
+		events: make(map[event.Type]bool),
+		queue:  make(chan event.Event, QueueSize),
+	}
+	// the host names the target in logs and metrics, the url may carry tokens
+	if u, err := url.Parse(wc.URL); err == nil {
+		t.name = u.Host
+	}
+	types := DefaultEvents
+	if len(wc.Events) > 0 {
+		types = nil
+		for _, e := range wc.Events {
+			types = append(types, event.Type(e))
+		}
+	}
+	for _, e := range types {
+		t.events[e] = true
+	}
+	if t.config.Timeout == 0 {
+		t.config.Timeout = config.Duration(DefaultTimeout)
+	}
+	if t.config.Retries == 0 {
+		t.config.Retries = DefaultRetries
+	} else if t.config.Retries < 0 {
+		t.config.Retries = 0
+	}
+	if t.config.Backoff == 0 {
+		t.config.Backoff = config.Duration(DefaultBackoff)
+	}
+	t.client = &http.Client{
+		Timeout: time.Duration(t.config.Timeout),
+	}
+	return t
+}
+
+func (t *target) run(ctx context.Context, node string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-t.queue:
+			t.deliver(ctx, node, e)
+		}
+	}
+}
+
+// deliver posts the event, and retries with backoff on errors, 5xx and 429
+func (t *target) deliver(ctx context.Context, node string, e event.Event) {
+	body, err := json.Marshal(Payload{
+		Node:  node,
+		Event: e,
+	})
+	if err != nil {
+		log.Errorf("json encode event %d: %v", e.Id, err)
+		return
+	}
+	backoff := time.Duration(t.config.Backoff)
+	for attempt := 0; ; attempt++ {
+		retry, err := t.post(ctx, e, body)
+		if err == nil {
+			notificationsTotal.Inc(t.name, "delivered")
+			return
+		}
+		if !retry || attempt >= t.config.Retries {
+			log.Errorf("notify webhook %s of event %d failed after %d attempts: %v", t.name, e.Id, attempt+1, err)
+			notificationsTotal.Inc(t.name, "failed")
+			return
+		}
+		log.Warningf("notify webhook %s of event %d error: %v, retry in %v", t.name, e.Id, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
+
+// post sends the body once, it returns whether the error is worth retrying
+func (t *target) post(ctx context.Context, e event.Event, body []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, "POST", t.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Janus-Event", string(e.Type))
+	request.Header.Set("X-Janus-Delivery", strconv.FormatUint(e.Id, 10))
+	request.Header.Set("X-Janus-Timestamp", timestamp)
+	if len(t.config.Secret) > 0 {
+		request.Header.Set("X-Janus-Signature", "sha256="+Sign(t.config.Secret, timestamp, body))
+	}
+	resp, err := t.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// Sign returns the hex HMAC-SHA256 of "timestamp.body", the receiver verifies it
+// with the X-Janus-Timestamp header and rejects the stale ones to avoid replaying
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
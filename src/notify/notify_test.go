@@ -0,0 +1,163 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+)
+
+// webhook answers the statuses in turn, then 200, and records the requests
+type webhook struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+}
+
+func newWebhook(t *testing.T, statuses ...int) (*webhook, string) {
+	w := &webhook{
+		statuses: statuses,
+		received: make(chan struct{}, 16),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.lock.Lock()
+		status := http.StatusOK
+		if n := len(w.requests); n < len(w.statuses) {
+			status = w.statuses[n]
+		}
+		w.requests = append(w.requests, r)
+		w.bodies = append(w.bodies, body)
+		w.lock.Unlock()
+		rw.WriteHeader(status)
+		w.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return w, server.URL
+}
+
+func (w *webhook) count() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.requests)
+}
+
+func TestDeliverRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		statuses []int
+		attempts int
+	}{
+		{"delivered", 0, nil, 1},
+		{"retried on 5xx", 3, []int{500, 503}, 3},
+		{"retried on 429", 3, []int{429}, 2},
+		{"not retried on 4xx", 3, []int{400}, 1},
+		{"given up", 1, []int{500, 500, 500}, 2},
+		{"retry disabled", -1, []int{500}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, url := newWebhook(t, tt.statuses...)
+			target := newTarget(config.WebhookConfig{
+				URL:     url,
+				Retries: tt.retries,
+				Backoff: config.Duration(time.Millisecond),
+			})
+			target.deliver(context.Background(), "janus-1", event.Event{Id: 1, Type: event.EventElection})
+			if n := w.count(); n != tt.attempts {
+				t.Errorf("%d attempts, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"signed", "s3cret"},
+		{"unsigned", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, url := newWebhook(t)
+			target := newTarget(config.WebhookConfig{URL: url, Secret: tt.secret})
+			target.deliver(context.Background(), "janus-1", event.Event{Id: 7, Type: event.EventMembershipChange, Message: "backends changed"})
+			if w.count() != 1 {
+				t.Fatalf("%d requests, want 1", w.count())
+			}
+			r, body := w.requests[0], w.bodies[0]
+			if r.Header.Get("X-Janus-Event") != "membership_change" || r.Header.Get("X-Janus-Delivery") != "7" {
+				t.Errorf("event %q, delivery %q", r.Header.Get("X-Janus-Event"), r.Header.Get("X-Janus-Delivery"))
+			}
+			var payload Payload
+			if err := json.Unmarshal(body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if payload.Node != "janus-1" || payload.Event.Message != "backends changed" {
+				t.Errorf("payload = %+v", payload)
+			}
+
+			signature := r.Header.Get("X-Janus-Signature")
+			if len(tt.secret) == 0 {
+				if len(signature) > 0 {
+					t.Errorf("signed %q without a secret", signature)
+				}
+				return
+			}
+			mac := hmac.New(sha256.New, []byte(tt.secret))
+			mac.Write([]byte(r.Header.Get("X-Janus-Timestamp") + "."))
+			mac.Write(body)
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+				t.Errorf("signature %q, want %q", signature, want)
+			}
+		})
+	}
+}
+
+func TestNotifierEvents(t *testing.T) {
+	defaults, defaultURL := newWebhook(t)
+	membership, membershipURL := newWebhook(t)
+	n := NewNotifier("janus-1", &config.NotificationConfig{
+		Webhooks: []config.WebhookConfig{
+			{URL: defaultURL},
+			{URL: membershipURL, Events: []string{"membership_change"}},
+		},
+	})
+	bus := event.NewBus(16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n.Start(ctx, bus)
+
+	bus.Publish(event.EventMembershipChange, "", "backends changed", nil)
+	bus.Publish(event.EventElection, "", "elected", nil)
+	bus.Publish(event.EventConfigReload, "", "reloaded", nil)
+	for _, w := range []*webhook{defaults, membership} {
+		select {
+		case <-w.received:
+		case <-time.After(time.Second):
+			t.Fatal("no event posted")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := defaults.requests[0].Header.Get("X-Janus-Event"); defaults.count() != 1 || got != "election" {
+		t.Errorf("default webhook posted %d events, first %q, want the election only", defaults.count(), got)
+	}
+	if got := membership.requests[0].Header.Get("X-Janus-Event"); membership.count() != 1 || got != "membership_change" {
+		t.Errorf("membership webhook posted %d events, first %q, want the membership change only", membership.count(), got)
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// member is a replica having connections
+type member struct {
+	active int
+	// removed is closed when the backend leaves the replicas
+	removed chan struct{}
+}
+
+// balancer picks a replica for every connection by the strategy
+type balancer struct {
+	sync.Mutex
+	config  *config.ReplicaProxyConfig
+	members map[string]*member
+	next    int
+	// current weights of the smooth weighted round robin
+	current map[string]int
+}
+
+func newBalancer(cfg *config.ReplicaProxyConfig) *balancer {
+	return &balancer{
+		config:  cfg,
+		members: make(map[string]*member),
+		current: make(map[string]int),
+	}
+}
+
+// pick returns a replica and a channel closed when it is removed, the connection
+// should be released after closing. It returns nil if no replica is available.
+func (b *balancer) pick(replicas []*model.PeerInfo) (*model.PeerInfo, <-chan struct{}) {
+	b.Lock()
+	defer b.Unlock()
+	if len(replicas) == 0 {
+		return nil, nil
+	}
+	var peer *model.PeerInfo
+	switch b.config.Strategy {
+	case config.BalanceLeastConn:
+		peer = b.leastConn(replicas)
+	case config.BalanceWeighted:
+		peer = b.weighted(replicas)
+	default:
+		peer = replicas[b.next%len(replicas)]
+		b.next++
+	}
+	if peer == nil {
+		return nil, nil
+	}
+
+	m, ok := b.members[peer.PeerId]
+	if !ok {
+		m = &member{removed: make(chan struct{})}
+		b.members[peer.PeerId] = m
+	}
+	m.active++
+	replicaActiveConnections.Add(1, peer.PeerId)
+	return peer, m.removed
+}
+
+// leastConn returns the replica with the fewest connections, the ties are taken
+// in turn
+func (b *balancer) leastConn(replicas []*model.PeerInfo) *model.PeerInfo {
+	var peer *model.PeerInfo
+	least := -1
+	for i := range replicas {
+		p := replicas[(b.next+i)%len(replicas)]
+		active := 0
+		if m, ok := b.members[p.PeerId]; ok {
+			active = m.active
+		}
+		if least < 0 || active < least {
+			peer, least = p, active
+		}
+	}
+	b.next++
+	return peer
+}
+
+// weighted is the smooth weighted round robin, which spreads the picks of a
+// heavy replica among the others
+func (b *balancer) weighted(replicas []*model.PeerInfo) *model.PeerInfo {
+	var peer *model.PeerInfo
+	total := 0
+	for _, p := range replicas {
+		weight, ok := b.config.Weights[p.PeerId]
+		if !ok {
+			weight = 1
+		}
+		if weight <= 0 {
+			continue
+		}
+		b.current[p.PeerId] += weight
+		total += weight
+		if peer == nil || b.current[p.PeerId] > b.current[peer.PeerId] {
+			peer = p
+		}
+	}
+	if peer != nil {
+		b.current[peer.PeerId] -= total
+	}
+	return peer
+}
+
+// release returns the connection picked with the removed channel
+func (b *balancer) release(peerId string, removed <-chan struct{}) {
+	b.Lock()
+	defer b.Unlock()
+	replicaActiveConnections.Add(-1, peerId)
+	if m, ok := b.members[peerId]; ok && m.removed == removed {
+		m.active--
+		if m.active == 0 {
+			delete(b.members, peerId)
+		}
+	}
+}
+
+// reconcile removes the members out of the replicas, their connections are closed
+func (b *balancer) reconcile(replicas []*model.PeerInfo) {
+	ids := make(map[string]bool, len(replicas))
+	for _, peer := range replicas {
+		ids[peer.PeerId] = true
+	}
+	b.Lock()
+	defer b.Unlock()
+	for id, m := range b.members {
+		if !ids[id] {
+			log.Infof("replica %s removed, close its %d connections", id, m.active)
+			close(m.removed)
+			delete(b.members, id)
+		}
+	}
+	for id := range b.current {
+		if !ids[id] {
+			delete(b.current, id)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// targetKey of the request context keeps the backend master of the request
+type targetKey struct{}
+
+func (s *Server) newReverseProxy() *httputil.ReverseProxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = s.dialContext
+	transport.TLSClientConfig = s.backendTLS
+	transport.TLSHandshakeTimeout = time.Duration(s.config.DialTimeout)
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(r.In.Context().Value(targetKey{}).(*url.URL))
+			// the forwarded headers of the clients are replaced, they are not trusted
+			r.SetXForwarded()
+			r.Out.Header.Set("Forwarded", forwarded(r.In))
+			// keep the host asked by the client
+			r.Out.Host = r.In.Host
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Errorf("proxy %s %s: %v", r.Method, r.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// forwarded is the Forwarded header of RFC 7239 for the request
+func forwarded(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	node := host
+	if strings.Contains(host, ":") {
+		node = fmt.Sprintf("%q", "["+host+"]")
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	return fmt.Sprintf("for=%s;host=%q;proto=%s", node, r.Host, proto)
+}
+
+// ServeHTTP proxies the request to the backend master, or to a replica if it is
+// a read of the read routing
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.ReadRouting.Enabled && s.isRead(r) {
+		if u := s.replica(); u != nil {
+			routedTotal.Inc(routeReplica)
+			s.forward(w, r, u)
+			return
+		}
+		routedTotal.Inc("fallback")
+	} else if s.config.ReadRouting.Enabled {
+		routedTotal.Inc(routeMaster)
+	}
+
+	u, _, err := s.master()
+	if err != nil {
+		log.Warningf("proxy %s %s: %v", r.Method, r.URL, err)
+		http.Error(w, "no backend master", http.StatusServiceUnavailable)
+		requestsTotal.Inc(strconv.Itoa(http.StatusServiceUnavailable))
+		return
+	}
+	s.forward(w, r, u)
+}
+
+// forward proxies the request to the backend of u
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	rec := &statusRecorder{
+		ResponseWriter: w,
+		code:           http.StatusOK,
+	}
+	s.reverseProxy.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), targetKey{}, u)))
+	requestsTotal.Inc(strconv.Itoa(rec.code))
+}
+
+// statusRecorder keeps the status code, it flushes for streaming responses
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.code = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import "github.com/mmpei/janus/src/metrics"
+
+var (
+	connectionsTotal = metrics.NewCounterVec("janus_proxy_connections_total",
+		"Client connections of the tcp proxy by result.", "result")
+	activeConnections = metrics.NewGaugeVec("janus_proxy_active_connections",
+		"Client connections being proxied.")
+	bytesTotal = metrics.NewCounterVec("janus_proxy_bytes_total",
+		"Bytes proxied by direction, upstream is from the clients to the backend.", "direction")
+	requestsTotal = metrics.NewCounterVec("janus_proxy_requests_total",
+		"Requests of the http proxy by status code.", "code")
+	dialLatency = metrics.NewHistogramVec("janus_proxy_backend_dial_seconds",
+		"Time of connecting the backend master.", metrics.DefaultBuckets)
+	tlsReloadsTotal = metrics.NewCounterVec("janus_proxy_certificate_reloads_total",
+		"Reloads of the proxy certificates by result.", "result")
+	routedTotal = metrics.NewCounterVec("janus_proxy_routed_requests_total",
+		"Requests of the read routing by target, fallback is the reads to the master without any replica.", "target")
+	replicaConnectionsTotal = metrics.NewCounterVec("janus_proxy_replica_connections_total",
+		"Client connections of the replica proxy by result.", "result")
+	replicaActiveConnections = metrics.NewGaugeVec("janus_proxy_replica_active_connections",
+		"Client connections being proxied to the replica.", "backend")
+	proxyProtocolTotal = metrics.NewCounterVec("janus_proxy_protocol_headers_total",
+		"PROXY protocol headers from the clients by result.", "result")
+	mysqlFailoversTotal = metrics.NewCounterVec("janus_proxy_mysql_failovers_total",
+		"Sessions of the mysql proxy on failover by result, moved to the new master or else.", "result")
+	redisFailoversTotal = metrics.NewCounterVec("janus_proxy_redis_failovers_total",
+		"Sessions and retried commands of the redis proxy on failover by result.", "result")
+	sentinelCommandsTotal = metrics.NewCounterVec("janus_redis_sentinel_commands_total",
+		"Commands of the redis sentinel listener by command.", "command")
+)
@@ -0,0 +1,755 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSessionStatements replayed after moving a session, more pin the session
+const maxSessionStatements = 64
+
+// the capabilities not offered to the clients, the proxy reads the packets
+const mysqlHiddenCapabilities = clientSSL | clientCompress | clientQueryAttributes
+
+// the statements whose effect could not be replayed on another backend
+var pinningStatements = []string{"CREATE TEMPORARY TABLE", "LOCK TABLES", "LOCK INSTANCE", "FLUSH TABLES WITH READ LOCK", "GET_LOCK(", "PREPARE "}
+
+type mysqlEvent struct {
+	// gen of the backend connection, 0 for the client
+	gen int
+	p   *mysqlPacket
+	err error
+}
+
+// mysqlSession is a client session of the mysql proxy. Its loop owns the state,
+// the readers of the client and the backend only send it the packets.
+type mysqlSession struct {
+	server *Server
+	client net.Conn
+	login  *mysqlHandshakeResponse
+	// password of the user, known is false if the session could not log in again
+	password string
+	known    bool
+
+	backend net.Conn
+	gen     int
+	// changed is closed when the master changes, nil once reacted
+	changed <-chan struct{}
+	events  chan mysqlEvent
+	done    chan struct{}
+
+	// the command being answered
+	inflight    bool
+	cmd         byte
+	query       string
+	clientSeq   byte
+	clientCont  bool
+	backendCont bool
+	responded   bool
+	response    mysqlResponse
+
+	inTrans bool
+	// pinned tells why the session could not be moved, empty if it could
+	pinned   string
+	stmts    int
+	schema   string
+	setStmts []string
+
+	// moving waits for the command to move the session
+	moving bool
+	drain  *time.Timer
+	// waiting for a new backend, with the commands of the client queued
+	failover *time.Timer
+	retry    *time.Ticker
+	queued   []*mysqlPacket
+	// aborted answers the next command an error, the transaction is lost
+	aborted bool
+}
+
+// handleMySQLConn proxies a mysql session to the backend master, the session is
+// moved to the new master on failover if possible
+func (s *Server) handleMySQLConn(conn net.Conn) {
+	defer conn.Close()
+	u, changed, err := s.master()
+	if err != nil {
+		log.Warningf("proxy %s: %v", conn.RemoteAddr(), err)
+		connectionsTotal.Inc("no_master")
+		return
+	}
+	backend, err := s.dial(context.Background(), u, s.header(conn))
+	if err != nil {
+		log.Errorf("proxy %s to %s: %v", conn.RemoteAddr(), u.Host, err)
+		connectionsTotal.Inc("dial_error")
+		return
+	}
+	sess := &mysqlSession{
+		server:  s,
+		client:  conn,
+		backend: backend,
+		gen:     1,
+		changed: changed,
+		events:  make(chan mysqlEvent),
+		done:    make(chan struct{}),
+	}
+	defer sess.close()
+	if err := sess.relayLogin(); err != nil {
+		log.Warningf("mysql proxy %s login: %v", conn.RemoteAddr(), err)
+		connectionsTotal.Inc("login_error")
+		return
+	}
+	connectionsTotal.Inc("proxied")
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+	sess.run()
+}
+
+// relayLogin relays the handshake and the auth exchange, keeping the handshake
+// response of the client
+func (sess *mysqlSession) relayLogin() error {
+	p, err := readMySQLPacket(sess.backend)
+	if err != nil {
+		return err
+	}
+	handshake, err := parseMySQLHandshake(p.payload)
+	if err != nil {
+		writeMySQLPacket(sess.client, p.seq, p.payload)
+		return err
+	}
+	if err := writeMySQLPacket(sess.client, p.seq, handshake.withoutCapabilities(mysqlHiddenCapabilities)); err != nil {
+		return err
+	}
+
+	p, err = readMySQLPacket(sess.client)
+	if err != nil {
+		return err
+	}
+	if login, err := parseMySQLHandshakeResponse(p.payload); err != nil {
+		sess.pinned = err.Error()
+	} else if login.capabilities&clientSSL != 0 {
+		return fmt.Errorf("client asks for TLS which is not offered")
+	} else {
+		sess.login = login
+		sess.schema = login.database
+		sess.password, sess.known = sess.server.config.MySQL.Password(login.user)
+	}
+	if err := writeMySQLPacket(sess.backend, p.seq, p.payload); err != nil {
+		return err
+	}
+
+	for {
+		p, err := readMySQLPacket(sess.backend)
+		if err != nil {
+			return err
+		}
+		if err := writeMySQLPacket(sess.client, p.seq, p.payload); err != nil {
+			return err
+		}
+		switch p.first() {
+		case mysqlOK:
+			return nil
+		case mysqlErr:
+			return fmt.Errorf("backend refused: %s", mysqlErrMessage(p.payload))
+		case mysqlAuthMore:
+			if len(p.payload) > 1 && p.payload[1] == cachingSHA2FastOK {
+				// the OK follows without the client
+				continue
+			}
+		}
+		// the client answers the auth switch or the auth data
+		p, err = readMySQLPacket(sess.client)
+		if err != nil {
+			return err
+		}
+		if err := writeMySQLPacket(sess.backend, p.seq, p.payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (sess *mysqlSession) run() {
+	go sess.read(sess.client, 0)
+	go sess.read(sess.backend, sess.gen)
+	for {
+		var drain, failover, retry <-chan time.Time
+		if sess.drain != nil {
+			drain = sess.drain.C
+		}
+		if sess.failover != nil {
+			failover = sess.failover.C
+			retry = sess.retry.C
+		}
+		ok := true
+		select {
+		case e := <-sess.events:
+			switch {
+			case e.gen == 0 && e.err != nil:
+				return
+			case e.gen == 0:
+				ok = sess.fromClient(e.p)
+			case e.gen != sess.gen:
+				// from a backend left
+			case e.err != nil:
+				ok = sess.backendLost(e.err)
+			default:
+				ok = sess.fromBackend(e.p)
+			}
+		case <-sess.changed:
+			sess.changed = nil
+			ok = sess.masterChanged()
+		case <-drain:
+			sess.drain = nil
+			ok = sess.failCommand("the command did not finish before the backend master changed")
+		case <-retry:
+			ok = sess.move()
+		case <-failover:
+			mysqlFailoversTotal.Inc("timeout")
+			if len(sess.queued) > 0 {
+				sess.writeError(sess.clientSeq+1, "no backend master to move the session to")
+			}
+			log.Warningf("mysql session %s: no backend master in time", sess.client.RemoteAddr())
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// read sends the packets of the connection to the loop until it fails
+func (sess *mysqlSession) read(conn net.Conn, gen int) {
+	for {
+		p, err := readMySQLPacket(conn)
+		select {
+		case sess.events <- mysqlEvent{gen: gen, p: p, err: err}:
+		case <-sess.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (sess *mysqlSession) close() {
+	close(sess.done)
+	if sess.backend != nil {
+		sess.backend.Close()
+	}
+	if sess.drain != nil {
+		sess.drain.Stop()
+	}
+	sess.stopWaiting()
+}
+
+// fromClient forwards a packet of the client, it returns false to end the session
+func (sess *mysqlSession) fromClient(p *mysqlPacket) bool {
+	sess.clientSeq = p.seq
+	if sess.aborted {
+		mysqlFailoversTotal.Inc("aborted_transaction")
+		sess.writeError(p.seq+1, "the transaction is lost with the backend master")
+		return false
+	}
+	if sess.backend == nil {
+		if p.first() == comQuit && !sess.clientCont {
+			return false
+		}
+		sess.queued = append(sess.queued, p)
+		return true
+	}
+
+	if len(sess.pinned) == 0 {
+		switch {
+		case sess.clientCont:
+			// continues the command
+		case sess.inflight && sess.response.state == stateInfile:
+			// the data of LOAD DATA LOCAL INFILE
+		case sess.inflight:
+			sess.pin("pipelined commands")
+		default:
+			sess.startCommand(p)
+		}
+	}
+	sess.clientCont = p.continued()
+	if err := writeMySQLPacket(sess.backend, p.seq, p.payload); err != nil {
+		return sess.backendLost(err)
+	}
+	return true
+}
+
+// startCommand tracks the command and the response expected
+func (sess *mysqlSession) startCommand(p *mysqlPacket) {
+	sess.cmd = p.first()
+	sess.responded = false
+	sess.backendCont = false
+	sess.inflight = true
+	kind := responseSingle
+	switch sess.cmd {
+	case comQuit, comStmtSendLongData:
+		sess.inflight = false
+	case comStmtClose:
+		sess.inflight = false
+		if sess.stmts > 0 {
+			sess.stmts--
+		}
+	case comQuery:
+		sess.query = strings.TrimSpace(string(p.payload[1:]))
+		head := queryHead(sess.query)
+		for _, stmt := range pinningStatements {
+			if strings.Contains(head, stmt) {
+				sess.pin(strings.TrimSuffix(stmt, "("))
+			}
+		}
+		kind = responseResultSet
+	case comStmtExecute:
+		kind = responseResultSet
+	case comStmtFetch:
+		kind = responseRows
+	case comStmtPrepare:
+		kind = responsePrepare
+	case comFieldList:
+		kind = responseFieldList
+	case comInitDB:
+		sess.query = string(p.payload[1:])
+	case comChangeUser:
+		sess.pin("change user")
+	case comStatistics, comResetConnection, 0x07, 0x0c, 0x0d, 0x0e, 0x1b:
+		// refresh, kill, debug, ping and set option answer a packet
+	default:
+		sess.pin(fmt.Sprintf("command %#x", sess.cmd))
+	}
+	sess.response = mysqlResponse{kind: kind}
+}
+
+// fromBackend forwards a packet of the backend, it returns false to end the
+// session
+func (sess *mysqlSession) fromBackend(p *mysqlPacket) bool {
+	if len(sess.pinned) == 0 && !sess.inflight {
+		if p.first() == mysqlErr {
+			// such as closing the idle connection, the session moves when it is lost
+			log.Infof("mysql session %s: backend says %s", sess.client.RemoteAddr(), mysqlErrMessage(p.payload))
+			return true
+		}
+		sess.pin("unexpected packet")
+	}
+	if err := writeMySQLPacket(sess.client, p.seq, p.payload); err != nil {
+		return false
+	}
+	sess.responded = true
+	if len(sess.pinned) > 0 {
+		return true
+	}
+	cont := sess.backendCont
+	sess.backendCont = p.continued()
+	if cont {
+		return true
+	}
+	done, err := sess.response.next(p, sess.deprecateEOF())
+	if err != nil {
+		sess.pin(err.Error())
+		return true
+	}
+	if done {
+		return sess.commandDone()
+	}
+	return true
+}
+
+// commandDone keeps the effects of the command which should be replayed, and
+// moves the session if the master changed while running it
+func (sess *mysqlSession) commandDone() bool {
+	sess.inflight = false
+	r := &sess.response
+	if r.hasStatus {
+		sess.inTrans = r.status&serverStatusInTrans != 0
+	}
+	if !r.failed {
+		switch sess.cmd {
+		case comQuery:
+			sess.keepStatement(sess.query)
+		case comInitDB:
+			sess.schema = sess.query
+		case comStmtPrepare:
+			sess.stmts++
+		case comResetConnection:
+			sess.stmts = 0
+			sess.setStmts = nil
+		}
+	}
+	if !sess.moving {
+		return true
+	}
+	if sess.drain != nil {
+		sess.drain.Stop()
+		sess.drain = nil
+	}
+	return sess.moveOrAbort()
+}
+
+// keepStatement keeps the SET and USE statements, the latest last
+func (sess *mysqlSession) keepStatement(stmt string) {
+	head := queryHead(stmt)
+	switch {
+	case strings.HasPrefix(head, "USE "):
+		sess.schema = strings.Trim(strings.TrimSpace(stmt[4:]), "`;")
+	case strings.HasPrefix(head, "SET ") && !strings.HasPrefix(head, "SET TRANSACTION"):
+		for i, s := range sess.setStmts {
+			if s == stmt {
+				sess.setStmts = append(sess.setStmts[:i], sess.setStmts[i+1:]...)
+				break
+			}
+		}
+		sess.setStmts = append(sess.setStmts, stmt)
+		if len(sess.setStmts) > maxSessionStatements {
+			sess.pin("too many SET statements")
+		}
+	}
+}
+
+// masterChanged moves the session, or waits for its command to finish
+func (sess *mysqlSession) masterChanged() bool {
+	if reason := sess.stuck(); len(reason) > 0 {
+		log.Infof("mysql session %s could not move, %s, close it", sess.client.RemoteAddr(), reason)
+		mysqlFailoversTotal.Inc("closed")
+		return false
+	}
+	if sess.inflight {
+		sess.moving = true
+		sess.drain = time.NewTimer(time.Duration(sess.server.config.MySQL.DrainTimeout))
+		return true
+	}
+	return sess.moveOrAbort()
+}
+
+func (sess *mysqlSession) moveOrAbort() bool {
+	sess.moving = false
+	if !sess.inTrans {
+		return sess.move()
+	}
+	// answer the error to the next command, the client is not waiting for one now
+	log.Infof("mysql session %s in a transaction, abort it", sess.client.RemoteAddr())
+	sess.leaveBackend()
+	sess.aborted = true
+	return true
+}
+
+// backendLost waits for a backend to move the session to, the command running
+// fails
+func (sess *mysqlSession) backendLost(err error) bool {
+	log.Infof("mysql session %s lost the backend: %v", sess.client.RemoteAddr(), err)
+	if reason := sess.stuck(); len(reason) > 0 {
+		mysqlFailoversTotal.Inc("closed")
+		return false
+	}
+	if sess.inflight {
+		return sess.failCommand("lost the backend while running the command")
+	}
+	if sess.inTrans {
+		sess.leaveBackend()
+		sess.aborted = true
+		return true
+	}
+	sess.leaveBackend()
+	return sess.move()
+}
+
+// failCommand answers the error to the running command if nothing is answered,
+// the session ends anyway
+func (sess *mysqlSession) failCommand(reason string) bool {
+	mysqlFailoversTotal.Inc("aborted_command")
+	log.Infof("mysql session %s: %s", sess.client.RemoteAddr(), reason)
+	if !sess.responded {
+		sess.writeError(sess.clientSeq+1, reason)
+	}
+	return false
+}
+
+// move authenticates the session to the master and replays its statements, it
+// waits for the master until the failover timeout if failing
+func (sess *mysqlSession) move() bool {
+	u, changed, err := sess.server.master()
+	if err == nil {
+		var conn net.Conn
+		if conn, err = sess.server.dial(context.Background(), u, sess.server.header(sess.client)); err == nil {
+			if err = sess.replay(conn); err != nil {
+				conn.Close()
+			} else {
+				sess.leaveBackend()
+				sess.stopWaiting()
+				sess.backend = conn
+				sess.changed = changed
+				sess.gen++
+				go sess.read(conn, sess.gen)
+				mysqlFailoversTotal.Inc("moved")
+				log.Infof("mysql session %s of %s moved to %s", sess.client.RemoteAddr(), sess.login.user, u.Host)
+				return sess.flushQueued()
+			}
+		}
+	}
+	sess.leaveBackend()
+	sess.changed = changed
+	if sess.failover != nil {
+		log.Debugf("mysql session %s move failed: %v", sess.client.RemoteAddr(), err)
+	} else {
+		log.Warningf("mysql session %s move failed, wait for the master: %v", sess.client.RemoteAddr(), err)
+		sess.failover = time.NewTimer(time.Duration(sess.server.config.MySQL.FailoverTimeout))
+		sess.retry = time.NewTicker(time.Second)
+	}
+	return true
+}
+
+// replay logs in to the backend and replays the session statements
+func (sess *mysqlSession) replay(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(time.Duration(sess.server.config.DialTimeout)))
+	defer conn.SetDeadline(time.Time{})
+	if err := mysqlAuthenticate(conn, sess.login, sess.password, sess.schema); err != nil {
+		return err
+	}
+	for _, stmt := range sess.setStmts {
+		if err := writeMySQLPacket(conn, 0, append([]byte{comQuery}, stmt...)); err != nil {
+			return err
+		}
+		r := mysqlResponse{kind: responseResultSet}
+		for {
+			p, err := readMySQLPacket(conn)
+			if err != nil {
+				return err
+			}
+			done, err := r.next(p, sess.deprecateEOF())
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+		}
+		if r.failed {
+			return fmt.Errorf("replay %q failed", stmt)
+		}
+	}
+	return nil
+}
+
+// flushQueued forwards the commands the client sent while moving
+func (sess *mysqlSession) flushQueued() bool {
+	queued := sess.queued
+	sess.queued = nil
+	for _, p := range queued {
+		if !sess.fromClient(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// leaveBackend closes the backend, the packets and the error of it read later are
+// dropped by the generation
+func (sess *mysqlSession) leaveBackend() {
+	if sess.backend != nil {
+		sess.backend.Close()
+		sess.backend = nil
+		sess.gen++
+	}
+	sess.inflight = false
+}
+
+func (sess *mysqlSession) stopWaiting() {
+	if sess.failover != nil {
+		sess.failover.Stop()
+		sess.retry.Stop()
+		sess.failover, sess.retry = nil, nil
+	}
+}
+
+// stuck returns why the session could not be moved, empty if it could
+func (sess *mysqlSession) stuck() string {
+	switch {
+	case len(sess.pinned) > 0:
+		return sess.pinned
+	case !sess.known:
+		return "unknown user"
+	case sess.stmts > 0:
+		return "prepared statements"
+	}
+	return ""
+}
+
+func (sess *mysqlSession) pin(reason string) {
+	if len(sess.pinned) == 0 {
+		log.Debugf("mysql session %s pinned: %s", sess.client.RemoteAddr(), reason)
+		sess.pinned = reason
+	}
+}
+
+func (sess *mysqlSession) deprecateEOF() bool {
+	return sess.login != nil && sess.login.capabilities&clientDeprecateEOF != 0
+}
+
+func (sess *mysqlSession) writeError(seq byte, message string) {
+	writeMySQLPacket(sess.client, seq, mysqlErrPacket(mysqlErrConnectionKilled, "70100", "janus: "+message))
+}
+
+// queryHead returns the head of the query in upper case for matching
+func queryHead(query string) string {
+	if len(query) > 4096 {
+		query = query[:4096]
+	}
+	return strings.ToUpper(query)
+}
+
+const (
+	responseSingle = iota
+	responseResultSet
+	responseRows
+	responsePrepare
+	responseFieldList
+)
+
+const (
+	stateStart = iota
+	stateColumns
+	stateColumnsEOF
+	stateRows
+	stateInfile
+	stateDefinitions
+)
+
+// mysqlResponse follows the packets of a response to know when it ends
+type mysqlResponse struct {
+	kind  int
+	state int
+	// definitions left of the columns or the params
+	remaining int
+	// sections of definitions left of a prepare response
+	sections []int
+
+	status    uint16
+	hasStatus bool
+	failed    bool
+}
+
+// next follows a packet, it returns true when the response ends
+func (r *mysqlResponse) next(p *mysqlPacket, deprecateEOF bool) (bool, error) {
+	switch r.kind {
+	case responseSingle:
+		return r.end(p), nil
+	case responseRows:
+		r.state = stateRows
+		r.kind = responseResultSet
+	case responseFieldList:
+		if p.first() == mysqlErr || p.isEOF(deprecateEOF) {
+			return r.end(p), nil
+		}
+		return false, nil
+	case responsePrepare:
+		return r.nextPrepare(p, deprecateEOF)
+	}
+
+	switch r.state {
+	case stateStart, stateInfile:
+		switch p.first() {
+		case mysqlOK, mysqlErr:
+			return r.endResult(p), nil
+		case mysqlLocalInfile:
+			if r.state == stateStart {
+				r.state = stateInfile
+				return false, nil
+			}
+		}
+		if r.state == stateInfile {
+			return false, fmt.Errorf("%w: %#x after LOCAL INFILE", ErrMySQLPacket, p.first())
+		}
+		n, size := readLenenc(p.payload)
+		if size == 0 || n == 0 {
+			return false, fmt.Errorf("%w: column count", ErrMySQLPacket)
+		}
+		r.state, r.remaining = stateColumns, int(n)
+	case stateColumns:
+		r.remaining--
+		if r.remaining == 0 {
+			r.state = stateColumnsEOF
+			if deprecateEOF {
+				r.state = stateRows
+			}
+		}
+	case stateColumnsEOF:
+		if !p.isEOF(false) {
+			return false, fmt.Errorf("%w: %#x after the columns", ErrMySQLPacket, p.first())
+		}
+		r.status, r.hasStatus = p.status()
+		if r.status&serverStatusCursorExists != 0 {
+			// the rows are fetched by COM_STMT_FETCH
+			return true, nil
+		}
+		r.state = stateRows
+	case stateRows:
+		if p.first() == mysqlErr || p.isEOF(deprecateEOF) {
+			return r.endResult(p), nil
+		}
+	}
+	return false, nil
+}
+
+// nextPrepare follows the OK of the statement and the definitions of its
+// params and columns
+func (r *mysqlResponse) nextPrepare(p *mysqlPacket, deprecateEOF bool) (bool, error) {
+	switch r.state {
+	case stateStart:
+		if p.first() != mysqlOK {
+			return r.end(p), nil
+		}
+		if len(p.payload) < 9 {
+			return false, fmt.Errorf("%w: prepare OK", ErrMySQLPacket)
+		}
+		columns := int(binary.LittleEndian.Uint16(p.payload[5:]))
+		params := int(binary.LittleEndian.Uint16(p.payload[7:]))
+		r.state = stateDefinitions
+		r.sections = []int{params, columns}
+	case stateDefinitions:
+		if r.remaining > 0 {
+			r.remaining--
+			if r.remaining > 0 || deprecateEOF {
+				break
+			}
+			// the EOF of the definitions follows
+			return false, nil
+		}
+		if !p.isEOF(false) {
+			return false, fmt.Errorf("%w: %#x after the definitions", ErrMySQLPacket, p.first())
+		}
+	}
+	// the next section having definitions
+	for r.remaining == 0 && len(r.sections) > 0 {
+		r.remaining, r.sections = r.sections[0], r.sections[1:]
+	}
+	return r.remaining == 0, nil
+}
+
+// endResult ends a result, another one follows if the server says more
+func (r *mysqlResponse) endResult(p *mysqlPacket) bool {
+	if !r.end(p) {
+		return false
+	}
+	if r.hasStatus && r.status&serverMoreResultsExists != 0 && !r.failed {
+		r.state = stateStart
+		return false
+	}
+	return true
+}
+
+// end keeps the status of the last packet, it always ends
+func (r *mysqlResponse) end(p *mysqlPacket) bool {
+	if p.first() == mysqlErr {
+		r.failed = true
+		return true
+	}
+	if status, ok := p.status(); ok && (p.first() == mysqlOK || p.first() == mysqlEOF) {
+		r.status, r.hasStatus = status, true
+	}
+	return true
+}
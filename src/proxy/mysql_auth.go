@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+)
+
+const (
+	mysqlNativePassword  = "mysql_native_password"
+	mysqlCachingSHA2     = "caching_sha2_password"
+	cachingSHA2FastOK    = 3
+	cachingSHA2FullAuth  = 4
+	cachingSHA2PublicKey = 2
+)
+
+// scramblePassword computes the auth response of the plugin for the scramble
+func scramblePassword(plugin string, scramble []byte, password string) ([]byte, error) {
+	if len(password) == 0 {
+		return nil, nil
+	}
+	if len(scramble) == 0 {
+		return nil, fmt.Errorf("%w: empty scramble of %s", ErrMySQLPacket, plugin)
+	}
+	switch plugin {
+	case mysqlNativePassword:
+		// SHA1(password) XOR SHA1(scramble + SHA1(SHA1(password)))
+		stage1 := sha1.Sum([]byte(password))
+		stage2 := sha1.Sum(stage1[:])
+		h := sha1.New()
+		h.Write(scramble)
+		h.Write(stage2[:])
+		return xorBytes(stage1[:], h.Sum(nil)), nil
+	case mysqlCachingSHA2:
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + scramble)
+		stage1 := sha256.Sum256([]byte(password))
+		stage2 := sha256.Sum256(stage1[:])
+		h := sha256.New()
+		h.Write(stage2[:])
+		h.Write(scramble)
+		return xorBytes(stage1[:], h.Sum(nil)), nil
+	}
+	return nil, fmt.Errorf("unsupported auth plugin %s", plugin)
+}
+
+// xorBytes repeats b over a, b should not be empty
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i%len(b)]
+	}
+	return out
+}
+
+// mysqlAuthenticate authenticates the session to the backend as its user, the
+// schema is used after authenticating
+func mysqlAuthenticate(conn net.Conn, client *mysqlHandshakeResponse, password, database string) error {
+	p, err := readMySQLPacket(conn)
+	if err != nil {
+		return err
+	}
+	handshake, err := parseMySQLHandshake(p.payload)
+	if err != nil {
+		return err
+	}
+	plugin := handshake.plugin
+	if plugin != mysqlCachingSHA2 {
+		plugin = mysqlNativePassword
+	}
+	scramble := handshake.scramble
+	auth, err := scramblePassword(plugin, scramble, password)
+	if err != nil {
+		return err
+	}
+	seq := p.seq + 1
+	if err := writeMySQLPacket(conn, seq, client.build(plugin, auth, database)); err != nil {
+		return err
+	}
+
+	for {
+		p, err := readMySQLPacket(conn)
+		if err != nil {
+			return err
+		}
+		seq = p.seq + 1
+		switch p.first() {
+		case mysqlOK:
+			return nil
+		case mysqlErr:
+			return fmt.Errorf("authenticate %s: %s", client.user, mysqlErrMessage(p.payload))
+		case mysqlEOF:
+			// switch to the plugin asked by the server
+			name, data, err := readNul(p.payload[1:])
+			if err != nil {
+				return err
+			}
+			plugin = name
+			scramble = data
+			if n := len(scramble); n > 0 && scramble[n-1] == 0 {
+				scramble = scramble[:n-1]
+			}
+			if auth, err = scramblePassword(plugin, scramble, password); err != nil {
+				return err
+			}
+			if err := writeMySQLPacket(conn, seq, auth); err != nil {
+				return err
+			}
+		case mysqlAuthMore:
+			data := p.payload[1:]
+			if plugin != mysqlCachingSHA2 || len(data) == 0 {
+				return fmt.Errorf("unexpected auth data of %s", plugin)
+			}
+			switch data[0] {
+			case cachingSHA2FastOK:
+				// the OK follows
+			case cachingSHA2FullAuth:
+				// the password is sent encrypted by the public key of the server
+				if err := writeMySQLPacket(conn, seq, []byte{cachingSHA2PublicKey}); err != nil {
+					return err
+				}
+			default:
+				encrypted, err := encryptPassword(data, scramble, password)
+				if err != nil {
+					return err
+				}
+				if err := writeMySQLPacket(conn, seq, encrypted); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("%w: auth packet %#x", ErrMySQLPacket, p.first())
+		}
+	}
+}
+
+// encryptPassword encrypts the password XOR scramble by the PEM public key
+func encryptPassword(key, scramble []byte, password string) ([]byte, error) {
+	if len(scramble) == 0 {
+		return nil, fmt.Errorf("%w: empty scramble to encrypt the password", ErrMySQLPacket)
+	}
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key of the server")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key of the server is not RSA")
+	}
+	plain := xorBytes(append([]byte(password), 0), scramble)
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, rsaKey, plain, nil)
+}
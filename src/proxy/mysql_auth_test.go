@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeMySQL is the server side of an authentication, it checks the auth
+// responses by the password as mysql does
+type fakeMySQL struct {
+	conn     net.Conn
+	password string
+	seq      byte
+}
+
+func (f *fakeMySQL) write(payload []byte) error {
+	err := writeMySQLPacket(f.conn, f.seq, payload)
+	f.seq++
+	return err
+}
+
+func (f *fakeMySQL) read() ([]byte, error) {
+	p, err := readMySQLPacket(f.conn)
+	if err != nil {
+		return nil, err
+	}
+	f.seq = p.seq + 1
+	return p.payload, nil
+}
+
+// readLogin reads the handshake response and returns its auth response
+func (f *fakeMySQL) readLogin() (*mysqlHandshakeResponse, []byte, error) {
+	payload, err := f.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	login, err := parseMySQLHandshakeResponse(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, b, _ := readNul(payload[32:])
+	n, size := readLenenc(b)
+	return login, b[size : size+int(n)], nil
+}
+
+func (f *fakeMySQL) checkNative(scramble, auth []byte) error {
+	stage1 := sha1.Sum([]byte(f.password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.Sum(append(append([]byte{}, scramble...), stage2[:]...))
+	if len(auth) != len(h) {
+		return fmt.Errorf("native auth response of %d bytes", len(auth))
+	}
+	for i := range auth {
+		auth[i] ^= h[i]
+	}
+	if sha1.Sum(auth) != stage2 {
+		return errors.New("native auth response does not match")
+	}
+	return nil
+}
+
+func (f *fakeMySQL) checkSHA2(scramble, auth []byte) error {
+	stage1 := sha256.Sum256([]byte(f.password))
+	stage2 := sha256.Sum256(stage1[:])
+	h := sha256.Sum256(append(stage2[:], scramble...))
+	if len(auth) != len(h) {
+		return fmt.Errorf("sha2 auth response of %d bytes", len(auth))
+	}
+	for i := range auth {
+		if auth[i]^h[i] != stage1[i] {
+			return errors.New("sha2 auth response does not match")
+		}
+	}
+	return nil
+}
+
+func TestMySQLAuthenticate(t *testing.T) {
+	scramble := []byte("0123456789abcdefghij")
+	other := []byte("ABCDEFGHIJ0123456789")
+	caps := uint32(clientProtocol41 | clientSecureConnection | clientPluginAuth | clientPluginAuthLenenc)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	tests := []struct {
+		name   string
+		plugin string
+		// serve authenticates the client after the handshake
+		serve func(f *fakeMySQL, login *mysqlHandshakeResponse, auth []byte) error
+		err   string
+	}{
+		{
+			name:   "native",
+			plugin: mysqlNativePassword,
+			serve: func(f *fakeMySQL, login *mysqlHandshakeResponse, auth []byte) error {
+				if login.database != "shop" || login.plugin != mysqlNativePassword {
+					return fmt.Errorf("login = %+v", login)
+				}
+				if err := f.checkNative(scramble, auth); err != nil {
+					return err
+				}
+				return f.write(okPacket(0))
+			},
+		},
+		{
+			name:   "switched to native",
+			plugin: mysqlCachingSHA2,
+			serve: func(f *fakeMySQL, login *mysqlHandshakeResponse, auth []byte) error {
+				if err := f.write(append(append([]byte{mysqlEOF}, mysqlNativePassword+"\x00"...), append(other, 0)...)); err != nil {
+					return err
+				}
+				auth, err := f.read()
+				if err != nil {
+					return err
+				}
+				if err := f.checkNative(other, auth); err != nil {
+					return err
+				}
+				return f.write(okPacket(0))
+			},
+		},
+		{
+			name:   "caching sha2 fast",
+			plugin: mysqlCachingSHA2,
+			serve: func(f *fakeMySQL, login *mysqlHandshakeResponse, auth []byte) error {
+				if err := f.checkSHA2(scramble, auth); err != nil {
+					return err
+				}
+				if err := f.write([]byte{mysqlAuthMore, cachingSHA2FastOK}); err != nil {
+					return err
+				}
+				return f.write(okPacket(0))
+			},
+		},
+		{
+			name:   "caching sha2 full",
+			plugin: mysqlCachingSHA2,
+			serve: func(f *fakeMySQL, login *mysqlHandshakeResponse, auth []byte) error {
+				if err := f.write([]byte{mysqlAuthMore, cachingSHA2FullAuth}); err != nil {
+					return err
+				}
+				request, err := f.read()
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(request, []byte{cachingSHA2PublicKey}) {
+					return fmt.Errorf("public key request %x", request)
+				}
+				if err := f.write(append([]byte{mysqlAuthMore}, publicKey...)); err != nil {
+					return err
+				}
+				encrypted, err := f.read()
+				if err != nil {
+					return err
+				}
+				plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, encrypted, nil)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(plain, xorBytes([]byte(f.password+"\x00"), scramble)) {
+					return errors.New("encrypted password does not match")
+				}
+				return f.write(okPacket(0))
+			},
+		},
+		{
+			name:   "refused",
+			plugin: mysqlNativePassword,
+			serve: func(f *fakeMySQL, login *mysqlHandshakeResponse, auth []byte) error {
+				return f.write(mysqlErrPacket(1045, "28000", "Access denied for user 'app'"))
+			},
+			err: "Access denied",
+		},
+		{
+			name:   "switched without scramble",
+			plugin: mysqlCachingSHA2,
+			serve: func(f *fakeMySQL, login *mysqlHandshakeResponse, auth []byte) error {
+				return f.write(append([]byte{mysqlEOF}, mysqlNativePassword+"\x00"...))
+			},
+			err: "empty scramble",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			served := make(chan error, 1)
+			go func() {
+				defer server.Close()
+				f := &fakeMySQL{conn: server, password: "secret"}
+				if err := f.write(handshake(caps, scramble, tt.plugin)); err != nil {
+					served <- err
+					return
+				}
+				login, auth, err := f.readLogin()
+				if err != nil {
+					served <- err
+					return
+				}
+				served <- tt.serve(f, login, auth)
+			}()
+
+			login := &mysqlHandshakeResponse{
+				capabilities:  clientProtocol41 | clientSecureConnection,
+				maxPacketSize: 1 << 24,
+				charset:       45,
+				user:          "app",
+			}
+			err := mysqlAuthenticate(client, login, "secret", "shop")
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-served; err != nil {
+				t.Fatalf("server: %v", err)
+			}
+		})
+	}
+}
+
+func TestScramblePassword(t *testing.T) {
+	if auth, err := scramblePassword(mysqlNativePassword, nil, ""); auth != nil || err != nil {
+		t.Errorf("empty password = %x, %v, want no auth response", auth, err)
+	}
+	if _, err := scramblePassword(mysqlNativePassword, nil, "secret"); !errors.Is(err, ErrMySQLPacket) {
+		t.Errorf("empty scramble error = %v, want %v", err, ErrMySQLPacket)
+	}
+	if _, err := encryptPassword(nil, nil, "secret"); !errors.Is(err, ErrMySQLPacket) {
+		t.Errorf("encrypt by empty scramble error = %v, want %v", err, ErrMySQLPacket)
+	}
+	if _, err := scramblePassword("sha256_password", []byte("0123456789abcdefghij"), "secret"); err == nil {
+		t.Error("unsupported plugin scrambled without error")
+	}
+}
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// the subset of the mysql protocol the mysql proxy follows
+const (
+	mysqlMaxPayload = 0xffffff
+
+	mysqlOK          = 0x00
+	mysqlAuthMore    = 0x01
+	mysqlLocalInfile = 0xfb
+	mysqlEOF         = 0xfe
+	mysqlErr         = 0xff
+
+	clientConnectWithDB    = 0x00000008
+	clientCompress         = 0x00000020
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientSecureConnection = 0x00008000
+	clientPluginAuth       = 0x00080000
+	clientConnectAttrs     = 0x00100000
+	clientPluginAuthLenenc = 0x00200000
+	clientDeprecateEOF     = 0x01000000
+	clientQueryAttributes  = 0x08000000
+
+	serverStatusInTrans      = 0x0001
+	serverStatusCursorExists = 0x0040
+	serverMoreResultsExists  = 0x0008
+
+	comQuit             = 0x01
+	comInitDB           = 0x02
+	comQuery            = 0x03
+	comFieldList        = 0x04
+	comStatistics       = 0x09
+	comChangeUser       = 0x11
+	comStmtPrepare      = 0x16
+	comStmtExecute      = 0x17
+	comStmtSendLongData = 0x18
+	comStmtClose        = 0x19
+	comStmtFetch        = 0x1c
+	comResetConnection  = 0x1f
+
+	// ER_CONNECTION_KILLED, answered to the sessions which could not be moved
+	mysqlErrConnectionKilled = 1927
+)
+
+var ErrMySQLPacket = errors.New("malformed mysql packet")
+
+// mysqlPacket is a packet of the wire, a payload of the max size is continued by
+// the next packet
+type mysqlPacket struct {
+	seq     byte
+	payload []byte
+}
+
+func readMySQLPacket(r io.Reader) (*mysqlPacket, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	p := &mysqlPacket{
+		seq:     header[3],
+		payload: make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, p.payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func writeMySQLPacket(w io.Writer, seq byte, payload []byte) error {
+	buf := make([]byte, 4, 4+len(payload))
+	buf[0], buf[1], buf[2], buf[3] = byte(len(payload)), byte(len(payload)>>8), byte(len(payload)>>16), seq
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// first returns the first byte of the payload, or 0 for an empty one
+func (p *mysqlPacket) first() byte {
+	if len(p.payload) == 0 {
+		return 0
+	}
+	return p.payload[0]
+}
+
+// continued returns whether the next packet continues the payload
+func (p *mysqlPacket) continued() bool {
+	return len(p.payload) == mysqlMaxPayload
+}
+
+// isEOF returns whether it is an EOF packet, or the OK packet ending the rows
+// with CLIENT_DEPRECATE_EOF
+func (p *mysqlPacket) isEOF(deprecateEOF bool) bool {
+	if p.first() != mysqlEOF {
+		return false
+	}
+	if deprecateEOF {
+		return len(p.payload) < mysqlMaxPayload
+	}
+	return len(p.payload) < 9
+}
+
+// status returns the server status of an OK or EOF packet
+func (p *mysqlPacket) status() (uint16, bool) {
+	b := p.payload
+	if len(b) == 0 {
+		return 0, false
+	}
+	if b[0] == mysqlEOF && len(b) < 9 {
+		if len(b) < 5 {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint16(b[3:]), true
+	}
+	// OK, or the OK ending the rows: affected rows and last insert id before it
+	pos := 1
+	for i := 0; i < 2; i++ {
+		_, n := readLenenc(b[pos:])
+		if n == 0 {
+			return 0, false
+		}
+		pos += n
+	}
+	if len(b) < pos+2 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(b[pos:]), true
+}
+
+// readLenenc reads a length encoded integer, n is 0 if malformed
+func readLenenc(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xfc:
+		if len(b) < 3 {
+			return 0, 0
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:])), 3
+	case 0xfd:
+		if len(b) < 4 {
+			return 0, 0
+		}
+		return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4
+	case 0xfe:
+		if len(b) < 9 {
+			return 0, 0
+		}
+		return binary.LittleEndian.Uint64(b[1:]), 9
+	case 0xfb, 0xff:
+		return 0, 0
+	}
+	return uint64(b[0]), 1
+}
+
+func appendLenenc(b []byte, n uint64) []byte {
+	switch {
+	case n < 0xfb:
+		return append(b, byte(n))
+	case n < 1<<16:
+		return append(b, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		return append(b, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	}
+	b = append(b, 0xfe)
+	return binary.LittleEndian.AppendUint64(b, n)
+}
+
+// readNul reads a string ended by NUL
+func readNul(b []byte) (string, []byte, error) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, ErrMySQLPacket
+	}
+	return string(b[:i]), b[i+1:], nil
+}
+
+// mysqlErrPacket builds an ERR packet
+func mysqlErrPacket(code uint16, state, message string) []byte {
+	b := []byte{mysqlErr, byte(code), byte(code >> 8), '#'}
+	b = append(b, state...)
+	return append(b, message...)
+}
+
+// mysqlHandshake is the initial handshake v10 of the server
+type mysqlHandshake struct {
+	capabilities uint32
+	scramble     []byte
+	plugin       string
+
+	// the raw payload and the offsets of the capabilities in it
+	payload         []byte
+	lowerCapability int
+	upperCapability int
+}
+
+func parseMySQLHandshake(payload []byte) (*mysqlHandshake, error) {
+	if len(payload) == 0 {
+		return nil, ErrMySQLPacket
+	}
+	if payload[0] == mysqlErr {
+		return nil, fmt.Errorf("backend refused: %s", mysqlErrMessage(payload))
+	}
+	if payload[0] != 10 {
+		return nil, fmt.Errorf("%w: handshake version %d", ErrMySQLPacket, payload[0])
+	}
+	h := &mysqlHandshake{payload: payload}
+	_, b, err := readNul(payload[1:])
+	if err != nil {
+		return nil, err
+	}
+	// connection id, scramble part 1, filler, lower capabilities
+	if len(b) < 4+8+1+2 {
+		return nil, ErrMySQLPacket
+	}
+	h.scramble = append(h.scramble, b[4:12]...)
+	h.lowerCapability = len(payload) - len(b) + 13
+	h.capabilities = uint32(binary.LittleEndian.Uint16(b[13:]))
+	b = b[15:]
+	// charset, status, upper capabilities, scramble length, reserved
+	if len(b) < 1+2+2+1+10 {
+		return h, nil
+	}
+	h.upperCapability = len(payload) - len(b) + 3
+	h.capabilities |= uint32(binary.LittleEndian.Uint16(b[3:])) << 16
+	scrambleLen := int(b[5])
+	b = b[16:]
+	if h.capabilities&clientSecureConnection != 0 {
+		n := scrambleLen - 8
+		if n < 13 {
+			n = 13
+		}
+		if len(b) < n {
+			return nil, ErrMySQLPacket
+		}
+		// the last byte of part 2 is NUL
+		h.scramble = append(h.scramble, b[:n-1]...)
+		b = b[n:]
+	}
+	if h.capabilities&clientPluginAuth != 0 {
+		h.plugin, _, _ = readNul(append(b, 0))
+	}
+	return h, nil
+}
+
+// withoutCapabilities returns the payload not offering the capabilities to the
+// client
+func (h *mysqlHandshake) withoutCapabilities(caps uint32) []byte {
+	payload := append([]byte{}, h.payload...)
+	lower := binary.LittleEndian.Uint16(payload[h.lowerCapability:]) &^ uint16(caps)
+	binary.LittleEndian.PutUint16(payload[h.lowerCapability:], lower)
+	if h.upperCapability > 0 {
+		upper := binary.LittleEndian.Uint16(payload[h.upperCapability:]) &^ uint16(caps>>16)
+		binary.LittleEndian.PutUint16(payload[h.upperCapability:], upper)
+	}
+	return payload
+}
+
+// mysqlHandshakeResponse is the HandshakeResponse41 of the client, kept to
+// authenticate again to a new master
+type mysqlHandshakeResponse struct {
+	capabilities  uint32
+	maxPacketSize uint32
+	charset       byte
+	user          string
+	database      string
+	plugin        string
+	attrs         []byte
+}
+
+func parseMySQLHandshakeResponse(payload []byte) (*mysqlHandshakeResponse, error) {
+	if len(payload) < 32 {
+		return nil, fmt.Errorf("%w: short handshake response", ErrMySQLPacket)
+	}
+	r := &mysqlHandshakeResponse{
+		capabilities:  binary.LittleEndian.Uint32(payload),
+		maxPacketSize: binary.LittleEndian.Uint32(payload[4:]),
+		charset:       payload[8],
+	}
+	if r.capabilities&clientProtocol41 == 0 {
+		return nil, fmt.Errorf("%w: protocol older than 4.1", ErrMySQLPacket)
+	}
+	user, b, err := readNul(payload[32:])
+	if err != nil {
+		return nil, err
+	}
+	r.user = user
+	// the auth response is not kept, it is for the scramble of the first backend
+	switch {
+	case r.capabilities&clientPluginAuthLenenc != 0:
+		n, size := readLenenc(b)
+		if size == 0 || len(b) < size+int(n) {
+			return nil, ErrMySQLPacket
+		}
+		b = b[size+int(n):]
+	case r.capabilities&clientSecureConnection != 0:
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return nil, ErrMySQLPacket
+		}
+		b = b[1+int(b[0]):]
+	default:
+		if _, b, err = readNul(b); err != nil {
+			return nil, err
+		}
+	}
+	if r.capabilities&clientConnectWithDB != 0 {
+		if r.database, b, err = readNul(b); err != nil {
+			return nil, err
+		}
+	}
+	if r.capabilities&clientPluginAuth != 0 && len(b) > 0 {
+		if r.plugin, b, err = readNul(b); err != nil {
+			return nil, err
+		}
+	}
+	if r.capabilities&clientConnectAttrs != 0 {
+		r.attrs = append(r.attrs, b...)
+	}
+	return r, nil
+}
+
+// build encodes the response with the auth response for the plugin and the
+// schema to use
+func (r *mysqlHandshakeResponse) build(plugin string, auth []byte, database string) []byte {
+	caps := r.capabilities | clientSecureConnection | clientPluginAuth | clientPluginAuthLenenc
+	caps &^= clientConnectWithDB | clientSSL | clientCompress
+	if len(database) > 0 {
+		caps |= clientConnectWithDB
+	}
+	b := binary.LittleEndian.AppendUint32(nil, caps)
+	b = binary.LittleEndian.AppendUint32(b, r.maxPacketSize)
+	b = append(b, r.charset)
+	b = append(b, make([]byte, 23)...)
+	b = append(b, r.user...)
+	b = append(b, 0)
+	b = appendLenenc(b, uint64(len(auth)))
+	b = append(b, auth...)
+	if len(database) > 0 {
+		b = append(b, database...)
+		b = append(b, 0)
+	}
+	b = append(b, plugin...)
+	b = append(b, 0)
+	if caps&clientConnectAttrs != 0 {
+		b = append(b, r.attrs...)
+	}
+	return b
+}
+
+// mysqlErrMessage returns the code and message of an ERR packet
+func mysqlErrMessage(payload []byte) string {
+	if len(payload) < 3 {
+		return "unknown error"
+	}
+	code := binary.LittleEndian.Uint16(payload[1:])
+	msg := payload[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		msg = msg[6:]
+	}
+	return fmt.Sprintf("%d %s", code, msg)
+}
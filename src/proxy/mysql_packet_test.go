@@ -0,0 +1,395 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// the packets of the responses, status is the server status
+func okPacket(status uint16) []byte {
+	return []byte{mysqlOK, 0, 0, byte(status), byte(status >> 8), 0, 0}
+}
+
+func eofPacket(status uint16) []byte {
+	return []byte{mysqlEOF, 0, 0, byte(status), byte(status >> 8)}
+}
+
+// rowsEndPacket is the OK ending the rows with CLIENT_DEPRECATE_EOF
+func rowsEndPacket(status uint16) []byte {
+	return []byte{mysqlEOF, 0, 0, byte(status), byte(status >> 8), 0, 0}
+}
+
+var (
+	errPacket    = mysqlErrPacket(1064, "42000", "syntax error")
+	columnPacket = []byte("\x03def\x00\x00\x00\x01a\x00\x0c\x3f\x00\x0b\x00\x00\x00\x03\x00\x00\x00\x00\x00")
+	rowPacket    = []byte("\x011")
+)
+
+func TestReadLenenc(t *testing.T) {
+	tests := []struct {
+		input []byte
+		n     uint64
+		size  int
+	}{
+		{[]byte{0}, 0, 1},
+		{[]byte{0xfa}, 0xfa, 1},
+		{[]byte{0xfc, 0x34, 0x12}, 0x1234, 3},
+		{[]byte{0xfd, 0x56, 0x34, 0x12}, 0x123456, 4},
+		{[]byte{0xfe, 8, 7, 6, 5, 4, 3, 2, 1}, 0x0102030405060708, 9},
+		{[]byte{0xfc, 0x34}, 0, 0},
+		{[]byte{0xfd, 0x56, 0x34}, 0, 0},
+		{[]byte{0xfe, 8, 7, 6}, 0, 0},
+		{[]byte{0xfb}, 0, 0},
+		{[]byte{0xff}, 0, 0},
+		{nil, 0, 0},
+	}
+	for _, tt := range tests {
+		n, size := readLenenc(tt.input)
+		if n != tt.n || size != tt.size {
+			t.Errorf("readLenenc(%x) = %d, %d, want %d, %d", tt.input, n, size, tt.n, tt.size)
+		}
+		if tt.size == 0 {
+			continue
+		}
+		if b := appendLenenc(nil, tt.n); !bytes.Equal(b, tt.input) {
+			t.Errorf("appendLenenc(%d) = %x, want %x", tt.n, b, tt.input)
+		}
+	}
+}
+
+func TestReadMySQLPacket(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMySQLPacket(&buf, 3, []byte("\x03SELECT 1")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes()[:4], []byte{9, 0, 0, 3}) {
+		t.Errorf("header = %x, want 09000003", buf.Bytes()[:4])
+	}
+	p, err := readMySQLPacket(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.seq != 3 || string(p.payload) != "\x03SELECT 1" || p.first() != comQuery {
+		t.Errorf("packet = %d %q", p.seq, p.payload)
+	}
+	if _, err := readMySQLPacket(bytes.NewReader([]byte{9, 0, 0, 3, 1, 2})); err == nil {
+		t.Error("read a cut packet without error")
+	}
+	if (&mysqlPacket{}).first() != 0 {
+		t.Error("first of an empty payload should be 0")
+	}
+}
+
+func TestMySQLPacketStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		status  uint16
+		ok      bool
+		// isEOF with and without CLIENT_DEPRECATE_EOF
+		eof, eofDeprecated bool
+	}{
+		{"ok", okPacket(serverStatusInTrans), serverStatusInTrans, true, false, false},
+		{"ok with lenenc", []byte{mysqlOK, 0xfc, 1, 0, 0xfc, 2, 0, 0x08, 0, 0, 0}, serverMoreResultsExists, true, false, false},
+		{"eof", eofPacket(serverStatusInTrans), serverStatusInTrans, true, true, true},
+		{"rows end", rowsEndPacket(serverMoreResultsExists), serverMoreResultsExists, true, true, true},
+		{"short eof", []byte{mysqlEOF, 0, 0}, 0, false, true, true},
+		{"short ok", []byte{mysqlOK, 0, 0, 1}, 0, false, false, false},
+		{"empty", nil, 0, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &mysqlPacket{payload: tt.payload}
+			status, ok := p.status()
+			if ok != tt.ok || (ok && status != tt.status) {
+				t.Errorf("status = %#x %v, want %#x %v", status, ok, tt.status, tt.ok)
+			}
+			if got := p.isEOF(false); got != tt.eof {
+				t.Errorf("isEOF(false) = %v, want %v", got, tt.eof)
+			}
+			if got := p.isEOF(true); got != tt.eofDeprecated {
+				t.Errorf("isEOF(true) = %v, want %v", got, tt.eofDeprecated)
+			}
+		})
+	}
+
+	// a row may start by 0xfe as a lenenc of 8 bytes, it ends the rows only when
+	// shorter than an EOF or the max payload
+	row := &mysqlPacket{payload: append([]byte{0xfe}, make([]byte, 9)...)}
+	if row.isEOF(false) {
+		t.Error("row of 10 bytes taken as EOF")
+	}
+	if (&mysqlPacket{payload: errPacket}).isEOF(true) {
+		t.Error("ERR taken as EOF")
+	}
+}
+
+// handshake builds the initial handshake v10 of a server
+func handshake(caps uint32, scramble []byte, plugin string) []byte {
+	b := []byte{10}
+	b = append(b, "8.0.36\x00"...)
+	b = binary.LittleEndian.AppendUint32(b, 42)
+	b = append(b, scramble[:8]...)
+	b = append(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(caps))
+	b = append(b, 0xff, 2, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(caps>>16))
+	b = append(b, byte(len(scramble)+1))
+	b = append(b, make([]byte, 10)...)
+	b = append(b, scramble[8:]...)
+	b = append(b, 0)
+	b = append(b, plugin...)
+	return append(b, 0)
+}
+
+func TestParseMySQLHandshake(t *testing.T) {
+	scramble := []byte("0123456789abcdefghij")
+	caps := uint32(clientProtocol41 | clientSecureConnection | clientPluginAuth | clientDeprecateEOF | clientSSL)
+	h, err := parseMySQLHandshake(handshake(caps, scramble, mysqlCachingSHA2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.capabilities != caps || !bytes.Equal(h.scramble, scramble) || h.plugin != mysqlCachingSHA2 {
+		t.Errorf("handshake = %#x %q %s", h.capabilities, h.scramble, h.plugin)
+	}
+	stripped, err := parseMySQLHandshake(h.withoutCapabilities(clientSSL | clientDeprecateEOF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := caps &^ (clientSSL | clientDeprecateEOF); stripped.capabilities != want {
+		t.Errorf("capabilities = %#x, want %#x", stripped.capabilities, want)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"version", []byte{9, 0}},
+		{"no version end", []byte{10, '8'}},
+		{"short", []byte{10, '8', 0, 1, 2, 3}},
+		{"err", mysqlErrPacket(1040, "08004", "Too many connections")},
+		{"scramble cut", handshake(caps, scramble, mysqlCachingSHA2)[:40]},
+	}
+	for _, tt := range tests {
+		if _, err := parseMySQLHandshake(tt.payload); err == nil {
+			t.Errorf("%s: parsed without error", tt.name)
+		}
+	}
+}
+
+func TestMySQLHandshakeResponse(t *testing.T) {
+	login := &mysqlHandshakeResponse{
+		capabilities:  clientProtocol41 | clientConnectAttrs | clientDeprecateEOF | clientSSL,
+		maxPacketSize: 1 << 24,
+		charset:       45,
+		user:          "app",
+		attrs:         []byte("\x0b\x04_pid\x0512345"),
+	}
+	payload := login.build(mysqlNativePassword, bytes.Repeat([]byte{7}, 20), "shop")
+	r, err := parseMySQLHandshakeResponse(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.user != "app" || r.database != "shop" || r.plugin != mysqlNativePassword || r.charset != 45 || r.maxPacketSize != 1<<24 {
+		t.Errorf("response = %+v", r)
+	}
+	if r.capabilities&clientSSL != 0 || r.capabilities&clientConnectWithDB == 0 {
+		t.Errorf("capabilities = %#x, want no SSL and with the schema", r.capabilities)
+	}
+	if !bytes.Equal(r.attrs, login.attrs) {
+		t.Errorf("attrs = %q, want %q", r.attrs, login.attrs)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"short", make([]byte, 31)},
+		{"protocol 320", append(make([]byte, 32), "app\x00\x00"...)},
+		{"no user end", append(binary.LittleEndian.AppendUint32(nil, clientProtocol41), append(make([]byte, 28), "app"...)...)},
+		{"auth cut", append(binary.LittleEndian.AppendUint32(nil, clientProtocol41|clientPluginAuthLenenc), append(make([]byte, 28), "app\x00\x14ab"...)...)},
+	}
+	for _, tt := range tests {
+		if _, err := parseMySQLHandshakeResponse(tt.payload); !errors.Is(err, ErrMySQLPacket) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, ErrMySQLPacket)
+		}
+	}
+}
+
+func TestMySQLResponseNext(t *testing.T) {
+	prepareOK := func(columns, params uint16) []byte {
+		b := []byte{mysqlOK, 1, 0, 0, 0}
+		b = binary.LittleEndian.AppendUint16(b, columns)
+		b = binary.LittleEndian.AppendUint16(b, params)
+		return append(b, 0, 0, 0)
+	}
+	tests := []struct {
+		name         string
+		kind         int
+		deprecateEOF bool
+		packets      [][]byte
+		status       uint16
+		failed       bool
+		err          bool
+	}{
+		{
+			name:    "ok",
+			kind:    responseResultSet,
+			packets: [][]byte{okPacket(serverStatusInTrans)},
+			status:  serverStatusInTrans,
+		},
+		{
+			name:    "err",
+			kind:    responseResultSet,
+			packets: [][]byte{errPacket},
+			failed:  true,
+		},
+		{
+			name:    "result set",
+			kind:    responseResultSet,
+			packets: [][]byte{{2}, columnPacket, columnPacket, eofPacket(0), rowPacket, rowPacket, eofPacket(serverStatusInTrans)},
+			status:  serverStatusInTrans,
+		},
+		{
+			name:         "result set without eof",
+			kind:         responseResultSet,
+			deprecateEOF: true,
+			packets:      [][]byte{{1}, columnPacket, rowPacket, rowsEndPacket(serverStatusInTrans)},
+			status:       serverStatusInTrans,
+		},
+		{
+			name:    "error in the rows",
+			kind:    responseResultSet,
+			packets: [][]byte{{1}, columnPacket, eofPacket(0), rowPacket, errPacket},
+			failed:  true,
+		},
+		{
+			name: "multiple results",
+			kind: responseResultSet,
+			packets: [][]byte{
+				{1}, columnPacket, eofPacket(0), rowPacket, eofPacket(serverMoreResultsExists),
+				okPacket(serverMoreResultsExists),
+				okPacket(serverStatusInTrans),
+			},
+			status: serverStatusInTrans,
+		},
+		{
+			name:    "error ends multiple results",
+			kind:    responseResultSet,
+			packets: [][]byte{okPacket(serverMoreResultsExists), errPacket},
+			status:  serverMoreResultsExists,
+			failed:  true,
+		},
+		{
+			name:    "local infile",
+			kind:    responseResultSet,
+			packets: [][]byte{append([]byte{mysqlLocalInfile}, "/tmp/data.csv"...), okPacket(0)},
+		},
+		{
+			name:    "local infile followed by rows",
+			kind:    responseResultSet,
+			packets: [][]byte{append([]byte{mysqlLocalInfile}, "/tmp/data.csv"...), {1}},
+			err:     true,
+		},
+		{
+			name:    "column count",
+			kind:    responseResultSet,
+			packets: [][]byte{{0xfc, 1}},
+			err:     true,
+		},
+		{
+			name:    "no eof after the columns",
+			kind:    responseResultSet,
+			packets: [][]byte{{1}, columnPacket, rowPacket},
+			err:     true,
+		},
+		{
+			name:    "cursor",
+			kind:    responseResultSet,
+			packets: [][]byte{{1}, columnPacket, eofPacket(serverStatusCursorExists)},
+			status:  serverStatusCursorExists,
+		},
+		{
+			name:    "fetched rows",
+			kind:    responseRows,
+			packets: [][]byte{rowPacket, rowPacket, eofPacket(serverStatusCursorExists)},
+			status:  serverStatusCursorExists,
+		},
+		{
+			name:    "field list",
+			kind:    responseFieldList,
+			packets: [][]byte{columnPacket, columnPacket, eofPacket(0)},
+		},
+		{
+			name:    "prepare",
+			kind:    responsePrepare,
+			packets: [][]byte{prepareOK(2, 1), columnPacket, eofPacket(0), columnPacket, columnPacket, eofPacket(0)},
+		},
+		{
+			name:         "prepare without eof",
+			kind:         responsePrepare,
+			deprecateEOF: true,
+			packets:      [][]byte{prepareOK(1, 2), columnPacket, columnPacket, columnPacket},
+		},
+		{
+			name:    "prepare without definitions",
+			kind:    responsePrepare,
+			packets: [][]byte{prepareOK(0, 0)},
+		},
+		{
+			name:    "prepare columns only",
+			kind:    responsePrepare,
+			packets: [][]byte{prepareOK(1, 0), columnPacket, eofPacket(0)},
+		},
+		{
+			name:    "prepare failed",
+			kind:    responsePrepare,
+			packets: [][]byte{errPacket},
+			failed:  true,
+		},
+		{
+			name:    "prepare ok cut",
+			kind:    responsePrepare,
+			packets: [][]byte{{mysqlOK, 1, 0, 0, 0}},
+			err:     true,
+		},
+		{
+			name:    "single",
+			kind:    responseSingle,
+			packets: [][]byte{okPacket(serverStatusInTrans)},
+			status:  serverStatusInTrans,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mysqlResponse{kind: tt.kind}
+			for i, payload := range tt.packets {
+				done, err := r.next(&mysqlPacket{payload: payload}, tt.deprecateEOF)
+				if err != nil {
+					if !tt.err || i != len(tt.packets)-1 {
+						t.Fatalf("packet %d: error %v", i, err)
+					}
+					if !errors.Is(err, ErrMySQLPacket) {
+						t.Fatalf("packet %d: error = %v, want %v", i, err, ErrMySQLPacket)
+					}
+					return
+				}
+				if last := i == len(tt.packets)-1; done != last {
+					t.Fatalf("packet %d: done = %v, want %v", i, done, last)
+				}
+			}
+			if tt.err {
+				t.Fatal("ended without error")
+			}
+			if r.failed != tt.failed {
+				t.Errorf("failed = %v, want %v", r.failed, tt.failed)
+			}
+			if r.status != tt.status {
+				t.Errorf("status = %#x, want %#x", r.status, tt.status)
+			}
+		})
+	}
+}
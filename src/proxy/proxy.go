@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+	jsync "github.com/mmpei/janus/src/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNoMaster = errors.New("no backend master elected")
+
+// Server proxies the clients on proxy_port to the backend master, or the ones on
+// replica_proxy_port to the replicas. Both janus nodes proxy, the sentinel slave
+// to the master learned by syncing.
+type Server struct {
+	addr     string
+	config   config.ProxyServerConfig
+	sentinel *jsync.Sentinel
+	monitor  *jsync.MonitorManager
+
+	// certs terminate the TLS of clients, nil if not terminating
+	certs *certStore
+	// backendTLS re-encrypts to the backend, nil for plain backends
+	backendTLS *tls.Config
+	dialer     net.Dialer
+
+	reverseProxy *httputil.ReverseProxy
+	// next is the counter of picking replicas round robin
+	next uint64
+	// balancer of the replica proxy, nil for the proxy to the master
+	balancer *balancer
+}
+
+// NewServer creates the proxy, scheme is the one of the backend proxied address
+func NewServer(addr string, cfg *config.ProxyServerConfig, scheme string, s *jsync.Sentinel, mm *jsync.MonitorManager) (*Server, error) {
+	server := &Server{
+		addr:     addr,
+		config:   *cfg,
+		sentinel: s,
+		monitor:  mm,
+		dialer: net.Dialer{
+			Timeout:   time.Duration(cfg.DialTimeout),
+			KeepAlive: 30 * time.Second,
+		},
+	}
+	if cfg.TLS.Mode == config.TLSModeTerminate {
+		certs, err := newCertStore(cfg.TLS.Certificates)
+		if err != nil {
+			return nil, err
+		}
+		server.certs = certs
+	}
+	if scheme == "https" || scheme == "tls" {
+		backendTLS, err := backendTLSConfig(&cfg.BackendTLS)
+		if err != nil {
+			return nil, err
+		}
+		server.backendTLS = backendTLS
+	}
+	if cfg.Mode == config.ProxyModeHTTP {
+		server.reverseProxy = server.newReverseProxy()
+	}
+	return server, nil
+}
+
+// ListenAndServe serves until the listener fails
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	// the PROXY header comes before the TLS handshake
+	if s.config.ProxyProtocol.Accept {
+		l = newProxyProtoListener(l, &s.config.ProxyProtocol)
+	}
+	if s.certs != nil {
+		l = tls.NewListener(l, &tls.Config{
+			GetCertificate: s.certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		})
+		go s.certs.watch(ctx, time.Duration(s.config.TLS.ReloadInterval))
+	}
+	if s.balancer != nil {
+		log.Infof("replica proxy listen on %s, %s, tls %s", s.addr, s.config.Replicas.Strategy, s.config.TLS.Mode)
+		go s.watchReplicas(ctx, event.Default)
+		return s.serveTCP(l, s.handleReplicaConn)
+	}
+	log.Infof("%s proxy listen on %s, tls %s", s.config.Mode, s.addr, s.config.TLS.Mode)
+
+	if s.config.Mode == config.ProxyModeHTTP {
+		server := &http.Server{
+			Handler:           s,
+			ReadHeaderTimeout: time.Duration(s.config.ReadHeaderTimeout),
+			IdleTimeout:       time.Duration(s.config.IdleTimeout),
+		}
+		return server.Serve(l)
+	}
+	switch s.config.Mode {
+	case config.ProxyModeMySQL:
+		return s.serveTCP(l, s.handleMySQLConn)
+	case config.ProxyModeRedis:
+		return s.serveTCP(l, s.handleRedisConn)
+	}
+	return s.serveTCP(l, s.handleConn)
+}
+
+// master returns the proxied address of the backend master, and a channel closed
+// when the master changes
+func (s *Server) master() (*url.URL, <-chan struct{}, error) {
+	return masterAddress(s.sentinel, s.monitor)
+}
+
+// masterAddress returns the proxied address of the master watched, the peer is
+// looked up by the id watched so that both are of the same master
+func masterAddress(sentinel *jsync.Sentinel, monitor *jsync.MonitorManager) (*url.URL, <-chan struct{}, error) {
+	id, _, changed := sentinel.WatchMaster()
+	if len(id) == 0 {
+		return nil, changed, ErrNoMaster
+	}
+	u, err := proxiedAddress(monitor, id)
+	return u, changed, err
+}
+
+// proxiedAddress returns the proxied address of the backend master id
+func proxiedAddress(monitor *jsync.MonitorManager, id string) (*url.URL, error) {
+	peer := monitor.Get(id)
+	if peer == nil || len(peer.ProxiedAddress) == 0 {
+		return nil, fmt.Errorf("no proxied address of backend master %s", id)
+	}
+	u, err := url.Parse(peer.ProxiedAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxied address %s: %v", peer.ProxiedAddress, err)
+	}
+	return u, nil
+}
+
+// dialContext connects the backend and observes the latency
+func (s *Server) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := s.dialer.DialContext(ctx, network, addr)
+	if err == nil {
+		dialLatency.Observe(time.Since(start).Seconds())
+	}
+	return conn, err
+}
+
+// dial connects the backend of the proxied address, it writes the PROXY header
+// if any and then does TLS for the tls and https schemes
+func (s *Server) dial(ctx context.Context, u *url.URL, header []byte) (net.Conn, error) {
+	conn, err := s.dialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > 0 {
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("write PROXY header to %s: %v", u.Host, err)
+		}
+	}
+	if u.Scheme != "tls" && u.Scheme != "https" {
+		return conn, nil
+	}
+	c := s.backendTLS.Clone()
+	if len(c.ServerName) == 0 {
+		c.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, c)
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.config.DialTimeout))
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake with %s: %v", u.Host, err)
+	}
+	return tlsConn, nil
+}
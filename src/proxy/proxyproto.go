@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// headerTimeout of reading the PROXY header after accepting
+const headerTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix  = []byte("PROXY ")
+	proxyV2Sig     = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	ErrProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	// the longest v1 header, with the CRLF
+	proxyV1MaxLength = 107
+	proxyV2Version   = 0x20
+	proxyV2Local     = 0x00
+	proxyV2Proxy     = 0x01
+	proxyV2TCP4      = 0x11
+	proxyV2TCP6      = 0x21
+)
+
+// proxyProtoListener requires the PROXY header of the accepted connections
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func newProxyProtoListener(l net.Listener, cfg *config.ProxyProtocolConfig) net.Listener {
+	pl := &proxyProtoListener{Listener: l}
+	for _, network := range cfg.TrustedNetworks {
+		// validated with the config
+		_, ipNet, _ := net.ParseCIDR(network)
+		pl.trusted = append(pl.trusted, ipNet)
+	}
+	return pl
+}
+
+// Accept closes the connections out of the trusted networks, the header is read
+// by the first use of the connection so that a slow client blocks only itself
+func (pl *proxyProtoListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if pl.isTrusted(conn.RemoteAddr()) {
+			return &proxyProtoConn{Conn: conn}, nil
+		}
+		log.Warningf("proxy protocol from untrusted %s", conn.RemoteAddr())
+		proxyProtocolTotal.Inc("untrusted")
+		conn.Close()
+	}
+}
+
+func (pl *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	if len(pl.trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range pl.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtoConn takes the addresses of the PROXY header as its own
+type proxyProtoConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	source net.Addr
+	dest   net.Addr
+	err    error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.source, c.dest, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Warningf("proxy protocol from %s: %v", c.Conn.RemoteAddr(), c.err)
+			proxyProtocolTotal.Inc("invalid")
+			c.Conn.Close()
+			return
+		}
+		proxyProtocolTotal.Inc("accepted")
+	})
+}
+
+func (c *proxyProtoConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.init()
+	if c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads the header of v1 or v2, the addresses are nil for the
+// UNKNOWN and LOCAL ones, such as the health checks of load balancers
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+	prefix, err = r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(prefix, proxyV2Sig) {
+		return readProxyV2(r)
+	}
+	return nil, nil, ErrProxyHeader
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("%w: v1 line not ended", ErrProxyHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	source, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dest, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, dest, nil
+}
+
+func parseV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: address %s %s", ErrProxyHeader, host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0xf0 != proxyV2Version {
+		return nil, nil, fmt.Errorf("%w: v2 version %#x", ErrProxyHeader, header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	switch header[12] & 0x0f {
+	case proxyV2Local:
+		return nil, nil, nil
+	case proxyV2Proxy:
+	default:
+		return nil, nil, fmt.Errorf("%w: v2 command %#x", ErrProxyHeader, header[12]&0x0f)
+	}
+
+	var size int
+	switch header[13] {
+	case proxyV2TCP4:
+		size = net.IPv4len
+	case proxyV2TCP6:
+		size = net.IPv6len
+	default:
+		// not tcp, keep the addresses of the connection
+		return nil, nil, nil
+	}
+	if len(body) < 2*size+4 {
+		return nil, nil, fmt.Errorf("%w: v2 addresses too short", ErrProxyHeader)
+	}
+	// the TLVs after the addresses are skipped
+	source := &net.TCPAddr{
+		IP:   net.IP(body[:size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size:])),
+	}
+	dest := &net.TCPAddr{
+		IP:   net.IP(body[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(body[2*size+2:])),
+	}
+	return source, dest, nil
+}
+
+// proxyHeader encodes the header of the version telling the backend the source
+// and destination of the client
+func proxyHeader(version string, source, dest net.Addr) []byte {
+	src, srcOK := source.(*net.TCPAddr)
+	dst, dstOK := dest.(*net.TCPAddr)
+	known := srcOK && dstOK
+	family := proxyV2TCP6
+	if known && src.IP.To4() != nil && dst.IP.To4() != nil {
+		family = proxyV2TCP4
+	}
+
+	if version == config.ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP6"
+		if family == proxyV2TCP4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto,
+			ipOf(src.IP, family), ipOf(dst.IP, family), src.Port, dst.Port))
+	}
+
+	buf := bytes.NewBuffer(append([]byte{}, proxyV2Sig...))
+	if !known {
+		buf.Write([]byte{proxyV2Version | proxyV2Local, 0, 0, 0})
+		return buf.Bytes()
+	}
+	srcBytes, dstBytes := []byte(src.IP.To16()), []byte(dst.IP.To16())
+	if family == proxyV2TCP4 {
+		srcBytes, dstBytes = src.IP.To4(), dst.IP.To4()
+	}
+	buf.Write([]byte{proxyV2Version | proxyV2Proxy, byte(family)})
+	binary.Write(buf, binary.BigEndian, uint16(2*len(srcBytes)+4))
+	buf.Write(srcBytes)
+	buf.Write(dstBytes)
+	binary.Write(buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
+
+// ipOf formats the ip of the family, ipv4 ones are mapped for TCP6
+func ipOf(ip net.IP, family int) string {
+	if family == proxyV2TCP4 {
+		return ip.To4().String()
+	}
+	if ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+	return ip.String()
+}
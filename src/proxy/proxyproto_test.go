@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/mmpei/janus/src/config"
+)
+
+func tcpAddr(s string) *net.TCPAddr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(command, family byte, body ...byte) []byte {
+		b := append([]byte{}, proxyV2Sig...)
+		b = append(b, command, family, 0, byte(len(body)))
+		return append(b, body...)
+	}
+	tests := []struct {
+		name   string
+		header []byte
+		source string
+		dest   string
+		// err is matched by errors.Is, io.ErrUnexpectedEOF for the short ones
+		err error
+	}{
+		{
+			name:   "v1 tcp4",
+			header: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 5000\r\n"),
+			source: "192.168.0.1:56324",
+			dest:   "10.0.0.1:5000",
+		},
+		{
+			name:   "v1 tcp6",
+			header: []byte("PROXY TCP6 2001:db8::1 ::1 56324 5000\r\n"),
+			source: "[2001:db8::1]:56324",
+			dest:   "[::1]:5000",
+		},
+		{
+			name:   "v1 unknown",
+			header: []byte("PROXY UNKNOWN ff:ff::1 ::1 1 2\r\n"),
+		},
+		{
+			name:   "v1 not ended",
+			header: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), proxyV1MaxLength)...),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v1 bad address",
+			header: []byte("PROXY TCP4 192.168.0 10.0.0.1 56324 5000\r\n"),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v1 bad port",
+			header: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 65536 5000\r\n"),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v1 fields",
+			header: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n"),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v1 protocol",
+			header: []byte("PROXY UDP4 192.168.0.1 10.0.0.1 56324 5000\r\n"),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v2 tcp4",
+			header: v2(proxyV2Version|proxyV2Proxy, proxyV2TCP4, 192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x13, 0x88),
+			source: "192.168.0.1:56324",
+			dest:   "10.0.0.1:5000",
+		},
+		{
+			name: "v2 tcp4 with tlvs",
+			header: v2(proxyV2Version|proxyV2Proxy, proxyV2TCP4, 192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x13, 0x88,
+				0x04, 0, 1, 0),
+			source: "192.168.0.1:56324",
+			dest:   "10.0.0.1:5000",
+		},
+		{
+			name:   "v2 local",
+			header: v2(proxyV2Version|proxyV2Local, 0),
+		},
+		{
+			name:   "v2 udp",
+			header: v2(proxyV2Version|proxyV2Proxy, 0x12, 192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x13, 0x88),
+		},
+		{
+			name:   "v2 version",
+			header: v2(0x10|proxyV2Proxy, proxyV2TCP4),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v2 command",
+			header: v2(proxyV2Version|0x02, proxyV2TCP4),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v2 addresses too short",
+			header: v2(proxyV2Version|proxyV2Proxy, proxyV2TCP6, 192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x13, 0x88),
+			err:    ErrProxyHeader,
+		},
+		{
+			name:   "v2 body cut",
+			header: v2(proxyV2Version|proxyV2Proxy, proxyV2TCP4, 192, 168, 0, 1, 10, 0, 0, 1, 0xdc, 0x04, 0x13, 0x88)[:20],
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name:   "no header",
+			header: []byte("GET / HTTP/1.1\r\nHost: janus\r\n\r\n"),
+			err:    ErrProxyHeader,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the data after the header is left to the connection
+			r := bufio.NewReader(bytes.NewReader(append(append([]byte{}, tt.header...), "data"...)))
+			source, dest, err := readProxyHeader(r)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if got := addrString(source); got != tt.source {
+				t.Errorf("source = %s, want %s", got, tt.source)
+			}
+			if got := addrString(dest); got != tt.dest {
+				t.Errorf("dest = %s, want %s", got, tt.dest)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "data" {
+				t.Errorf("left %q after the header, want \"data\"", rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		source net.Addr
+		dest   net.Addr
+		// want the addresses read back, empty for unknown
+		wantSource string
+		wantDest   string
+	}{
+		{"ipv4", tcpAddr("192.168.0.1:56324"), tcpAddr("10.0.0.1:5000"), "192.168.0.1:56324", "10.0.0.1:5000"},
+		{"ipv6", tcpAddr("[2001:db8::1]:56324"), tcpAddr("[::1]:5000"), "[2001:db8::1]:56324", "[::1]:5000"},
+		{"mixed", tcpAddr("192.168.0.1:56324"), tcpAddr("[::1]:5000"), "192.168.0.1:56324", "[::1]:5000"},
+		{"unknown", &net.UnixAddr{Name: "/tmp/janus.sock", Net: "unix"}, tcpAddr("10.0.0.1:5000"), "", ""},
+	}
+	for _, version := range []string{config.ProxyProtocolV1, config.ProxyProtocolV2} {
+		for _, tt := range tests {
+			t.Run(version+" "+tt.name, func(t *testing.T) {
+				header := proxyHeader(version, tt.source, tt.dest)
+				source, dest, err := readProxyHeader(bufio.NewReader(bytes.NewReader(header)))
+				if err != nil {
+					t.Fatalf("read %q: %v", header, err)
+				}
+				if got := addrString(source); got != tt.wantSource {
+					t.Errorf("source = %s, want %s", got, tt.wantSource)
+				}
+				if got := addrString(dest); got != tt.wantDest {
+					t.Errorf("dest = %s, want %s", got, tt.wantDest)
+				}
+			})
+		}
+	}
+}
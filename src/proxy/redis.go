@@ -0,0 +1,453 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	jsync "github.com/mmpei/janus/src/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRedisBatch of the pipelined commands forwarded at once
+	maxRedisBatch = 1024
+	// redisRetryInterval of sending the commands again while waiting for the master
+	redisRetryInterval = 500 * time.Millisecond
+)
+
+// the errors of the backend being not the master any more, or not ready yet
+var retryableRedisErrors = []string{"READONLY", "LOADING", "MASTERDOWN", "UNBLOCKED"}
+
+// the commands the RESP of which could not be followed, such as the pushes, the
+// sessions sending them are relayed as the tcp proxy does
+var relayedRedisCommands = map[string]bool{
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true, "MONITOR": true,
+	"SYNC": true, "PSYNC": true, "CLIENT REPLY": true, "CLIENT TRACKING": true,
+}
+
+// the commands changing the session, replayed on the new master
+var sessionRedisCommands = map[string]bool{
+	"AUTH": true, "HELLO": true, "SELECT": true, "CLIENT SETNAME": true,
+}
+
+// redisSession is a client session of the redis proxy, the commands are read
+// in batches of the pipelined ones and forwarded to the master
+type redisSession struct {
+	server *Server
+	client net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	backend       net.Conn
+	backendReader *bufio.Reader
+	// host of the master connected
+	host string
+	// changed is closed when the master changes
+	changed <-chan struct{}
+
+	// the session commands by name, replayed in order
+	setup    map[string]*redisCommand
+	order    []string
+	resp3    bool
+	multi    bool
+	watching bool
+}
+
+// handleRedisConn proxies the commands of a redis client to the backend master,
+// retrying the ones the old master refuses on the new master
+func (s *Server) handleRedisConn(conn net.Conn) {
+	defer conn.Close()
+	sess := &redisSession{
+		server: s,
+		client: conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		setup:  make(map[string]*redisCommand),
+	}
+	defer sess.leaveBackend()
+	if err := sess.connect(); err != nil {
+		log.Warningf("proxy %s: %v", conn.RemoteAddr(), err)
+		if err == ErrNoMaster {
+			connectionsTotal.Inc("no_master")
+		} else {
+			connectionsTotal.Inc("dial_error")
+		}
+		return
+	}
+	connectionsTotal.Inc("proxied")
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+
+	for {
+		cmds, err := sess.readBatch()
+		if err != nil {
+			log.Debugf("redis session %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if !sess.serve(cmds) {
+			return
+		}
+		if err := sess.writer.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// readBatch reads a command and the ones pipelined after it
+func (sess *redisSession) readBatch() ([]*redisCommand, error) {
+	cmd, err := readRedisCommand(sess.reader)
+	if err != nil {
+		return nil, err
+	}
+	cmds := []*redisCommand{cmd}
+	for len(cmds) < maxRedisBatch && sess.reader.Buffered() > 0 {
+		if cmd, err = readRedisCommand(sess.reader); err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+// serve forwards the batch, split by the commands answered locally or relaying
+// the session. It returns false to end the session.
+func (sess *redisSession) serve(cmds []*redisCommand) bool {
+	start := 0
+	for i, cmd := range cmds {
+		name := cmd.name()
+		local := name == "SENTINEL GET-MASTER-ADDR-BY-NAME" && sess.server.config.Redis.AnswerSentinel
+		if !local && !relayedRedisCommands[name] {
+			continue
+		}
+		if !sess.forward(cmds[start:i]) {
+			return false
+		}
+		start = i + 1
+		if local {
+			sess.writer.Write(masterAddrReply(sess.server.sentinel, sess.server.monitor, cmd, sess.server.config.Redis.MasterName, sess.resp3))
+			continue
+		}
+		return sess.relay(cmds[i:])
+	}
+	return sess.forward(cmds[start:])
+}
+
+// forward sends the commands to the master and the replies to the client, the
+// commands refused by a demoted or loading master are sent again once it changes.
+// The other commands of the batch ran already and are not sent again.
+func (sess *redisSession) forward(cmds []*redisCommand) bool {
+	if len(cmds) == 0 {
+		return true
+	}
+	if !sess.ready() {
+		return false
+	}
+	replies, err := sess.exchange(cmds)
+	if err != nil {
+		log.Infof("redis session %s lost the backend: %v", sess.client.RemoteAddr(), err)
+		redisFailoversTotal.Inc("lost")
+		sess.leaveBackend()
+	}
+	for i, reply := range replies {
+		if !sess.multi && retryableRedisError(reply) {
+			rest := cmds[i:len(replies)]
+			if !sess.retry(rest, replies[i:]) {
+				return false
+			}
+			for j, reply := range replies[i:] {
+				sess.writeReply(rest[j], reply)
+			}
+			break
+		}
+		sess.writeReply(cmds[i], reply)
+	}
+	// the commands may have run, answer an error instead of running them again
+	for range cmds[len(replies):] {
+		sess.writer.Write(respError("lost the backend master"))
+	}
+	return true
+}
+
+// retry sends the commands of the refused replies again until they are
+// answered or the failover times out, the replies are replaced in place
+func (sess *redisSession) retry(cmds []*redisCommand, replies [][]byte) bool {
+	log.Infof("redis session %s: %s, retry the refused commands", sess.client.RemoteAddr(), firstLine(replies[0]))
+	if err := sess.writer.Flush(); err != nil {
+		return false
+	}
+	timeout := time.NewTimer(time.Duration(sess.server.config.Redis.FailoverTimeout))
+	defer timeout.Stop()
+	ticker := time.NewTicker(redisRetryInterval)
+	defer ticker.Stop()
+	// the commands refused in a transaction abort it, they are not sent alone
+	end := len(cmds)
+	for i, cmd := range cmds {
+		if cmd.name() == "MULTI" {
+			end = i
+			break
+		}
+	}
+	for {
+		var refused []int
+		for i, reply := range replies[:end] {
+			if retryableRedisError(reply) {
+				refused = append(refused, i)
+			}
+		}
+		if len(refused) == 0 {
+			redisFailoversTotal.Inc("retried")
+			return true
+		}
+		select {
+		case <-sess.changed:
+		case <-ticker.C:
+		case <-timeout.C:
+			redisFailoversTotal.Inc("timeout")
+			return true
+		}
+		if err := sess.connect(); err != nil {
+			log.Debugf("redis session %s: %v", sess.client.RemoteAddr(), err)
+			continue
+		}
+		batch := make([]*redisCommand, len(refused))
+		for i, j := range refused {
+			batch[i] = cmds[j]
+		}
+		got, err := sess.exchange(batch)
+		for i, reply := range got {
+			replies[refused[i]] = reply
+		}
+		if err != nil {
+			// the commands may have run, as in forward
+			for _, j := range refused[len(got):] {
+				replies[j] = respError("lost the backend master")
+			}
+			sess.leaveBackend()
+		}
+	}
+}
+
+func (sess *redisSession) relay(cmds []*redisCommand) bool {
+	if !sess.ready() {
+		return false
+	}
+	if err := sess.writer.Flush(); err != nil {
+		return false
+	}
+	for _, cmd := range cmds {
+		if _, err := sess.backend.Write(cmd.raw); err != nil {
+			return false
+		}
+	}
+	log.Debugf("redis session %s relayed from %s", sess.client.RemoteAddr(), cmds[0].name())
+	done := make(chan struct{}, 2)
+	go pipe(sess.backend, sess.reader, "upstream", done)
+	go pipe(sess.client, sess.backendReader, "downstream", done)
+	select {
+	case <-done:
+	case <-sess.changed:
+		log.Infof("backend master changed, close the relayed redis session %s", sess.client.RemoteAddr())
+		redisFailoversTotal.Inc("closed")
+	}
+	return false
+}
+
+// ready moves the session to the new master if it changed, or waits for one if
+// the backend is lost. It returns false to close the sessions whose MULTI or WATCH
+// would be lost.
+func (sess *redisSession) ready() bool {
+	select {
+	case <-sess.changed:
+	default:
+		if sess.backend != nil {
+			return true
+		}
+	}
+	if u, _, err := sess.server.master(); (sess.multi || sess.watching) && (sess.backend == nil || err != nil || u.Host != sess.host) {
+		log.Infof("backend master changed, close the redis session %s in a transaction", sess.client.RemoteAddr())
+		redisFailoversTotal.Inc("closed")
+		sess.writer.Flush()
+		return false
+	}
+	timeout := time.NewTimer(time.Duration(sess.server.config.Redis.FailoverTimeout))
+	defer timeout.Stop()
+	for {
+		err := sess.connect()
+		if err == nil {
+			return true
+		}
+		log.Debugf("redis session %s: %v", sess.client.RemoteAddr(), err)
+		select {
+		case <-sess.changed:
+		case <-time.After(redisRetryInterval):
+		case <-timeout.C:
+			log.Warningf("redis session %s: no backend master in time: %v", sess.client.RemoteAddr(), err)
+			redisFailoversTotal.Inc("timeout")
+			return false
+		}
+	}
+}
+
+// connect connects the master unless connected to it, replaying the session
+// commands on a new connection
+func (sess *redisSession) connect() error {
+	u, changed, err := sess.server.master()
+	if err != nil {
+		sess.changed = changed
+		return err
+	}
+	if sess.backend != nil && sess.host == u.Host {
+		sess.changed = changed
+		return nil
+	}
+	conn, err := sess.server.dial(context.Background(), u, sess.server.header(sess.client))
+	if err != nil {
+		sess.changed = changed
+		return err
+	}
+	moving := len(sess.host) > 0
+	sess.leaveBackend()
+	sess.backend, sess.backendReader = conn, bufio.NewReader(conn)
+	sess.host, sess.changed = u.Host, changed
+	if err := sess.replay(); err != nil {
+		sess.leaveBackend()
+		return err
+	}
+	if moving {
+		log.Infof("redis session %s moved to %s", sess.client.RemoteAddr(), u.Host)
+		redisFailoversTotal.Inc("moved")
+	}
+	return nil
+}
+
+// replay sends the session commands to the new connection
+func (sess *redisSession) replay() error {
+	if len(sess.order) == 0 {
+		return nil
+	}
+	cmds := make([]*redisCommand, 0, len(sess.order))
+	for _, name := range sess.order {
+		cmds = append(cmds, sess.setup[name])
+	}
+	sess.backend.SetDeadline(time.Now().Add(time.Duration(sess.server.config.DialTimeout)))
+	defer sess.backend.SetDeadline(time.Time{})
+	replies, err := sess.exchange(cmds)
+	if err != nil {
+		return err
+	}
+	for i, reply := range replies {
+		if len(reply) > 0 && reply[0] == '-' {
+			return fmt.Errorf("replay %s: %s", cmds[i].name(), firstLine(reply))
+		}
+	}
+	return nil
+}
+
+// exchange writes the commands and reads their replies, the replies read are
+// returned with the error
+func (sess *redisSession) exchange(cmds []*redisCommand) ([][]byte, error) {
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, cmd.raw...)
+	}
+	if _, err := sess.backend.Write(buf); err != nil {
+		return nil, err
+	}
+	replies := make([][]byte, 0, len(cmds))
+	for range cmds {
+		reply, err := readRESP(sess.backendReader)
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// writeReply answers the client and follows the state of the session
+func (sess *redisSession) writeReply(cmd *redisCommand, reply []byte) {
+	sess.writer.Write(reply)
+	name := cmd.name()
+	failed := len(reply) > 0 && reply[0] == '-'
+	switch {
+	case name == "EXEC" || name == "DISCARD" || name == "RESET":
+		sess.multi, sess.watching = false, false
+		if name == "RESET" {
+			sess.setup, sess.order, sess.resp3 = make(map[string]*redisCommand), nil, false
+		}
+	case failed:
+	case name == "MULTI":
+		sess.multi = true
+	case name == "WATCH":
+		sess.watching = true
+	case name == "UNWATCH":
+		sess.watching = false
+	case sessionRedisCommands[name] && !sess.multi:
+		if name == "HELLO" && len(cmd.args) > 1 {
+			sess.resp3 = string(cmd.args[1]) == "3"
+		}
+		if _, ok := sess.setup[name]; !ok {
+			sess.order = append(sess.order, name)
+		}
+		sess.setup[name] = cmd
+	}
+}
+
+func (sess *redisSession) leaveBackend() {
+	if sess.backend != nil {
+		sess.backend.Close()
+		sess.backend, sess.backendReader = nil, nil
+	}
+}
+
+// masterAddrReply answers SENTINEL get-master-addr-by-name with the host and port
+// of the backend master, or null for an unknown name or without a master
+func masterAddrReply(sentinel *jsync.Sentinel, monitor *jsync.MonitorManager, cmd *redisCommand, masterName string, resp3 bool) []byte {
+	if len(cmd.args) != 3 {
+		return respError("wrong number of arguments for SENTINEL get-master-addr-by-name")
+	}
+	var u *url.URL
+	if string(cmd.args[2]) == masterName {
+		u, _, _ = masterAddress(sentinel, monitor)
+	}
+	if u == nil {
+		if resp3 {
+			return []byte("_\r\n")
+		}
+		return []byte("*-1\r\n")
+	}
+	host, port := hostPort(u)
+	return appendRESPArray(nil, [][]byte{[]byte(host), []byte(port)})
+}
+
+// hostPort returns the host and port of the redis address, 6379 by default
+func hostPort(u *url.URL) (string, string) {
+	port := u.Port()
+	if len(port) == 0 {
+		port = "6379"
+	}
+	return u.Hostname(), port
+}
+
+func retryableRedisError(reply []byte) bool {
+	for _, kind := range retryableRedisErrors {
+		if isRESPError(reply, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstLine returns the first line of the reply for logging
+func firstLine(reply []byte) string {
+	for i, c := range reply {
+		if c == '\r' || c == '\n' {
+			return string(reply[:i])
+		}
+	}
+	return string(reply)
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+	jsync "github.com/mmpei/janus/src/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+// reconcileInterval of checking the replicas besides the events, such as for the
+// lag growing over the cap
+const reconcileInterval = time.Second
+
+// NewReplicaServer creates the proxy on replica_proxy_port, it load balances the
+// connections across the replicas as the tcp proxy in any mode
+func NewReplicaServer(addr string, cfg *config.ProxyServerConfig, scheme string, s *jsync.Sentinel, mm *jsync.MonitorManager) (*Server, error) {
+	server, err := NewServer(addr, cfg, scheme, s, mm)
+	if err != nil {
+		return nil, err
+	}
+	server.balancer = newBalancer(&server.config.Replicas)
+	return server, nil
+}
+
+// handleReplicaConn copies the bytes between the client and a replica, or the
+// master if no replica is available and falling back
+func (s *Server) handleReplicaConn(conn net.Conn) {
+	defer conn.Close()
+	peer, removed := s.balancer.pick(s.replicas(time.Duration(s.config.Replicas.MaxLag)))
+	if peer == nil {
+		if s.config.Replicas.FallbackToMaster {
+			replicaConnectionsTotal.Inc("fallback")
+			s.handleConn(conn)
+			return
+		}
+		log.Warningf("replica proxy %s: no replica available", conn.RemoteAddr())
+		replicaConnectionsTotal.Inc("no_replica")
+		return
+	}
+	defer s.balancer.release(peer.PeerId, removed)
+
+	u, err := url.Parse(peer.ProxiedAddress)
+	if err != nil {
+		log.Errorf("replica proxy %s: invalid proxied address %s: %v", conn.RemoteAddr(), peer.ProxiedAddress, err)
+		replicaConnectionsTotal.Inc("dial_error")
+		return
+	}
+	backend, err := s.dial(context.Background(), u, s.header(conn))
+	if err != nil {
+		log.Errorf("replica proxy %s to %s: %v", conn.RemoteAddr(), u.Host, err)
+		replicaConnectionsTotal.Inc("dial_error")
+		return
+	}
+	defer backend.Close()
+	replicaConnectionsTotal.Inc("proxied")
+	if !relay(conn, backend, removed) {
+		log.Infof("replica %s removed, close the connection of %s", peer.PeerId, conn.RemoteAddr())
+	}
+}
+
+// watchReplicas removes the backends from the balancer once they are not replicas,
+// which is checked on the health, election and membership events, and on the
+// changes of the master learned by syncing
+func (s *Server) watchReplicas(ctx context.Context, bus *event.Bus) {
+	events, cancel := bus.Subscribe(64)
+	defer cancel()
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		_, _, changed := s.sentinel.WatchMaster()
+		s.balancer.reconcile(s.replicas(time.Duration(s.config.Replicas.MaxLag)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		case <-events:
+		}
+	}
+}
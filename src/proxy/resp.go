@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxBulkLength is the proto-max-bulk-len of redis, for the replies of the backend
+	maxBulkLength = 512 << 20
+	// maxCommandArgs and maxCommandBulk limit the commands of the clients, which
+	// are read before any authentication
+	maxCommandArgs = 1 << 20
+	maxCommandBulk = 64 << 20
+	// respChunk the bulks are read by, so that the memory follows the bytes
+	// received rather than the length claimed
+	respChunk = 64 << 10
+)
+
+var ErrRESP = errors.New("malformed RESP")
+
+// redisCommand is a command of the client, raw is the RESP array forwarded
+type redisCommand struct {
+	args [][]byte
+	raw  []byte
+}
+
+// name returns the command in upper case, with the subcommand for the commands
+// having ones the proxy follows
+func (c *redisCommand) name() string {
+	if len(c.args) == 0 {
+		return ""
+	}
+	name := strings.ToUpper(string(c.args[0]))
+	if (name == "CLIENT" || name == "SENTINEL") && len(c.args) > 1 {
+		name += " " + strings.ToUpper(string(c.args[1]))
+	}
+	return name
+}
+
+// readRedisCommand reads an array of bulk strings, or an inline command which is
+// forwarded as an array
+func readRedisCommand(r *bufio.Reader) (*redisCommand, error) {
+	for {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] != '*' {
+			fields := bytes.Fields(append([]byte{}, line...))
+			if len(fields) == 0 {
+				continue
+			}
+			return &redisCommand{args: fields, raw: appendRESPArray(nil, fields)}, nil
+		}
+		n, err := respLength(line, maxCommandArgs)
+		if err != nil {
+			return nil, err
+		}
+		c := &redisCommand{raw: append([]byte{}, line...)}
+		for i := 0; i < n; i++ {
+			line, err := readRESPLine(r)
+			if err != nil {
+				return nil, err
+			}
+			if line[0] != '$' {
+				return nil, fmt.Errorf("%w: %q in a command", ErrRESP, line[0])
+			}
+			size, err := respLength(line, maxCommandBulk)
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("%w: bulk length of a command", ErrRESP)
+			}
+			c.raw = append(c.raw, line...)
+			start := len(c.raw)
+			if c.raw, err = readRESPBytes(r, c.raw, size+2); err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, c.raw[start:start+size])
+		}
+		if n > 0 {
+			return c, nil
+		}
+	}
+}
+
+// readRESP reads a reply of RESP2 or RESP3 and returns its raw bytes
+func readRESP(r *bufio.Reader) ([]byte, error) {
+	return appendRESP(nil, r)
+}
+
+func appendRESP(b []byte, r *bufio.Reader) ([]byte, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, line...)
+	switch line[0] {
+	case '+', '-', ':', '_', ',', '#', '(':
+		return b, nil
+	case '$', '!', '=':
+		n, err := respLength(line, maxBulkLength)
+		if err != nil || n < 0 {
+			return b, err
+		}
+		return readRESPBytes(r, b, n+2)
+	case '*', '~', '>', '%', '|':
+		n, err := respLength(line, maxBulkLength)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] == '%' || line[0] == '|' {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			if b, err = appendRESP(b, r); err != nil {
+				return nil, err
+			}
+		}
+		if line[0] == '|' {
+			// the attributes come before the reply
+			return appendRESP(b, r)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("%w: type %q", ErrRESP, line[0])
+}
+
+// readRESPLine reads a line ended by CRLF, or LF for inline commands. It is valid
+// until the next read.
+func readRESPLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%w: line too long", ErrRESP)
+	}
+	return line, err
+}
+
+// readRESPBytes appends n bytes read by chunks
+func readRESPBytes(r io.Reader, b []byte, n int) ([]byte, error) {
+	for n > 0 {
+		size := n
+		if size > respChunk {
+			size = respChunk
+		}
+		start := len(b)
+		b = append(b, make([]byte, size)...)
+		if _, err := io.ReadFull(r, b[start:]); err != nil {
+			return nil, err
+		}
+		n -= size
+	}
+	return b, nil
+}
+
+// respLength parses the length of a bulk or an aggregate up to max, -1 is null
+func respLength(line []byte, max int) (int, error) {
+	n, err := strconv.Atoi(string(bytes.TrimRight(line[1:], "\r\n")))
+	if err != nil || n < -1 || n > max {
+		return 0, fmt.Errorf("%w: length %q", ErrRESP, line)
+	}
+	return n, nil
+}
+
+// appendRESPArray appends an array of bulk strings
+func appendRESPArray(b []byte, items [][]byte) []byte {
+	b = appendArrayHeader(b, len(items))
+	for _, item := range items {
+		b = appendBulk(b, item)
+	}
+	return b
+}
+
+// appendArrayHeader appends the header of an array, its n items follow
+func appendArrayHeader(b []byte, n int) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(n), 10)
+	return append(b, "\r\n"...)
+}
+
+func appendBulk(b []byte, item []byte) []byte {
+	b = append(b, '$')
+	b = strconv.AppendInt(b, int64(len(item)), 10)
+	b = append(b, "\r\n"...)
+	b = append(b, item...)
+	return append(b, "\r\n"...)
+}
+
+// respError is an error reply, the message has no line breaks
+func respError(message string) []byte {
+	return []byte("-ERR janus: " + message + "\r\n")
+}
+
+// isRESPError returns whether the reply is an error of the kind, such as READONLY
+func isRESPError(reply []byte, kind string) bool {
+	return len(reply) > len(kind) && reply[0] == '-' && string(reply[1:1+len(kind)]) == kind
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReadRedisCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		args  []string
+		raw   string
+		err   error
+	}{
+		{
+			name:  "array",
+			input: "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2\r\nv1\r\n",
+			args:  []string{"SET", "k", "v1"},
+			raw:   "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$2\r\nv1\r\n",
+		},
+		{
+			name:  "binary bulk",
+			input: "*2\r\n$3\r\nGET\r\n$4\r\na\r\nb\r\n",
+			args:  []string{"GET", "a\r\nb"},
+			raw:   "*2\r\n$3\r\nGET\r\n$4\r\na\r\nb\r\n",
+		},
+		{
+			name:  "inline forwarded as array",
+			input: "ping  hello\r\n",
+			args:  []string{"ping", "hello"},
+			raw:   "*2\r\n$4\r\nping\r\n$5\r\nhello\r\n",
+		},
+		{
+			name:  "inline ended by LF",
+			input: "PING\n",
+			args:  []string{"PING"},
+			raw:   "*1\r\n$4\r\nPING\r\n",
+		},
+		{
+			name:  "empty lines and arrays skipped",
+			input: "\r\n*0\r\n*1\r\n$4\r\nPING\r\n",
+			args:  []string{"PING"},
+			raw:   "*1\r\n$4\r\nPING\r\n",
+		},
+		{
+			name:  "not a bulk",
+			input: "*1\r\n:1\r\n",
+			err:   ErrRESP,
+		},
+		{
+			name:  "null bulk",
+			input: "*1\r\n$-1\r\n",
+			err:   ErrRESP,
+		},
+		{
+			name:  "bad length",
+			input: "*x\r\n",
+			err:   ErrRESP,
+		},
+		{
+			name:  "too many args",
+			input: fmt.Sprintf("*%d\r\n", maxCommandArgs+1),
+			err:   ErrRESP,
+		},
+		{
+			name:  "bulk too long",
+			input: fmt.Sprintf("*1\r\n$%d\r\n", maxCommandBulk+1),
+			err:   ErrRESP,
+		},
+		{
+			name:  "line too long",
+			input: strings.Repeat("a", 8192) + "\r\n",
+			err:   ErrRESP,
+		},
+		{
+			name:  "bulk cut",
+			input: "*1\r\n$4\r\nPI",
+			err:   io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "eof",
+			input: "",
+			err:   io.EOF,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := readRedisCommand(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			var args []string
+			for _, arg := range cmd.args {
+				args = append(args, string(arg))
+			}
+			if strings.Join(args, "|") != strings.Join(tt.args, "|") {
+				t.Errorf("args = %q, want %q", args, tt.args)
+			}
+			if string(cmd.raw) != tt.raw {
+				t.Errorf("raw = %q, want %q", cmd.raw, tt.raw)
+			}
+		})
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// reply read, the input when empty
+		reply string
+		err   error
+	}{
+		{name: "simple", input: "+OK\r\n"},
+		{name: "error", input: "-READONLY You can't write against a read only replica.\r\n"},
+		{name: "integer", input: ":42\r\n"},
+		{name: "bulk", input: "$5\r\nhello\r\n"},
+		{name: "null bulk", input: "$-1\r\n"},
+		{name: "empty bulk", input: "$0\r\n\r\n"},
+		{name: "array", input: "*2\r\n$1\r\na\r\n*1\r\n:1\r\n"},
+		{name: "null array", input: "*-1\r\n"},
+		{name: "resp3 null", input: "_\r\n"},
+		{name: "resp3 map", input: "%2\r\n+server\r\n+redis\r\n+proto\r\n:3\r\n"},
+		{name: "resp3 set", input: "~2\r\n+a\r\n+b\r\n"},
+		{name: "resp3 push", input: ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$1\r\nx\r\n"},
+		{name: "resp3 verbatim", input: "=9\r\ntxt:hello\r\n"},
+		{name: "resp3 attribute before the reply", input: "|1\r\n+ttl\r\n:3\r\n$1\r\nv\r\n"},
+		{name: "one reply of two", input: "+OK\r\n+QUEUED\r\n", reply: "+OK\r\n"},
+		{name: "unknown type", input: "?\r\n", err: ErrRESP},
+		{name: "bulk too long", input: fmt.Sprintf("$%d\r\n", maxBulkLength+1), err: ErrRESP},
+		{name: "bulk cut", input: "$5\r\nhel", err: io.ErrUnexpectedEOF},
+		{name: "array cut", input: "*2\r\n+a\r\n", err: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := readRESP(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			want := tt.reply
+			if len(want) == 0 {
+				want = tt.input
+			}
+			if string(reply) != want {
+				t.Errorf("reply = %q, want %q", reply, want)
+			}
+		})
+	}
+}
+
+// a client claiming a long bulk gets the memory of the bytes it sends only
+func TestReadRESPBytesByChunks(t *testing.T) {
+	input := fmt.Sprintf("*1\r\n$%d\r\n%s", maxCommandBulk, strings.Repeat("a", 100))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readRedisCommand(bufio.NewReader(strings.NewReader(input)))
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*respChunk {
+		t.Errorf("allocated %d bytes for a bulk of 100 bytes", allocated)
+	}
+
+	// a bulk longer than a chunk is read whole
+	value := strings.Repeat("v", 3*respChunk+1)
+	cmd, err := readRedisCommand(bufio.NewReader(strings.NewReader(string(appendRESPArray(nil, [][]byte{[]byte("SET"), []byte(value)})))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmd.args) != 2 || string(cmd.args[1]) != value {
+		t.Errorf("value of %d bytes read as %d args", len(value), len(cmd.args))
+	}
+}
+
+func TestRESPErrors(t *testing.T) {
+	tests := []struct {
+		reply     string
+		kind      string
+		is        bool
+		retryable bool
+	}{
+		{"-READONLY You can't write against a read only replica.\r\n", "READONLY", true, true},
+		{"-LOADING Redis is loading the dataset in memory\r\n", "LOADING", true, true},
+		{"-ERR unknown command\r\n", "READONLY", false, false},
+		{"+READONLY\r\n", "READONLY", false, false},
+		{"-READ\r\n", "READONLY", false, false},
+	}
+	for _, tt := range tests {
+		if got := isRESPError([]byte(tt.reply), tt.kind); got != tt.is {
+			t.Errorf("isRESPError(%q, %s) = %v, want %v", tt.reply, tt.kind, got, tt.is)
+		}
+		if got := retryableRedisError([]byte(tt.reply)); got != tt.retryable {
+			t.Errorf("retryableRedisError(%q) = %v, want %v", tt.reply, got, tt.retryable)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmpei/janus/src/model"
+)
+
+const (
+	routeReplica = "replica"
+	routeMaster  = "master"
+)
+
+// isRead returns whether the request matches the rules of reads, the header
+// overrides the method and path rules
+func (s *Server) isRead(r *http.Request) bool {
+	rules := &s.config.ReadRouting
+	if len(rules.Header) > 0 {
+		switch strings.ToLower(r.Header.Get(rules.Header)) {
+		case routeReplica:
+			return true
+		case routeMaster:
+			return false
+		}
+	}
+	matched := false
+	for _, method := range rules.Methods {
+		if r.Method == method {
+			matched = true
+			break
+		}
+	}
+	if !matched || len(rules.PathPrefixes) == 0 {
+		return matched
+	}
+	for _, prefix := range rules.PathPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// replica picks a replica for the read round robin, nil if none qualifies
+func (s *Server) replica() *url.URL {
+	replicas := s.replicas(time.Duration(s.config.ReadRouting.MaxLag))
+	if len(replicas) == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&s.next, 1)
+	u, err := url.Parse(replicas[n%uint64(len(replicas))].ProxiedAddress)
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// replicas returns copies of the healthy backends except the master sorted by
+// id, the lagging ones are excluded if maxLag is set
+func (s *Server) replicas(maxLag time.Duration) []*model.PeerInfo {
+	master := s.sentinel.GetMaster()
+	var replicas []*model.PeerInfo
+	peers := s.monitor.Snapshot()
+	for i := range peers {
+		peer := &peers[i]
+		if !peer.Alive || peer.PeerId == master || len(peer.ProxiedAddress) == 0 {
+			continue
+		}
+		if maxLag > 0 && (peer.Lag < 0 || peer.Lag > maxLag) {
+			continue
+		}
+		replicas = append(replicas, peer)
+	}
+	return replicas
+}
@@ -0,0 +1,432 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	jsync "github.com/mmpei/janus/src/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// switchMasterChannel is published on the elections, as Redis Sentinel does
+	switchMasterChannel = "+switch-master"
+	// publishTimeout of writing a message to a subscriber, a slow one is closed
+	publishTimeout = time.Second
+)
+
+// RedisSentinelServer answers the subset of the Redis Sentinel protocol the
+// clients use to find the master and the replicas, from the state of the
+// sentinel. The clients subscribed to +switch-master are told the elections.
+type RedisSentinelServer struct {
+	addr       string
+	masterName string
+	sentinel   *jsync.Sentinel
+	monitor    *jsync.MonitorManager
+
+	lock        sync.Mutex
+	subscribers map[*sentinelSession]bool
+}
+
+// sentinelSession is a client of the sentinel listener, the lock serializes the
+// replies and the messages published
+type sentinelSession struct {
+	conn     net.Conn
+	lock     sync.Mutex
+	channels map[string]bool
+	patterns map[string]bool
+}
+
+func NewRedisSentinelServer(ip string, cfg *config.RedisSentinelConfig, s *jsync.Sentinel, mm *jsync.MonitorManager) *RedisSentinelServer {
+	return &RedisSentinelServer{
+		addr:        net.JoinHostPort(ip, strconv.Itoa(cfg.Port)),
+		masterName:  cfg.MasterName,
+		sentinel:    s,
+		monitor:     mm,
+		subscribers: make(map[*sentinelSession]bool),
+	}
+}
+
+// ListenAndServe serves until the listener fails
+func (s *RedisSentinelServer) ListenAndServe(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Infof("redis sentinel of master %s listen on %s", s.masterName, s.addr)
+	go s.watchMaster(ctx)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// watchMaster publishes +switch-master when the master changes to another one
+func (s *RedisSentinelServer) watchMaster(ctx context.Context) {
+	var old *url.URL
+	for {
+		u, changed, _ := masterAddress(s.sentinel, s.monitor)
+		if u != nil {
+			if old != nil && old.Host != u.Host {
+				oldHost, oldPort := hostPort(old)
+				host, port := hostPort(u)
+				log.Infof("redis sentinel switch master %s from %s to %s", s.masterName, old.Host, u.Host)
+				s.publish(switchMasterChannel, strings.Join([]string{s.masterName, oldHost, oldPort, host, port}, " "))
+			}
+			old = u
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
+
+func (s *RedisSentinelServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	sess := &sentinelSession{
+		conn:     conn,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+	}
+	defer s.unsubscribe(sess)
+	reader := bufio.NewReader(conn)
+	for {
+		cmd, err := readRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		reply, quit := s.handle(sess, cmd)
+		if err := sess.write(reply); err != nil || quit {
+			return
+		}
+	}
+}
+
+// handle returns the reply of the command, quit is true to close the connection
+func (s *RedisSentinelServer) handle(sess *sentinelSession, cmd *redisCommand) ([]byte, bool) {
+	name := cmd.name()
+	label := strings.ToLower(name)
+	if !sentinelCommands[name] {
+		label = "other"
+	}
+	sentinelCommandsTotal.Inc(label)
+
+	subscribed := sess.subscriptions() > 0
+	switch name {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(cmd.args) < 2 {
+			return []byte(fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(name))), false
+		}
+		return s.subscribe(sess, name, cmd.args[1:]), false
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		return s.subscribe(sess, name, cmd.args[1:]), false
+	case "PING":
+		if subscribed {
+			payload := []byte{}
+			if len(cmd.args) > 1 {
+				payload = cmd.args[1]
+			}
+			return appendRESPArray(nil, [][]byte{[]byte("pong"), payload}), false
+		}
+		if len(cmd.args) > 1 {
+			return appendBulk(nil, cmd.args[1]), false
+		}
+		return []byte("+PONG\r\n"), false
+	case "QUIT":
+		return []byte("+OK\r\n"), true
+	}
+	if subscribed {
+		return []byte(fmt.Sprintf("-ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n", strings.ToLower(name))), false
+	}
+
+	switch name {
+	case "SENTINEL GET-MASTER-ADDR-BY-NAME":
+		return masterAddrReply(s.sentinel, s.monitor, cmd, s.masterName, false), false
+	case "SENTINEL MASTERS":
+		if fields := s.masterFields(); fields != nil {
+			return appendRESPArray(appendArrayHeader(nil, 1), fields), false
+		}
+		return appendArrayHeader(nil, 0), false
+	case "SENTINEL MASTER":
+		if !s.knownName(cmd) {
+			return []byte("-ERR No such master with that name\r\n"), false
+		}
+		if fields := s.masterFields(); fields != nil {
+			return appendRESPArray(nil, fields), false
+		}
+		return []byte("-ERR No such master with that name\r\n"), false
+	case "SENTINEL REPLICAS", "SENTINEL SLAVES":
+		if !s.knownName(cmd) {
+			return []byte("-ERR No such master with that name\r\n"), false
+		}
+		replicas := s.replicaFields(s.master())
+		b := appendArrayHeader(nil, len(replicas))
+		for _, fields := range replicas {
+			b = appendRESPArray(b, fields)
+		}
+		return b, false
+	case "SENTINEL SENTINELS":
+		if !s.knownName(cmd) {
+			return []byte("-ERR No such master with that name\r\n"), false
+		}
+		// the other janus node answers the same, the clients need not know it
+		return appendArrayHeader(nil, 0), false
+	case "ROLE":
+		b := appendArrayHeader(nil, 2)
+		b = appendBulk(b, []byte("sentinel"))
+		return appendRESPArray(b, [][]byte{[]byte(s.masterName)}), false
+	case "INFO":
+		return appendBulk(nil, []byte(s.info())), false
+	case "HELLO":
+		if len(cmd.args) > 1 && string(cmd.args[1]) != "2" {
+			return []byte("-NOPROTO unsupported protocol version\r\n"), false
+		}
+		return appendRESPArray(nil, [][]byte{
+			[]byte("server"), []byte("janus"), []byte("proto"), []byte("2"),
+			[]byte("mode"), []byte("sentinel"), []byte("role"), []byte("sentinel"),
+		}), false
+	case "CLIENT SETNAME", "CLIENT SETINFO":
+		return []byte("+OK\r\n"), false
+	case "AUTH":
+		return []byte("-ERR AUTH <password> called without any password configured for the default user\r\n"), false
+	}
+	return []byte(fmt.Sprintf("-ERR unknown command '%s'\r\n", strings.ToLower(name))), false
+}
+
+// the commands counted by name, the others as other
+var sentinelCommands = map[string]bool{
+	"SENTINEL GET-MASTER-ADDR-BY-NAME": true, "SENTINEL MASTERS": true, "SENTINEL MASTER": true,
+	"SENTINEL REPLICAS": true, "SENTINEL SLAVES": true, "SENTINEL SENTINELS": true,
+	"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	"PING": true, "QUIT": true, "ROLE": true, "INFO": true, "HELLO": true,
+}
+
+func (s *RedisSentinelServer) knownName(cmd *redisCommand) bool {
+	return len(cmd.args) == 3 && string(cmd.args[2]) == s.masterName
+}
+
+// sentinelMaster is the backend master of a term, all the fields of it are read
+// at once so that they describe the same master
+type sentinelMaster struct {
+	id    string
+	term  uint64
+	addr  *url.URL
+	alive bool
+}
+
+// master returns the backend master, nil without a master or its address
+func (s *RedisSentinelServer) master() *sentinelMaster {
+	id, term := s.sentinel.GetMasterTerm()
+	if len(id) == 0 {
+		return nil
+	}
+	u, err := proxiedAddress(s.monitor, id)
+	if err != nil {
+		return nil
+	}
+	return &sentinelMaster{
+		id:    id,
+		term:  term,
+		addr:  u,
+		alive: s.monitor.IsHealth(id),
+	}
+}
+
+// masterFields returns the fields of SENTINEL master, nil without a master
+func (s *RedisSentinelServer) masterFields() [][]byte {
+	master := s.master()
+	if master == nil {
+		return nil
+	}
+	host, port := hostPort(master.addr)
+	flags := "master"
+	if !master.alive {
+		flags += ",s_down"
+	}
+	return fields(
+		"name", s.masterName,
+		"ip", host,
+		"port", port,
+		"runid", "",
+		"flags", flags,
+		"role-reported", "master",
+		"config-epoch", strconv.FormatUint(master.term, 10),
+		"num-slaves", strconv.Itoa(len(s.replicaFields(master))),
+		"num-other-sentinels", "0",
+		"quorum", "1",
+	)
+}
+
+// replicaFields returns the fields of the backends other than the master, which
+// could be nil
+func (s *RedisSentinelServer) replicaFields(master *sentinelMaster) [][][]byte {
+	id, masterHost, masterPort := "", "?", "0"
+	if master != nil {
+		id = master.id
+		masterHost, masterPort = hostPort(master.addr)
+	}
+	var replicas [][][]byte
+	for _, peer := range s.monitor.Snapshot() {
+		if peer.PeerId == id || len(peer.ProxiedAddress) == 0 {
+			continue
+		}
+		u, err := url.Parse(peer.ProxiedAddress)
+		if err != nil {
+			continue
+		}
+		host, port := hostPort(u)
+		flags, link := "slave", "ok"
+		if !peer.Alive {
+			flags, link = "slave,s_down", "err"
+		}
+		replicas = append(replicas, fields(
+			"name", net.JoinHostPort(host, port),
+			"ip", host,
+			"port", port,
+			"runid", "",
+			"flags", flags,
+			"role-reported", "slave",
+			"master-link-status", link,
+			"master-host", masterHost,
+			"master-port", masterPort,
+			"slave-priority", "100",
+		))
+	}
+	return replicas
+}
+
+func (s *RedisSentinelServer) info() string {
+	status, address := "odown", "?:0"
+	master := s.master()
+	if master != nil {
+		host, port := hostPort(master.addr)
+		status, address = "ok", net.JoinHostPort(host, port)
+	}
+	return fmt.Sprintf("# Server\r\nredis_mode:sentinel\r\n\r\n# Sentinel\r\nsentinel_masters:1\r\n"+
+		"master0:name=%s,status=%s,address=%s,slaves=%d,sentinels=1\r\n",
+		s.masterName, status, address, len(s.replicaFields(master)))
+}
+
+// subscribe changes the subscriptions of the session, with a reply for each
+func (s *RedisSentinelServer) subscribe(sess *sentinelSession, name string, args [][]byte) []byte {
+	kind := strings.ToLower(name)
+	sess.lock.Lock()
+	set := sess.channels
+	if strings.HasPrefix(name, "P") {
+		set = sess.patterns
+	}
+	adding := !strings.Contains(name, "UNSUBSCRIBE")
+	if !adding && len(args) == 0 {
+		for channel := range set {
+			args = append(args, []byte(channel))
+		}
+	}
+	var b []byte
+	if !adding && len(args) == 0 {
+		b = append(appendArrayHeader(nil, 3), appendBulk(nil, []byte(kind))...)
+		b = append(b, "$-1\r\n"...)
+		b = strconv.AppendInt(append(b, ':'), int64(len(sess.channels)+len(sess.patterns)), 10)
+		b = append(b, "\r\n"...)
+	}
+	for _, arg := range args {
+		if adding {
+			set[string(arg)] = true
+		} else {
+			delete(set, string(arg))
+		}
+		b = append(appendArrayHeader(b, 3), appendBulk(nil, []byte(kind))...)
+		b = appendBulk(b, arg)
+		b = strconv.AppendInt(append(b, ':'), int64(len(sess.channels)+len(sess.patterns)), 10)
+		b = append(b, "\r\n"...)
+	}
+	count := len(sess.channels) + len(sess.patterns)
+	sess.lock.Unlock()
+
+	s.lock.Lock()
+	if count > 0 {
+		s.subscribers[sess] = true
+	} else {
+		delete(s.subscribers, sess)
+	}
+	s.lock.Unlock()
+	return b
+}
+
+func (s *RedisSentinelServer) unsubscribe(sess *sentinelSession) {
+	s.lock.Lock()
+	delete(s.subscribers, sess)
+	s.lock.Unlock()
+}
+
+// publish sends the message to the sessions subscribed to the channel
+func (s *RedisSentinelServer) publish(channel, message string) {
+	s.lock.Lock()
+	sessions := make([]*sentinelSession, 0, len(s.subscribers))
+	for sess := range s.subscribers {
+		sessions = append(sessions, sess)
+	}
+	s.lock.Unlock()
+	for _, sess := range sessions {
+		sess.publish(channel, message)
+	}
+}
+
+func (sess *sentinelSession) publish(channel, message string) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	var b []byte
+	if sess.channels[channel] {
+		b = appendRESPArray(b, [][]byte{[]byte("message"), []byte(channel), []byte(message)})
+	}
+	for pattern := range sess.patterns {
+		if ok, _ := path.Match(pattern, channel); ok {
+			b = appendRESPArray(b, [][]byte{[]byte("pmessage"), []byte(pattern), []byte(channel), []byte(message)})
+		}
+	}
+	if len(b) == 0 {
+		return
+	}
+	sess.conn.SetWriteDeadline(time.Now().Add(publishTimeout))
+	defer sess.conn.SetWriteDeadline(time.Time{})
+	if _, err := sess.conn.Write(b); err != nil {
+		log.Warningf("redis sentinel publish to %s: %v", sess.conn.RemoteAddr(), err)
+		sess.conn.Close()
+	}
+}
+
+func (sess *sentinelSession) subscriptions() int {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	return len(sess.channels) + len(sess.patterns)
+}
+
+func (sess *sentinelSession) write(b []byte) error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	_, err := sess.conn.Write(b)
+	return err
+}
+
+// fields encodes the pairs of field names and values as bulk strings
+func fields(pairs ...string) [][]byte {
+	b := make([][]byte, 0, len(pairs))
+	for _, p := range pairs {
+		b = append(b, []byte(p))
+	}
+	return b
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// acceptRetryDelay after failing to accept
+const acceptRetryDelay = 100 * time.Millisecond
+
+// serveTCP accepts the connections and handles each in a goroutine
+func (s *Server) serveTCP(l net.Listener, handle func(net.Conn)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// such as too many open files, wait for some to be closed
+			log.Warningf("proxy accept error: %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		go handle(conn)
+	}
+}
+
+// handleConn copies the bytes between the client and the backend master. The
+// connection is closed when the master changes, so the client reconnects to the
+// new one instead of writing to a slave.
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	u, changed, err := s.master()
+	if err != nil {
+		log.Warningf("proxy %s: %v", conn.RemoteAddr(), err)
+		connectionsTotal.Inc("no_master")
+		return
+	}
+	backend, err := s.dial(context.Background(), u, s.header(conn))
+	if err != nil {
+		log.Errorf("proxy %s to %s: %v", conn.RemoteAddr(), u.Host, err)
+		connectionsTotal.Inc("dial_error")
+		return
+	}
+	defer backend.Close()
+	connectionsTotal.Inc("proxied")
+	if !relay(conn, backend, changed) {
+		log.Infof("backend master changed, close the connection of %s", conn.RemoteAddr())
+	}
+}
+
+// header returns the PROXY header of the client to send to the backend, nil if
+// not sending
+func (s *Server) header(conn net.Conn) []byte {
+	if len(s.config.ProxyProtocol.Send) == 0 {
+		return nil
+	}
+	return proxyHeader(s.config.ProxyProtocol.Send, conn.RemoteAddr(), conn.LocalAddr())
+}
+
+// relay copies the bytes between the client and the backend until either of them
+// closes, or stop is closed and it returns false
+func relay(conn, backend net.Conn, stop <-chan struct{}) bool {
+	activeConnections.Add(1)
+	defer activeConnections.Add(-1)
+	done := make(chan struct{}, 2)
+	go pipe(backend, conn, "upstream", done)
+	go pipe(conn, backend, "downstream", done)
+	select {
+	case <-done:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// pipe copies src to dst until either fails, closing both by the caller stops
+// the other direction
+func pipe(dst io.Writer, src io.Reader, direction string, done chan<- struct{}) {
+	io.Copy(&countingWriter{w: dst, direction: direction}, src)
+	done <- struct{}{}
+}
+
+type countingWriter struct {
+	w         io.Writer
+	direction string
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	bytesTotal.Add(float64(n), cw.direction)
+	return n, err
+}
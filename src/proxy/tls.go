@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/auth"
+	"github.com/mmpei/janus/src/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// certStore serves the certificates by SNI, and reloads them when the files change
+type certStore struct {
+	lock     sync.RWMutex
+	files    []config.CertificateConfig
+	certs    []*tls.Certificate
+	modTimes []time.Time
+}
+
+func newCertStore(files []config.CertificateConfig) (*certStore, error) {
+	cs := &certStore{
+		files:    files,
+		certs:    make([]*tls.Certificate, len(files)),
+		modTimes: make([]time.Time, len(files)),
+	}
+	for i := range files {
+		if err := cs.load(i); err != nil {
+			return nil, err
+		}
+	}
+	return cs, nil
+}
+
+// load reads the certificate i, the old one is kept on errors
+func (cs *certStore) load(i int) error {
+	f := cs.files[i]
+	modTime, err := modTime(f)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %v", f.CertFile, err)
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.certs[i] = &cert
+	cs.modTimes[i] = modTime
+	return nil
+}
+
+// modTime returns the later modification time of the cert and key files
+func modTime(f config.CertificateConfig) (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{f.CertFile, f.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate returns the first certificate valid for the SNI of the client,
+// the first one if none is
+func (cs *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	for _, cert := range cs.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return cs.certs[0], nil
+}
+
+// watch reloads the certificates whose files are changed until ctx is done
+func (cs *certStore) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for i, f := range cs.files {
+			t, err := modTime(f)
+			cs.lock.RLock()
+			changed := err == nil && !t.Equal(cs.modTimes[i])
+			cs.lock.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := cs.load(i); err != nil {
+				log.Errorf("reload certificate %s error: %v, keep the old one", f.CertFile, err)
+				tlsReloadsTotal.Inc("failure")
+				continue
+			}
+			log.Infof("certificate %s reloaded", f.CertFile)
+			tlsReloadsTotal.Inc("success")
+		}
+	}
+}
+
+// backendTLSConfig verifies the backend by the ca file or the system roots
+func backendTLSConfig(cfg *config.BackendTLSConfig) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if len(cfg.CAFile) > 0 {
+		pool, err := auth.LoadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	return c, nil
+}
@@ -0,0 +1,152 @@
+package reload
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+	jsync "github.com/mmpei/janus/src/sync"
+	log "github.com/sirupsen/logrus"
+)
+
+// LoadFunc reads the configuration the same way as starting
+type LoadFunc func() (*config.Configuration, error)
+
+// Reloader re-reads the configuration and applies the live-tunable changes. The
+// components are handed their own copies of the changed fields, config.ProxyConfig
+// is left as started since it is read without a lock.
+type Reloader struct {
+	lock sync.Mutex
+	load LoadFunc
+	// current is the configuration applied, the reloaded one is diffed against it
+	current config.Configuration
+
+	syncManager *jsync.SyncManager
+	sentinel    *jsync.Sentinel
+	epMonitor   *jsync.MonitorManager
+
+	// appliers of the other live fields, by field
+	appliers    map[string]func(cfg *config.Configuration)
+}
+
+func NewReloader(load LoadFunc, sm *jsync.SyncManager, s *jsync.Sentinel, mm *jsync.MonitorManager) *Reloader {
+	return &Reloader{
+		load: load,
+		current: config.ProxyConfig,
+		syncManager: sm,
+		sentinel: s,
+		epMonitor: mm,
+		appliers: make(map[string]func(cfg *config.Configuration)),
+	}
+}
+
+// OnChange registers how to apply the field when it is changed by reloading,
+// apply should hand a copy of it to the component
+func (r *Reloader) OnChange(field string, apply func(cfg *config.Configuration)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.appliers[field] = apply
+}
+
+// Reload reads and validates the configuration, and applies the changes. Nothing
+// is applied if any change needs a restart.
+func (r *Reloader) Reload() ([]config.Change, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cfg, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	changes, err := config.Diff(&r.current, cfg)
+	if err != nil {
+		return changes, err
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	for _, c := range changes {
+		log.Infof("reload config %s: %s -> %s", c.Field, c.Old, c.New)
+	}
+
+	if config.Changed(changes, "log_level") {
+		log.SetLevel(LogLevel(cfg.LogLevel))
+	}
+	if config.Changed(changes, "to_master") || config.Changed(changes, "to_slave") {
+		r.sentinel.SetRoleURLs(cfg.ToMaster, cfg.ToSlave)
+	}
+
+	// the loops take the new copy of their own section when restarted
+	if config.Changed(changes, "sync") {
+		r.syncManager.SetConfig(&cfg.Sync)
+		if err := r.syncManager.Restart(); err != nil {
+			return changes, err
+		}
+	}
+	if config.Changed(changes, "monitor") {
+		r.epMonitor.SetConfig(&cfg.Monitor)
+		if r.epMonitor.IsRunning() {
+			if err := r.epMonitor.Restart(); err != nil {
+				return changes, err
+			}
+		}
+	}
+
+	if config.Changed(changes, "backends") {
+		if len(r.current.Discovery.Provider) > 0 {
+			log.Warningf("backends are discovered by %s, ignore the static ones", r.current.Discovery.Provider)
+		} else {
+			r.sentinel.ReconcileBackends(cfg.Backends)
+		}
+	}
+
+	for field, apply := range r.appliers {
+		if config.Changed(changes, field) {
+			apply(cfg)
+		}
+	}
+
+	r.current = *cfg
+
+	fields := make([]string, 0, len(changes))
+	for _, c := range changes {
+		fields = append(fields, c.Field)
+	}
+	event.Publish(event.EventConfigReload, "", fmt.Sprintf("config reloaded, %d changes", len(changes)), map[string]string{
+		"fields": strings.Join(fields, ","),
+	})
+	return changes, nil
+}
+
+// HandleSignals reloads whenever SIGHUP is received
+func (r *Reloader) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Infof("SIGHUP received, reload config")
+		changes, err := r.Reload()
+		if err != nil {
+			log.Errorf("reload config error: %v", err)
+			continue
+		}
+		log.Infof("reload config done, %d changes", len(changes))
+	}
+}
+
+// LogLevel parses the level, info is used if it is invalid
+func LogLevel(level string) log.Level {
+	l, err := log.ParseLevel(level)
+	if err != nil {
+		l = log.InfoLevel
+		log.Warnf("error parsing level %s: %v, using %q	", level, err, l)
+	}
+	return l
+}
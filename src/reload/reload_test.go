@@ -0,0 +1,98 @@
+package reload
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mmpei/janus/src/config"
+	log "github.com/sirupsen/logrus"
+)
+
+func testConfig() *config.Configuration {
+	c := config.NewDefaultConfiguration()
+	c.LogLevel = "info"
+	c.IP = "127.0.0.1"
+	c.Port = 9000
+	c.Cluster = []string{"127.0.0.1:9000", "127.0.0.1:9001"}
+	c.Backends = []string{"127.0.0.1:9090"}
+	c.Monitor.URL = "/status"
+	c.ToMaster = "/master"
+	c.ToSlave = "/slave"
+	return c
+}
+
+func TestReload(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.InfoLevel)
+	config.ProxyConfig = *testConfig()
+	if err := config.ProxyConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *config.Configuration)
+		// changed fields, or the error
+		want  []string
+		err   string
+		level log.Level
+	}{
+		{
+			name:   "invalid",
+			change: func(c *config.Configuration) { c.LogLevel = "debug"; c.IP = "" },
+			err:    "invalid config",
+			level:  log.InfoLevel,
+		},
+		{
+			name:   "restart only",
+			change: func(c *config.Configuration) { c.LogLevel = "debug"; c.BackendsFile = "/tmp/backends.yaml" },
+			err:    "changes need a restart: backends_file",
+			level:  log.InfoLevel,
+		},
+		// the rejected changes are not applied, so they are still rejected
+		{
+			name:   "restart only again",
+			change: func(c *config.Configuration) { c.BackendsFile = "/tmp/backends.yaml" },
+			err:    "changes need a restart: backends_file",
+			level:  log.InfoLevel,
+		},
+		{
+			name:   "live",
+			change: func(c *config.Configuration) { c.LogLevel = "debug" },
+			want:   []string{"log_level"},
+			level:  log.DebugLevel,
+		},
+		{
+			name:   "unchanged",
+			change: func(c *config.Configuration) { c.LogLevel = "debug" },
+			level:  log.DebugLevel,
+		},
+	}
+	var loaded *config.Configuration
+	r := NewReloader(func() (*config.Configuration, error) {
+		return loaded, nil
+	}, nil, nil, nil)
+	for _, tt := range tests {
+		loaded = testConfig()
+		tt.change(loaded)
+		changes, err := r.Reload()
+		if len(tt.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("%s: error = %v, want %q", tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		} else {
+			var fields []string
+			for _, c := range changes {
+				fields = append(fields, c.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("%s: changed %v, want %v", tt.name, fields, tt.want)
+			}
+		}
+		if level := log.GetLevel(); level != tt.level {
+			t.Fatalf("%s: log level %v, want %v", tt.name, level, tt.level)
+		}
+	}
+}
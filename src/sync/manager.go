@@ -1,6 +1,8 @@
 package sync
 
 import (
+	"context"
+	"sort"
 	"sync"
 	"github.com/mmpei/janus/src/config"
 	"time"
@@ -10,124 +12,131 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/mmpei/janus/src/model"
 	"encoding/json"
+	"strings"
+	"github.com/mmpei/janus/src/event"
 )
 
 type EndpointInfo struct {
 	Master bool
+	// replication lag in seconds, optionally reported by replicas
+	Lag *float64
 }
 
+// MonitorManager monitors the endpoints and tracks which of them reports to be master
 type MonitorManager struct {
 	sync.Mutex
-	monitor Monitor
-	config  *config.SyncConfig
+	monitor *Monitor
+	client  *http.Client
 
 	// store whether ep is a master
 	epStatus map[string]bool
 	hookFunc func(peerId string, master bool)
 
-	stopped bool
-	stopChan map[string]chan bool
+	proxiedPort int
+	// guards the membership changes, but not the epStatus lock, because removing
+	// a backend waits for its check which updates epStatus
+	memberLock     sync.Mutex
+	// version of the backends membership, and the file to persist it
+	version        int64
+	membershipFile string
 }
 
 func NewMonitorManager(endpoints []string, proxiedPort int, monitorConfig *config.SyncConfig) *MonitorManager {
-	return &MonitorManager{
-		monitor: *NewMonitor(endpoints, proxiedPort, monitorConfig),
-		stopChan: make(map[string]chan bool, len(endpoints)),
-		stopped: true,
+	mm := &MonitorManager{
+		monitor: NewMonitor(endpoints, proxiedPort, monitorConfig),
 		epStatus: make(map[string]bool, len(endpoints)),
-		config: monitorConfig,
+		proxiedPort: proxiedPort,
+		client: &http.Client{},
 	}
+	mm.monitor.SetCheckFunc(mm.check)
+	mm.monitor.SetKind("backend")
+	return mm
 }
 
 func (mm *MonitorManager) Get(peerId string) *model.PeerInfo {
 	return mm.monitor.Get(peerId)
 }
 
-func (mm *MonitorManager) Run() error {
-	client := http.Client{
-		Timeout: time.Duration(mm.config.Timeout)*time.Second,
+// check requests the endpoint once and ticks the monitor with the result
+func (mm *MonitorManager) check(ctx context.Context, peer *model.PeerInfo) bool {
+	cfg := mm.monitor.Config()
+	url := fmt.Sprintf("http://%s%s", peer.PeerAddr, cfg.URL)
+	log.Debugf("monitoring manager : %s", url)
+	// timeout per request, so that reloading the config takes effect
+	reqCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.Timeout))
+	defer cancel()
+	request, err := http.NewRequestWithContext(reqCtx, "GET", url, nil)
+	if err != nil {
+		log.Errorf("monitoring manager generate http request error: %v", err)
+		return false
 	}
-	peers := mm.monitor.GetAll()
-	for index := range peers {
-		peer := peers[index]
-		if _, ok := mm.stopChan[peer.PeerId]; !ok {
-			mm.stopChan[peer.PeerId] = make(chan bool, 1)
+	start := time.Now()
+	resp, err := mm.client.Do(request)
+	latency := time.Since(start)
+	if ctx.Err() != nil { // stopped while checking, the result means nothing
+		if err == nil {
+			resp.Body.Close()
 		}
-		go func() {
-			ticker := time.NewTicker(time.Duration(mm.config.Interval)*time.Second)
-			stop := mm.stopChan[peer.PeerId]
-			defer ticker.Stop()
-Loop:
-			for {
-				select {
-				case <-ticker.C:
-					url := fmt.Sprintf("http://%s%s", peer.PeerAddr, mm.config.URL)
-					log.Debugf("monitoring manager : %s", url)
-					request, err := http.NewRequest("GET", url, nil)
-					if err != nil {
-						log.Errorf("monitoring manager generate http request error: %v", err)
-						continue
-					}
-					resp, err := client.Do(request)
-					if err != nil { // set remote peer failed
-						mm.monitor.Tick(peer.PeerId, false)
-						log.Errorf("monitoring manager http failed: %v", err)
-						continue
-					}
-					if resp.StatusCode != http.StatusOK {
-						mm.monitor.Tick(peer.PeerId, false)
-						log.Errorf("monitoring manager http failed: response code = %d", resp.StatusCode)
-						continue
-					}
-					body, err := ioutil.ReadAll(resp.Body)
-					if err != nil {
-						mm.monitor.Tick(peer.PeerId, false)
-						log.Errorf("monitoring manager http failed: read body failed %v", err)
-						continue
-					}
-
-					respInfo := &EndpointInfo{}
-					if err := json.Unmarshal(body, respInfo); err != nil {
-						mm.monitor.Tick(peer.PeerId, false)
-						log.Errorf("monitoring manager http failed: decode response body failed %v", err)
-						continue
-					}
-					mm.monitor.Tick(peer.PeerId, true)
-					mm.CheckEPStatus(peer.PeerId, respInfo)
-				case <-stop:
-					log.Infof("stop monitor %s", peer.PeerId)
-					break Loop
-				}
-			}
-		}()
+		return true
+	}
+	if err != nil { // set remote peer failed
+		mm.monitor.Tick(peer.PeerId, false, 0, err.Error())
+		log.Errorf("monitoring manager http failed: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		mm.monitor.Tick(peer.PeerId, false, 0, fmt.Sprintf("response code = %d", resp.StatusCode))
+		log.Errorf("monitoring manager http failed: response code = %d", resp.StatusCode)
+		return false
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		mm.monitor.Tick(peer.PeerId, false, 0, fmt.Sprintf("read body failed %v", err))
+		log.Errorf("monitoring manager http failed: read body failed %v", err)
+		return false
 	}
-	return nil
-}
-
-func (mm *MonitorManager) Stop() error {
-	mm.Lock()
-	defer mm.Unlock()
 
-	if mm.stopped {
-		log.Warningf("endpoints monitoring already in stopped status.")
-		return nil
+	respInfo := &EndpointInfo{}
+	if err := json.Unmarshal(body, respInfo); err != nil {
+		mm.monitor.Tick(peer.PeerId, false, 0, fmt.Sprintf("decode response body failed %v", err))
+		log.Errorf("monitoring manager http failed: decode response body failed %v", err)
+		return false
 	}
-	for _, v := range mm.stopChan {
-		v<-true
+	checkLatency.Observe(latency.Seconds(), peer.PeerId)
+	mm.monitor.Tick(peer.PeerId, true, latency, "check succeeded")
+	lag := time.Duration(-1)
+	if respInfo.Lag != nil {
+		lag = time.Duration(*respInfo.Lag * float64(time.Second))
 	}
-	mm.stopped = true
-	return nil
+	mm.monitor.SetLag(peer.PeerId, lag)
+	mm.CheckEPStatus(peer.PeerId, respInfo)
+	return true
 }
 
+// Stop stops monitoring the endpoints, it returns after all the checks exit
+func (mm *MonitorManager) Stop() error {
+	return mm.monitor.Stop()
+}
+
+// Start starts monitoring the endpoints
 func (mm *MonitorManager) Start() error {
-	mm.Lock()
-	defer mm.Unlock()
-	if !mm.stopped {
-		log.Warningf("endpoints monitoring already in running status.")
-		return nil
-	}
-	mm.stopped = false
-	return mm.Run()
+	return mm.monitor.Start()
+}
+
+// Restart restarts monitoring the endpoints
+func (mm *MonitorManager) Restart() error {
+	return mm.monitor.Restart()
+}
+
+// SetConfig replaces the monitor config, it takes effect after restarting
+func (mm *MonitorManager) SetConfig(c *config.SyncConfig) {
+	mm.monitor.SetConfig(c)
+}
+
+// IsRunning returns whether the endpoints are being monitored
+func (mm *MonitorManager) IsRunning() bool {
+	return mm.monitor.IsRunning()
 }
 
 func (mm *MonitorManager) SetHealthHookFunc(f func(peerId string)) {
@@ -139,6 +148,8 @@ func (mm *MonitorManager) SetStatusHookFunc(f func(peerId string, master bool))
 }
 
 func (mm *MonitorManager) CheckEPStatus(peerId string, epInfo *EndpointInfo) {
+	mm.Lock()
+	defer mm.Unlock()
 	master := epInfo.Master
 	ms, ok := mm.epStatus[peerId]
 	if (!ok || ms != master) && mm.monitor.IsHealth(peerId) {
@@ -154,6 +165,176 @@ func (mm *MonitorManager) SetEPStatus(peerId string, master bool) {
 	mm.epStatus[peerId] = master
 }
 
+// IsHealth returns whether the endpoint is alive
+func (mm *MonitorManager) IsHealth(peerId string) bool {
+	return mm.monitor.IsHealth(peerId)
+}
+
 func (mm *MonitorManager) GetHealthy() []*model.PeerInfo {
 	return mm.monitor.GetHealthy()
 }
+
+// GetCandidates returns the endpoints which could be elected as master
+func (mm *MonitorManager) GetCandidates() []*model.PeerInfo {
+	return mm.monitor.GetCandidates()
+}
+
+// LatencyStats returns the check latency percentiles of the endpoint
+func (mm *MonitorManager) LatencyStats(peerId string) model.LatencyStats {
+	return mm.monitor.LatencyStats(peerId)
+}
+
+// GetAll returns all the endpoints
+func (mm *MonitorManager) GetAll() []*model.PeerInfo {
+	return mm.monitor.GetAll()
+}
+
+// Snapshot returns a copy of all the endpoints, safe to read while monitoring
+func (mm *MonitorManager) Snapshot() []model.PeerInfo {
+	return mm.monitor.Snapshot()
+}
+
+// History returns the state and the recent transitions of the endpoint
+func (mm *MonitorManager) History(peerId string) (*model.PeerHistory, error) {
+	return mm.monitor.History(peerId)
+}
+
+// LoadMembership restores the backends changed at runtime from file, and persists
+// the later changes into it
+func (mm *MonitorManager) LoadMembership(file string) error {
+	mm.membershipFile = file
+	ms, err := LoadMembership(file)
+	if err != nil {
+		return err
+	}
+	if ms == nil {
+		return nil
+	}
+	log.Infof("restore backends from %s: %v", file, ms.Backends)
+	mm.ApplyMembership(ms, "")
+	return nil
+}
+
+// Membership returns the current backends and the version of them
+func (mm *MonitorManager) Membership() *Membership {
+	mm.memberLock.Lock()
+	defer mm.memberLock.Unlock()
+	return mm.membership()
+}
+
+func (mm *MonitorManager) membership() *Membership {
+	ms := &Membership{
+		Version: mm.version,
+	}
+	for _, peer := range mm.monitor.GetAll() {
+		ms.Backends = append(ms.Backends, peer.PeerAddr)
+	}
+	sort.Strings(ms.Backends)
+	return ms
+}
+
+// AddEndpoint adds a backend and starts monitoring it if running
+func (mm *MonitorManager) AddEndpoint(peerAddr string) error {
+	mm.memberLock.Lock()
+	defer mm.memberLock.Unlock()
+	if _, err := mm.monitor.AddPeer(peerAddr, mm.proxiedPort); err != nil {
+		return err
+	}
+	log.Infof("backend %s added", peerAddr)
+	mm.membershipChanged(mm.version + 1)
+	return nil
+}
+
+// RemoveEndpoint stops monitoring the backend and removes it
+func (mm *MonitorManager) RemoveEndpoint(peerId string) error {
+	mm.memberLock.Lock()
+	defer mm.memberLock.Unlock()
+	if err := mm.monitor.RemovePeer(peerId); err != nil {
+		return err
+	}
+	mm.deleteEPStatus(peerId)
+	checkLatency.Delete(peerId)
+	log.Infof("backend %s removed", peerId)
+	mm.membershipChanged(mm.version + 1)
+	return nil
+}
+
+// ApplyMembership reconciles the backends with a newer membership, keep is never
+// removed since it is the master. It returns whether the membership is applied.
+// The version is a logical counter, both nodes change it from the one they have
+// seen, so the clocks do not matter. The same version changed by both nodes at
+// once is ordered by the backends.
+func (mm *MonitorManager) ApplyMembership(ms *Membership, keep string) bool {
+	mm.memberLock.Lock()
+	defer mm.memberLock.Unlock()
+	if ms == nil || ms.Version < mm.version {
+		return false
+	}
+	if ms.Version == mm.version && !laterBackends(ms.Backends, mm.membership().Backends) {
+		return false
+	}
+
+	version := ms.Version
+
+	wanted := make(map[string]bool, len(ms.Backends))
+	for _, addr := range ms.Backends {
+		wanted[addr] = true
+	}
+	for _, peer := range mm.monitor.GetAll() {
+		if wanted[peer.PeerId] {
+			delete(wanted, peer.PeerId)
+			continue
+		}
+		if peer.PeerId == keep {
+			log.Warningf("backend %s is the master, keep it", peer.PeerId)
+			// the membership kept differs, it goes back to the other node
+			version = ms.Version + 1
+			continue
+		}
+		if err := mm.monitor.RemovePeer(peer.PeerId); err != nil {
+			log.Errorf("remove backend %s error: %v", peer.PeerId, err)
+			continue
+		}
+		mm.deleteEPStatus(peer.PeerId)
+		checkLatency.Delete(peer.PeerId)
+		log.Infof("backend %s removed", peer.PeerId)
+	}
+	for addr := range wanted {
+		if _, err := mm.monitor.AddPeer(addr, mm.proxiedPort); err != nil {
+			log.Errorf("add backend %s error: %v", addr, err)
+			continue
+		}
+		log.Infof("backend %s added", addr)
+	}
+	mm.membershipChanged(version)
+	return true
+}
+
+// laterBackends orders the different backends of the same version
+func laterBackends(backends, current []string) bool {
+	sorted := append([]string(nil), backends...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",") > strings.Join(current, ",")
+}
+
+func (mm *MonitorManager) deleteEPStatus(peerId string) {
+	mm.Lock()
+	defer mm.Unlock()
+	delete(mm.epStatus, peerId)
+}
+
+// membershipChanged updates the version and persists the membership, memberLock should be held
+func (mm *MonitorManager) membershipChanged(version int64) {
+	mm.version = version
+	ms := mm.membership()
+	event.Publish(event.EventMembershipChange, "", fmt.Sprintf("backends changed: %v", ms.Backends), map[string]string{
+		"backends": strings.Join(ms.Backends, ","),
+		"version": fmt.Sprint(version),
+	})
+	if len(mm.membershipFile) == 0 {
+		return
+	}
+	if err := ms.Save(mm.membershipFile); err != nil {
+		log.Errorf("save backends into %s error: %v", mm.membershipFile, err)
+	}
+}
@@ -0,0 +1,55 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Membership is the set of backends changed at runtime. The version counts the
+// changes seen by the two janus nodes, the higher one wins when syncing.
+type Membership struct {
+	Version  int64    `yaml:"version"`
+	Backends []string `yaml:"backends"`
+}
+
+// LoadMembership reads the membership saved in file, it returns nil if the file
+// does not exist
+func LoadMembership(file string) (*Membership, error) {
+	buffer, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ms := &Membership{}
+	if err := yaml.Unmarshal(buffer, ms); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// Save writes the membership into file atomically
+func (ms *Membership) Save(file string) error {
+	buffer, err := yaml.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buffer); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
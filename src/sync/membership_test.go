@@ -0,0 +1,126 @@
+package sync
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestApplyMembership(t *testing.T) {
+	tests := []struct {
+		name    string
+		ms      *Membership
+		keep    string
+		applied bool
+		want    *Membership
+	}{
+		{
+			name: "nil",
+			want: &Membership{Version: 1, Backends: []string{"a:1", "b:1"}},
+		},
+		{
+			name: "older",
+			ms:   &Membership{Version: 0, Backends: []string{"c:1"}},
+			want: &Membership{Version: 1, Backends: []string{"a:1", "b:1"}},
+		},
+		{
+			name:    "newer",
+			ms:      &Membership{Version: 2, Backends: []string{"c:1", "a:1"}},
+			applied: true,
+			want:    &Membership{Version: 2, Backends: []string{"a:1", "c:1"}},
+		},
+		{
+			name:    "newer without the master",
+			ms:      &Membership{Version: 2, Backends: []string{"c:1", "a:1"}},
+			keep:    "b:1",
+			applied: true,
+			// the master kept differs, the version goes up to win back
+			want: &Membership{Version: 3, Backends: []string{"a:1", "b:1", "c:1"}},
+		},
+		{
+			name: "same",
+			ms:   &Membership{Version: 1, Backends: []string{"b:1", "a:1"}},
+			want: &Membership{Version: 1, Backends: []string{"a:1", "b:1"}},
+		},
+		{
+			name:    "same version ordered later",
+			ms:      &Membership{Version: 1, Backends: []string{"b:1", "c:1"}},
+			applied: true,
+			want:    &Membership{Version: 1, Backends: []string{"b:1", "c:1"}},
+		},
+		{
+			name: "same version ordered earlier",
+			ms:   &Membership{Version: 1, Backends: []string{"a:1"}},
+			want: &Membership{Version: 1, Backends: []string{"a:1", "b:1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm := NewMonitorManager([]string{"a:1", "b:1"}, 0, testSyncConfig())
+			mm.ApplyMembership(&Membership{Version: 1, Backends: []string{"a:1", "b:1"}}, "")
+			if applied := mm.ApplyMembership(tt.ms, tt.keep); applied != tt.applied {
+				t.Fatalf("applied = %v, want %v", applied, tt.applied)
+			}
+			if ms := mm.Membership(); !reflect.DeepEqual(ms, tt.want) {
+				t.Fatalf("membership = %+v, want %+v", ms, tt.want)
+			}
+		})
+	}
+}
+
+func TestMembershipEndpoints(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "backends.yaml")
+	mm := NewMonitorManager([]string{"a:1"}, 0, testSyncConfig())
+	if err := mm.LoadMembership(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.AddEndpoint("b:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.AddEndpoint("b:1"); err != ErrPeerExists {
+		t.Fatalf("add again = %v, want %v", err, ErrPeerExists)
+	}
+	if err := mm.RemoveEndpoint("a:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.RemoveEndpoint("a:1"); err != ErrPeerNotFound {
+		t.Fatalf("remove again = %v, want %v", err, ErrPeerNotFound)
+	}
+	want := &Membership{Version: 2, Backends: []string{"b:1"}}
+	if ms := mm.Membership(); !reflect.DeepEqual(ms, want) {
+		t.Fatalf("membership = %+v, want %+v", ms, want)
+	}
+
+	// the changes are restored from the file
+	restored := NewMonitorManager([]string{"a:1"}, 0, testSyncConfig())
+	if err := restored.LoadMembership(file); err != nil {
+		t.Fatal(err)
+	}
+	if ms := restored.Membership(); !reflect.DeepEqual(ms, want) {
+		t.Fatalf("restored membership = %+v, want %+v", ms, want)
+	}
+}
+
+func TestMonitorAddRemovePeer(t *testing.T) {
+	m := NewMonitor([]string{"127.0.0.1:9090"}, 0, testSyncConfig())
+	c := &counter{checks: map[string]int{}}
+	m.SetCheckFunc(c.check)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	if _, err := m.AddPeer("127.0.0.1:9091", 0); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "added peer checked", func() bool { return c.get("127.0.0.1:9091") > 0 })
+
+	if err := m.RemovePeer("127.0.0.1:9091"); err != nil {
+		t.Fatal(err)
+	}
+	removed := c.get("127.0.0.1:9091")
+	eventually(t, "other peer checked", func() bool { return c.get("127.0.0.1:9090") > 2 })
+	if n := c.get("127.0.0.1:9091"); n != removed || m.Get("127.0.0.1:9091") != nil {
+		t.Fatalf("removed peer checked %d times more, found %v", n-removed, m.Get("127.0.0.1:9091") != nil)
+	}
+}
@@ -0,0 +1,87 @@
+package sync
+
+import (
+	"time"
+
+	"github.com/mmpei/janus/src/metrics"
+)
+
+var (
+	syncTotal = metrics.NewCounterVec("janus_sync_total",
+		"Sync round trips with the peer janus by result.", "result")
+	syncLatency = metrics.NewHistogramVec("janus_sync_latency_seconds",
+		"Round trip time of successful syncs with the peer janus.", metrics.DefaultBuckets)
+	checkLatency = metrics.NewHistogramVec("janus_backend_check_latency_seconds",
+		"Round trip time of successful backend checks.", metrics.DefaultBuckets, "backend")
+	electionsTotal = metrics.NewCounterVec("janus_elections_total",
+		"Elections of the backend master by result.", "result")
+	roleChangesTotal = metrics.NewCounterVec("janus_role_change_calls_total",
+		"Calls to change the backend role by role and result.", "role", "result")
+)
+
+// RegisterMetrics exposes the state kept by the sync manager, the sentinel and
+// the backends monitor, they are read when scraping
+func RegisterMetrics(sm *SyncManager, mm *MonitorManager) {
+	metrics.NewGaugeFunc("janus_sentinel_master",
+		"Whether this janus is the sentinel master.", nil,
+		func(emit func(v float64, values ...string)) {
+			emit(boolValue(sm.IsMaster()))
+		})
+	metrics.NewGaugeFunc("janus_backend_master",
+		"Whether the backend is the master known by this janus.", []string{"backend"},
+		func(emit func(v float64, values ...string)) {
+			master := sm.GetEPMaster()
+			for _, peer := range mm.Snapshot() {
+				emit(boolValue(peer.PeerId == master), peer.PeerId)
+			}
+		})
+	metrics.NewGaugeFunc("janus_backend_alive",
+		"Whether the backend is alive after the failure and recover thresholds.", []string{"backend"},
+		func(emit func(v float64, values ...string)) {
+			for _, peer := range mm.Snapshot() {
+				emit(boolValue(peer.Alive), peer.PeerId)
+			}
+		})
+	metrics.NewGaugeFunc("janus_backend_healthy",
+		"Whether the last check of the backend succeeded.", []string{"backend"},
+		func(emit func(v float64, values ...string)) {
+			for _, peer := range mm.Snapshot() {
+				emit(boolValue(peer.Success), peer.PeerId)
+			}
+		})
+	metrics.NewGaugeFunc("janus_backend_check_count",
+		"Continuous checks with the same result of the backend.", []string{"backend"},
+		func(emit func(v float64, values ...string)) {
+			for _, peer := range mm.Snapshot() {
+				emit(float64(peer.Count), peer.PeerId)
+			}
+		})
+	metrics.NewGaugeFunc("janus_backend_flapping",
+		"Whether the backend is flapping.", []string{"backend"},
+		func(emit func(v float64, values ...string)) {
+			for _, peer := range mm.Snapshot() {
+				emit(boolValue(peer.Flapping), peer.PeerId)
+			}
+		})
+	metrics.NewGaugeFunc("janus_backend_degraded",
+		"Whether the backend is degraded by slow checks.", []string{"backend"},
+		func(emit func(v float64, values ...string)) {
+			for _, peer := range mm.Snapshot() {
+				emit(boolValue(peer.Degraded), peer.PeerId)
+			}
+		})
+	metrics.NewGaugeFunc("janus_seconds_since_last_sync",
+		"Seconds since the last successful sync with the peer janus, absent if never synced.", nil,
+		func(emit func(v float64, values ...string)) {
+			if last := sm.LastSync(); !last.IsZero() {
+				emit(time.Since(last).Seconds())
+			}
+		})
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
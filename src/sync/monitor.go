@@ -7,19 +7,52 @@ import (
 	log "github.com/sirupsen/logrus"
 	"fmt"
 	"time"
-	"net/http"
-	"io/ioutil"
+	"sort"
+	"context"
+	"errors"
+	"github.com/mmpei/janus/src/event"
 )
 
+var (
+	ErrPeerNotFound = errors.New("PeerNotFoundError")
+	ErrPeerExists   = errors.New("PeerExistsError")
+)
+
+// CheckFunc checks the peer once and reports the result by Monitor.Tick,
+// it returns false when the check failed. ctx is done when the monitor stops.
+type CheckFunc func(ctx context.Context, peer *model.PeerInfo) bool
+
+// Monitor keeps the status of peers, and checks each of them in its own goroutine
+// while running
 type Monitor struct {
 	sync.Mutex
 	peers       map[string]*model.PeerInfo
+	// kind of the peers in the events, backend or janus
+	kind        string
 
+	// config is replaced by SetConfig but never changed in place
 	config      *config.SyncConfig
 
 	hookFunc    func(peerId string)
+	checkFunc   CheckFunc
+
+	// lifecycle, guarded by runLock but not the peers lock, because stopping
+	// waits for the check goroutines which tick the peers
+	runLock     sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	runners     map[string]*runner
+}
+
+// runner is the check goroutine of a peer
+type runner struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
 
-	stop 	    chan bool
+func (r *runner) stop() {
+	r.cancel()
+	<-r.done
 }
 
 func NewMonitor(peerAddrs []string, proxiedPort int, c *config.SyncConfig) *Monitor {
@@ -28,71 +61,160 @@ func NewMonitor(peerAddrs []string, proxiedPort int, c *config.SyncConfig) *Moni
 		peer := model.NewPeer(peerAddr, proxiedPort)
 		peers[peer.PeerId] = peer
 	}
+	cfg := *c
 	return &Monitor{
 		peers: peers,
-		config: c,
-		stop: make(chan bool),
+		config: &cfg,
+		runners: make(map[string]*runner),
 	}
 }
 
+// SetConfig replaces the config by a copy of c, the running checks keep their
+// schedule until restarted
+func (m *Monitor) SetConfig(c *config.SyncConfig) {
+	cfg := *c
+	m.Lock()
+	defer m.Unlock()
+	m.config = &cfg
+}
+
+// Config returns the current config, which should not be changed
+func (m *Monitor) Config() *config.SyncConfig {
+	m.Lock()
+	defer m.Unlock()
+	return m.config
+}
+
 func (m *Monitor) SetHookFunc(f func(peerId string)) {
 	m.hookFunc = f
 }
 
-func (m *Monitor) Start() {
+func (m *Monitor) SetCheckFunc(f CheckFunc) {
+	m.checkFunc = f
+}
+
+func (m *Monitor) SetKind(kind string) {
+	m.kind = kind
 }
 
-func (m *Monitor) Stop() {
-	for range m.peers {
-		m.stop <- true
+// Start runs a check goroutine for every peer
+func (m *Monitor) Start() error {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+	if m.cancel != nil {
+		log.Warningf("monitoring already in running status.")
+		return nil
+	}
+	if m.checkFunc == nil {
+		return fmt.Errorf("no check function for monitoring")
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	for _, peer := range m.GetAll() {
+		m.startPeer(peer)
 	}
+	return nil
 }
 
-// Run monitoring, not use for now
-func (m *Monitor) Run() error {
-	client := http.Client{
-		Timeout: time.Duration(m.config.Timeout)*time.Second,
+// Stop cancels the running checks and waits for all the check goroutines to exit
+func (m *Monitor) Stop() error {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+	if m.cancel == nil {
+		log.Warningf("monitoring already in stopped status.")
+		return nil
+	}
+	m.cancel()
+	for peerId, r := range m.runners {
+		r.stop()
+		delete(m.runners, peerId)
 	}
+	m.ctx, m.cancel = nil, nil
+	return nil
+}
 
-	for k := range m.peers {
-		peer := m.peers[k]
-		go func() {
-			ticker := time.NewTicker(time.Duration(m.config.Interval)*time.Second)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					url := fmt.Sprintf("http://%s/%s", peer.PeerAddr, m.config.URL)
-					request, err := http.NewRequest("GET", url, nil)
-					if err != nil {
-						log.Errorf("monitoring generate http request error: %v", err)
-						continue
-					}
-					resp, err := client.Do(request)
-					if err != nil { // set remote peer failed
-						m.Tick(peer.PeerId, false)
-						log.Errorf("monitoring http failed: %v", err)
-						continue
-					}
-					if m.config.CheckCode && (resp.StatusCode > 299 || resp.StatusCode < 200) {
-						m.Tick(peer.PeerId, false)
-						log.Errorf("monitoring http failed: response code = %d", resp.StatusCode)
-						continue
-					}
-					ioutil.ReadAll(resp.Body)
-					m.Tick(peer.PeerId, true)
-				case stop := <-m.stop:
-					if stop {
-						log.Infof("stop monitoring peer: %s", peer.PeerId)
-						return
-					}
-				}
-			}
-		}()
+// Restart stops the checks and starts them again, it picks up the config changes
+func (m *Monitor) Restart() error {
+	if err := m.Stop(); err != nil {
+		return err
 	}
+	return m.Start()
+}
+
+// IsRunning returns whether the checks are running
+func (m *Monitor) IsRunning() bool {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+	return m.cancel != nil
+}
+
+// AddPeer adds a peer and starts checking it if the monitor is running
+func (m *Monitor) AddPeer(peerAddr string, proxiedPort int) (*model.PeerInfo, error) {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	peer := model.NewPeer(peerAddr, proxiedPort)
+	m.Lock()
+	if _, ok := m.peers[peer.PeerId]; ok {
+		m.Unlock()
+		return nil, ErrPeerExists
+	}
+	m.peers[peer.PeerId] = peer
+	m.Unlock()
+
+	if m.cancel != nil {
+		m.startPeer(peer)
+	}
+	return peer, nil
+}
+
+// RemovePeer stops checking the peer and removes it
+func (m *Monitor) RemovePeer(peerId string) error {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	if r, ok := m.runners[peerId]; ok {
+		r.stop()
+		delete(m.runners, peerId)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.peers[peerId]; !ok {
+		return ErrPeerNotFound
+	}
+	delete(m.peers, peerId)
 	return nil
 }
 
+// startPeer runs the check goroutine of the peer, runLock should be held
+func (m *Monitor) startPeer(peer *model.PeerInfo) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	r := &runner{
+		cancel: cancel,
+		done: make(chan struct{}),
+	}
+	m.runners[peer.PeerId] = r
+	go func() {
+		defer close(r.done)
+		m.run(ctx, peer)
+	}()
+}
+
+func (m *Monitor) run(ctx context.Context, peer *model.PeerInfo) {
+	sched := newSchedule(m.Config())
+	timer := time.NewTimer(sched.First())
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Infof("stop monitoring peer: %s", peer.PeerId)
+			return
+		case <-timer.C:
+		}
+		sched.Observe(m.checkFunc(ctx, peer))
+		timer.Reset(sched.Next())
+	}
+}
+
 // GetHealthy returns healthy peers
 func (m *Monitor) GetHealthy() []*model.PeerInfo {
 	m.Lock()
@@ -107,13 +229,46 @@ func (m *Monitor) GetHealthy() []*model.PeerInfo {
 	return healthy
 }
 
+// GetCandidates returns healthy peers which are not flapping, they could be elected.
+// Peers which are not degraded come first.
+func (m *Monitor) GetCandidates() []*model.PeerInfo {
+	m.Lock()
+	defer m.Unlock()
+	var candidates []*model.PeerInfo
+	for id := range m.peers {
+		peer := m.peers[id]
+		if peer.Alive && !peer.Flapping {
+			candidates = append(candidates, peer)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return !candidates[i].Degraded && candidates[j].Degraded
+	})
+	return candidates
+}
+
+// LatencyStats returns the check latency percentiles of the peer
+func (m *Monitor) LatencyStats(peerId string) model.LatencyStats {
+	m.Lock()
+	defer m.Unlock()
+	peer, ok := m.peers[peerId]
+	if !ok {
+		return model.LatencyStats{}
+	}
+	return peer.LatencyStats()
+}
+
 // Get
 func (m *Monitor) Get(peerId string) *model.PeerInfo {
+	m.Lock()
+	defer m.Unlock()
 	return m.peers[peerId]
 }
 
 // GetAll
 func (m *Monitor) GetAll() []*model.PeerInfo {
+	m.Lock()
+	defer m.Unlock()
 	var ps []*model.PeerInfo
 	for k := range m.peers {
 		ps = append(ps, m.peers[k])
@@ -121,27 +276,96 @@ func (m *Monitor) GetAll() []*model.PeerInfo {
 	return ps
 }
 
-// Tick used to modify the peer status when monitoring is triggered external
-func (m *Monitor) Tick(peerId string, success bool) error {
-	peer, ok := m.peers[peerId]
-	if !ok {
-		log.Errorf("could not find the specified peer")
-		return fmt.Errorf("PeerNotFoundError")
+// Snapshot returns a copy of all the peers sorted by id
+func (m *Monitor) Snapshot() []model.PeerInfo {
+	m.Lock()
+	defer m.Unlock()
+	ps := make([]model.PeerInfo, 0, len(m.peers))
+	for _, peer := range m.peers {
+		ps = append(ps, *peer)
 	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].PeerId < ps[j].PeerId
+	})
+	return ps
+}
 
+// Tick used to modify the peer status when monitoring is triggered external,
+// latency is the round trip time of a successful check and reason describes the
+// check result which is kept in the peer history
+func (m *Monitor) Tick(peerId string, success bool, latency time.Duration, reason string) error {
 	m.Lock()
 	defer m.Unlock()
 
+	peer, ok := m.peers[peerId]
+	if !ok {
+		log.Errorf("could not find the specified peer")
+		return ErrPeerNotFound
+	}
+
 	alive := peer.Alive
+	state := peer.State()
 	peer.Tick(success, m.getCount(success))
-	if alive != peer.Alive && m.hookFunc != nil { // do hooking
+	flap := m.config.Flap
+	if r := peer.Observe(success, flap.Window, flap.High, flap.Low); len(r) > 0 {
+		log.Warningf("peer %s flapping changed to %t: %s", peerId, peer.Flapping, r)
+		reason = r
+	}
+	degrade := m.config.Degrade
+	failed := false
+	if success {
+		threshold := time.Duration(degrade.ThresholdMs)*time.Millisecond
+		if r := peer.ObserveLatency(latency, threshold, degrade.Count); len(r) > 0 {
+			log.Warningf("peer %s degraded changed to %t: %s", peerId, peer.Degraded, r)
+			reason = r
+		}
+		// persistently degraded, let the hook treat it as failed
+		failed = peer.Degraded && degrade.FailMasterAfter > 0 && peer.DegradedCount == degrade.FailMasterAfter
+	}
+	if s := peer.State(); s != state {
+		peer.AddTransition(state, s, reason)
+		event.Publish(event.EventHealthChange, peerId, fmt.Sprintf("%s %s changed from %s to %s", m.kind, peerId, state, s), map[string]string{
+			"kind": m.kind,
+			"from": state,
+			"to": s,
+			"reason": reason,
+		})
+	}
+	if (alive != peer.Alive || failed) && m.hookFunc != nil { // do hooking
 		go m.hookFunc(peerId)
 	}
 
 	return nil
 }
 
+// SetLag sets the replication lag reported by the peer, negative if not reported
+func (m *Monitor) SetLag(peerId string, lag time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if peer, ok := m.peers[peerId]; ok {
+		peer.Lag = lag
+	}
+}
+
+// History returns the recent transitions of the peer
+func (m *Monitor) History(peerId string) (*model.PeerHistory, error) {
+	m.Lock()
+	defer m.Unlock()
+	peer, ok := m.peers[peerId]
+	if !ok {
+		return nil, ErrPeerNotFound
+	}
+	return &model.PeerHistory{
+		PeerId:      peerId,
+		State:       peer.State(),
+		Flapping:    peer.Flapping,
+		Transitions: peer.History(),
+	}, nil
+}
+
 func (m *Monitor) IsHealth(peerId string) bool {
+	m.Lock()
+	defer m.Unlock()
 	peer, ok := m.peers[peerId]
 	if !ok {
 		return false
@@ -0,0 +1,137 @@
+package sync
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/model"
+)
+
+// counter counts the checks of each peer
+type counter struct {
+	lock   sync.Mutex
+	checks map[string]int
+}
+
+func (c *counter) check(ctx context.Context, peer *model.PeerInfo) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checks[peer.PeerId]++
+	return true
+}
+
+func (c *counter) get(peerId string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.checks[peerId]
+}
+
+func testSyncConfig() *config.SyncConfig {
+	return &config.SyncConfig{
+		Interval: config.Duration(5 * time.Millisecond),
+		Failure:  config.MonitorConfig{Count: 2},
+		Recover:  config.MonitorConfig{Count: 1},
+	}
+}
+
+// eventually waits the condition for a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("%s not met after a second", what)
+}
+
+func TestMonitorStartStop(t *testing.T) {
+	peers := []string{"127.0.0.1:9090", "127.0.0.1:9091"}
+	m := NewMonitor(peers, 0, testSyncConfig())
+	if err := m.Start(); err == nil {
+		t.Fatal("started without a check function")
+	}
+	c := &counter{checks: map[string]int{}}
+	m.SetCheckFunc(c.check)
+	for round := 0; round < 2; round++ {
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// started twice is no-op
+		if err := m.Start(); err != nil || !m.IsRunning() {
+			t.Fatalf("round %d: start again = %v, running %v", round, err, m.IsRunning())
+		}
+		first, second := c.get(peers[0]), c.get(peers[1])
+		eventually(t, "every peer checked", func() bool {
+			return c.get(peers[0]) > first && c.get(peers[1]) > second
+		})
+		if err := m.Stop(); err != nil || m.IsRunning() {
+			t.Fatalf("round %d: stop = %v, running %v", round, err, m.IsRunning())
+		}
+		stopped := c.get(peers[0]) + c.get(peers[1])
+		time.Sleep(20 * time.Millisecond)
+		if n := c.get(peers[0]) + c.get(peers[1]); n != stopped {
+			t.Fatalf("round %d: %d checks after stopped", round, n-stopped)
+		}
+	}
+	if err := m.Stop(); err != nil {
+		t.Fatalf("stop again = %v", err)
+	}
+}
+
+func TestMonitorStopCancelsCheck(t *testing.T) {
+	m := NewMonitor([]string{"127.0.0.1:9090"}, 0, testSyncConfig())
+	checking := make(chan struct{}, 1)
+	m.SetCheckFunc(func(ctx context.Context, peer *model.PeerInfo) bool {
+		select {
+		case checking <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return false
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-checking
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop does not cancel the running check")
+	}
+}
+
+func TestMonitorTick(t *testing.T) {
+	tests := []struct {
+		results []bool
+		// alive after each result
+		want []bool
+	}{
+		{[]bool{false, false, true}, []bool{true, false, true}},
+		{[]bool{false, true, false, true}, []bool{true, true, true, true}},
+		{[]bool{true, false, false, false}, []bool{true, true, false, false}},
+	}
+	for _, tt := range tests {
+		m := NewMonitor([]string{"127.0.0.1:9090"}, 0, testSyncConfig())
+		for i, success := range tt.results {
+			if err := m.Tick("127.0.0.1:9090", success, time.Millisecond, "checked"); err != nil {
+				t.Fatal(err)
+			}
+			if alive := m.IsHealth("127.0.0.1:9090"); alive != tt.want[i] {
+				t.Fatalf("%v: alive after check %d = %v, want %v", tt.results, i, alive, tt.want[i])
+			}
+		}
+	}
+	m := NewMonitor(nil, 0, testSyncConfig())
+	if err := m.Tick("127.0.0.1:9090", true, 0, ""); err == nil {
+		t.Error("unknown peer ticked without error")
+	}
+}
@@ -0,0 +1,76 @@
+package sync
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+)
+
+// schedule computes the delay before the next check of a peer
+type schedule struct {
+	config *config.SyncConfig
+	// continuous successful checks, 0 after a failure
+	successes int
+	suspect   bool
+}
+
+func newSchedule(c *config.SyncConfig) *schedule {
+	return &schedule{
+		config: c,
+	}
+}
+
+// Observe records the result of the last check
+func (s *schedule) Observe(success bool) {
+	if success {
+		s.successes++
+		s.suspect = false
+	} else {
+		s.successes = 0
+		s.suspect = true
+	}
+}
+
+// Next returns the delay before the next check
+func (s *schedule) Next() time.Duration {
+	interval := time.Duration(s.config.Interval)
+	adaptive := s.config.Adaptive
+	if adaptive.Enabled {
+		if s.suspect && adaptive.FastInterval > 0 {
+			interval = time.Duration(adaptive.FastInterval)
+		} else if adaptive.StableCount > 0 && s.successes >= adaptive.StableCount && adaptive.SlowInterval > 0 {
+			interval = time.Duration(adaptive.SlowInterval)
+		}
+	}
+	return jitter(interval, s.config.Jitter)
+}
+
+// First returns a random delay within one interval, so the checks of peers
+// started together do not fire in lockstep
+func (s *schedule) First() time.Duration {
+	interval := time.Duration(s.config.Interval)
+	if s.config.Jitter <= 0 || interval <= 0 {
+		return interval
+	}
+	return time.Duration(rand.Int63n(int64(interval))) + 1
+}
+
+// jitter randomizes d by up to fraction of it in both directions
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	delta := int64(float64(d) * fraction)
+	if delta <= 0 {
+		return d
+	}
+	d += time.Duration(rand.Int63n(2*delta+1) - delta)
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	return d
+}
@@ -0,0 +1,97 @@
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+)
+
+func TestJitter(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		fraction float64
+		min, max time.Duration
+	}{
+		{time.Second, 0, time.Second, time.Second},
+		{time.Second, -0.5, time.Second, time.Second},
+		{0, 0.5, 0, 0},
+		{time.Second, 0.1, 900 * time.Millisecond, 1100 * time.Millisecond},
+		// the fraction is at most 1, and the delay stays positive
+		{time.Second, 3, time.Nanosecond, 2 * time.Second},
+		{time.Nanosecond, 0.1, time.Nanosecond, time.Nanosecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 1000; i++ {
+			if d := jitter(tt.d, tt.fraction); d < tt.min || d > tt.max {
+				t.Fatalf("jitter(%v, %v) = %v, want within [%v, %v]", tt.d, tt.fraction, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	adaptive := config.AdaptiveConfig{
+		Enabled:      true,
+		FastInterval: config.Duration(500 * time.Millisecond),
+		SlowInterval: config.Duration(5 * time.Second),
+		StableCount:  3,
+	}
+	tests := []struct {
+		name     string
+		adaptive config.AdaptiveConfig
+		results  []bool
+		// delay after each result
+		want []time.Duration
+	}{
+		{
+			name:     "adaptive",
+			adaptive: adaptive,
+			results:  []bool{true, true, true, true, false, false, true, true, true},
+			want: []time.Duration{
+				time.Second, time.Second, 5 * time.Second, 5 * time.Second,
+				500 * time.Millisecond, 500 * time.Millisecond,
+				time.Second, time.Second, 5 * time.Second,
+			},
+		},
+		{
+			name:     "disabled",
+			adaptive: config.AdaptiveConfig{FastInterval: adaptive.FastInterval, SlowInterval: adaptive.SlowInterval, StableCount: 1},
+			results:  []bool{true, false},
+			want:     []time.Duration{time.Second, time.Second},
+		},
+		{
+			name:     "no slow interval",
+			adaptive: config.AdaptiveConfig{Enabled: true, FastInterval: adaptive.FastInterval, StableCount: 1},
+			results:  []bool{true, false},
+			want:     []time.Duration{time.Second, 500 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSchedule(&config.SyncConfig{
+				Interval: config.Duration(time.Second),
+				Adaptive: tt.adaptive,
+			})
+			for i, success := range tt.results {
+				s.Observe(success)
+				if d := s.Next(); d != tt.want[i] {
+					t.Fatalf("check %d: next = %v, want %v", i, d, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleFirst(t *testing.T) {
+	s := newSchedule(&config.SyncConfig{Interval: config.Duration(time.Second)})
+	if d := s.First(); d != time.Second {
+		t.Errorf("first without jitter = %v, want %v", d, time.Second)
+	}
+	s = newSchedule(&config.SyncConfig{Interval: config.Duration(time.Second), Jitter: 0.1})
+	for i := 0; i < 1000; i++ {
+		if d := s.First(); d <= 0 || d > time.Second {
+			t.Fatalf("first = %v, want within (0, 1s]", d)
+		}
+	}
+}
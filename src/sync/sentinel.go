@@ -8,8 +8,12 @@ import (
 	"github.com/mmpei/janus/src/config"
 	"time"
 	"net/http"
+	"errors"
+	"github.com/mmpei/janus/src/event"
 )
 
+var ErrRemoveMaster = errors.New("could not remove the master, switch over first")
+
 // do monitoring and control the endpoint status.
 type Sentinel struct {
 	sync.Mutex
@@ -18,11 +22,25 @@ type Sentinel struct {
 
 	master string
 	onDuty bool
+
+	// term counts the master changes, the slave takes it from the sentinel master.
+	// changed is closed and replaced whenever the master changes.
+	termLock sync.Mutex
+	term     uint64
+	changed  chan struct{}
+
+	// urls of the backends to change their role, set again by reloading
+	urlLock  sync.Mutex
+	toMaster string
+	toSlave  string
 }
 
 func NewSentinel(m *MonitorManager) *Sentinel {
 	s := &Sentinel{
 		monitor: m,
+		changed: make(chan struct{}),
+		toMaster: config.ProxyConfig.ToMaster,
+		toSlave: config.ProxyConfig.ToSlave,
 	}
 	s.monitor.SetHealthHookFunc(s.HookEndpointHealth)
 	s.monitor.SetStatusHookFunc(s.HookEndpointStatus)
@@ -30,14 +48,58 @@ func NewSentinel(m *MonitorManager) *Sentinel {
 }
 
 func (s *Sentinel) GetMaster() string {
+	s.termLock.Lock()
+	defer s.termLock.Unlock()
 	return s.master
 }
 
+// GetMasterTerm returns the master and its term
+func (s *Sentinel) GetMasterTerm() (string, uint64) {
+	s.termLock.Lock()
+	defer s.termLock.Unlock()
+	return s.master, s.term
+}
+
+// WatchMaster returns the master, its term, and a channel closed when the
+// master changes
+func (s *Sentinel) WatchMaster() (string, uint64, <-chan struct{}) {
+	s.termLock.Lock()
+	defer s.termLock.Unlock()
+	return s.master, s.term, s.changed
+}
+
+// setMaster changes the master, the term is increased unless it is given by the
+// sentinel master
+func (s *Sentinel) setMaster(peerId string, term uint64) {
+	s.termLock.Lock()
+	defer s.termLock.Unlock()
+	if term == 0 {
+		if peerId == s.master {
+			return
+		}
+		term = s.term + 1
+	} else if peerId == s.master && term == s.term {
+		return
+	}
+	s.master = peerId
+	s.term = term
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// SetRoleURLs replaces the urls changing the role of backends
+func (s *Sentinel) SetRoleURLs(toMaster, toSlave string) {
+	s.urlLock.Lock()
+	defer s.urlLock.Unlock()
+	s.toMaster, s.toSlave = toMaster, toSlave
+}
+
 func (s *Sentinel) GetMasterPeer() *model.PeerInfo {
-	if len(s.master) == 0 {
+	master := s.GetMaster()
+	if len(master) == 0 {
 		return nil
 	}
-	return s.monitor.Get(s.master)
+	return s.monitor.Get(master)
 }
 
 func (s *Sentinel) HookEndpointHealth(peerId string) {
@@ -48,18 +110,18 @@ func (s *Sentinel) HookEndpointHealth(peerId string) {
 	}
 	s.Lock()
 	defer s.Unlock()
-	if len(s.master) == 0 {
+	if len(s.GetMaster()) == 0 {
 		//log.Warningf("waiting for init")
 		s.Elect()
 		return
 	}
 
-	if peerId != s.master {
+	if peerId != s.GetMaster() {
 		log.Infof("a slave status changes, do nothing")
 		return
 	}
 
-	// todo master down, re-elect
+	// todo master down or persistently degraded, re-elect
 	s.Elect()
 }
 
@@ -73,9 +135,9 @@ func (s *Sentinel) HookEndpointStatus(peerId string, master bool) {
 
 	s.Lock()
 	ret := false
-	if len(s.master) == 0 {
+	if len(s.GetMaster()) == 0 {
 		if master {
-			s.master = peerId
+			s.setMaster(peerId, 0)
 		}
 		ret = true
 	}
@@ -84,22 +146,34 @@ func (s *Sentinel) HookEndpointStatus(peerId string, master bool) {
 		return
 	}
 
-	if master && peerId != s.master { // the master monitored is different from elected
+	// the backend could be removed while its check was running
+	peer := s.monitor.Get(peerId)
+	if peer == nil {
+		log.Warningf("endpoint %s is removed, ignore its status", peerId)
+		return
+	}
+	elected := s.GetMaster()
+	if master && peerId != elected { // the master monitored is different from elected
 		log.Errorf("there are another master that not my elect %s", peerId)
+		event.Publish(event.EventSplitBrainSuspected, peerId, fmt.Sprintf("backend %s reports master but %s is elected", peerId, elected), map[string]string{
+			"kind": "backend",
+			"elected": elected,
+		})
 		// downgrade
-		if err := s.changeEPRole(s.monitor.Get(peerId), false); err != nil {
-			log.Errorf("downgrade peer %s failed: +v", peerId, err)
+		if err := s.changeEPRole(peer, false); err != nil {
+			log.Errorf("downgrade peer %s failed: %+v", peerId, err)
 		}
-	} else if !master && peerId == s.master { // master downgrade to slave
+	} else if !master && peerId == elected { // master downgrade to slave
 		// upgrade again
-		if err := s.changeEPRole(s.monitor.Get(peerId), true); err != nil {
-			log.Errorf("upgrade peer %s failed: +v", peerId, err)
+		if err := s.changeEPRole(peer, true); err != nil {
+			log.Errorf("upgrade peer %s failed: %+v", peerId, err)
 		}
 	}
 }
 
-// HookReportMaster handles sync report status change
-func (s *Sentinel) HookReportMaster(peerId string) {
+// HookReportMaster handles sync report status change, term is the one of the
+// sentinel master
+func (s *Sentinel) HookReportMaster(peerId string, term uint64) {
 	// i am on duty. not process
 	if s.onDuty {
 		log.Errorf("i am on duty, ep status changed by other should never happen")
@@ -107,7 +181,49 @@ func (s *Sentinel) HookReportMaster(peerId string) {
 	}
 
 	// sentinel slave, do nothing, just accept
-	s.master = peerId
+	s.setMaster(peerId, term)
+}
+
+// HookReportBackends handles the backends membership synced from the other node
+func (s *Sentinel) HookReportBackends(ms *Membership) {
+	if ms == nil {
+		return
+	}
+	if s.monitor.ApplyMembership(ms, s.GetMaster()) {
+		log.Infof("backends changed by the other node: %v", ms.Backends)
+	}
+}
+
+// ReconcileBackends applies the backends found by discovery, the master is kept
+// even if it is not found any more
+func (s *Sentinel) ReconcileBackends(backends []string) {
+	current := s.monitor.Membership()
+	if equalBackends(current.Backends, backends) {
+		return
+	}
+	ms := &Membership{
+		Version: current.Version + 1,
+		Backends: backends,
+	}
+	if s.monitor.ApplyMembership(ms, s.GetMaster()) {
+		log.Infof("backends changed by discovery: %v", backends)
+	}
+}
+
+// AddBackend adds a backend at runtime
+func (s *Sentinel) AddBackend(peerAddr string) error {
+	return s.monitor.AddEndpoint(peerAddr)
+}
+
+// RemoveBackend removes a backend at runtime, the master could not be removed
+// until it is switched over
+func (s *Sentinel) RemoveBackend(peerId string) error {
+	s.Lock()
+	defer s.Unlock()
+	if peerId == s.GetMaster() {
+		return ErrRemoveMaster
+	}
+	return s.monitor.RemoveEndpoint(peerId)
 }
 
 // HookSelfRole will take the duty of master sentinel or downgrade to slave
@@ -121,6 +237,13 @@ func (s *Sentinel) HookSelfRole(master bool) {
 	// todo start or stop the duty
 
 	s.onDuty = master
+	role := "slave"
+	if master {
+		role = "master"
+	}
+	event.Publish(event.EventRoleChange, fmt.Sprintf("%s:%d", config.ProxyConfig.IP, config.ProxyConfig.Port), "sentinel role changed to "+role, map[string]string{
+		"role": role,
+	})
 	if s.onDuty {
 		s.monitor.Start()
 		// wait for monitor sync the endpoint status
@@ -128,12 +251,12 @@ func (s *Sentinel) HookSelfRole(master bool) {
 		// check and do election if needed
 		s.Lock()
 		defer s.Unlock()
-		if len(s.master) == 0 { // should init
+		if elected := s.GetMaster(); len(elected) == 0 { // should init
 			s.Elect()
 		} else { // only promote to sentinel master, do nothing
 			log.Infof("promote to sentinel master, waiter for check status")
 			// set monitor status
-			s.monitor.SetEPStatus(s.master, true)
+			s.monitor.SetEPStatus(elected, true)
 			return
 		}
 	} else {
@@ -144,34 +267,80 @@ func (s *Sentinel) HookSelfRole(master bool) {
 
 // Elect just do elect from healthy endpoints
 func (s *Sentinel) Elect() error {
-	// do elect and change remote status
-	peers := s.monitor.GetHealthy()
+	// do elect and change remote status, flapping endpoints are excluded
+	peers := s.monitor.GetCandidates()
 
 	// test select first one as master
+	previous := s.GetMaster()
 	did := false
 	for _, peer := range peers {
 		err := s.changeEPRole(peer, true)
 		if err == nil {
 			did = true
-			s.master = peer.PeerId
+			s.setMaster(peer.PeerId, 0)
 			break
 		} else {
 			log.Errorf("elect master error: %v", err)
 		}
 	}
 	if !did {
-		s.master = ""
+		s.setMaster("", 0)
+		electionsTotal.Inc("failed")
+		event.Publish(event.EventElection, "", fmt.Sprintf("election failed among %d candidates", len(peers)), map[string]string{
+			"result": "failed",
+			"previous": previous,
+		})
+	} else {
+		elected := s.GetMaster()
+		electionsTotal.Inc("elected")
+		event.Publish(event.EventElection, elected, "backend "+elected+" elected as master", map[string]string{
+			"result": "elected",
+			"master": elected,
+			"previous": previous,
+		})
+		// the previous master could be still running, such as a persistently
+		// degraded one, it is demoted aside since a dead one takes the timeout
+		if old := s.monitor.Get(previous); old != nil && previous != elected {
+			go func() {
+				if err := s.changeEPRole(old, false); err != nil {
+					log.Errorf("demote previous master %s failed: %+v", previous, err)
+				}
+			}()
+		}
 	}
 	return nil
 }
 
-func (s *Sentinel) changeEPRole(peer *model.PeerInfo, master bool) error {
+func (s *Sentinel) changeEPRole(peer *model.PeerInfo, master bool) (err error) {
+	if peer == nil {
+		return ErrPeerNotFound
+	}
+	defer func() {
+		role, result := "slave", "success"
+		if master {
+			role = "master"
+		}
+		data := map[string]string{
+			"role": role,
+			"result": result,
+		}
+		if err != nil {
+			result = "failure"
+			data["result"] = result
+			data["error"] = err.Error()
+		}
+		roleChangesTotal.Inc(role, result)
+		event.Publish(event.EventBackendRoleChange, peer.PeerId, fmt.Sprintf("change backend %s to %s: %s", peer.PeerId, role, result), data)
+	}()
+
 	var u string
+	s.urlLock.Lock()
 	if master {
-		u = config.ProxyConfig.ToMaster
+		u = s.toMaster
 	} else {
-		u = config.ProxyConfig.ToSlave
+		u = s.toSlave
 	}
+	s.urlLock.Unlock()
 
 	client := http.Client{
 		Timeout: 10*time.Second,
@@ -186,8 +355,25 @@ func (s *Sentinel) changeEPRole(peer *model.PeerInfo, master bool) error {
 	if err != nil {
 		return fmt.Errorf("%v", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("change ep role failed: %d", resp.StatusCode)
 	}
 	return nil
 }
+
+func equalBackends(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, addr := range a {
+		set[addr] = true
+	}
+	for _, addr := range b {
+		if !set[addr] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,7 @@
 package sync
 
 import (
+	"context"
 	"net/http"
 	"time"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"sync"
 	log "github.com/sirupsen/logrus"
 	"encoding/json"
+	"github.com/mmpei/janus/src/event"
+	"github.com/mmpei/janus/src/auth"
 )
 
 type ElectPeer struct {
@@ -20,42 +23,76 @@ type ElectPeer struct {
 
 	// the id of master of endpoints, only send when i am master
 	EPMasterId string
+	// the term of the master of endpoints, increased when it changes
+	EPTerm uint64
+
+	// the backends membership, the newer one wins
+	Backends *Membership
 }
 
 type SyncManager struct {
 	lock sync.Mutex
 	client http.Client
-	singleMonitor Monitor
+	// monitor the remote peer by syncing with it
+	singleMonitor *Monitor
 
 	self model.PeerInfo
 	master *model.PeerInfo
 	electTime time.Time
 
 	initTimes int
+	// the last time syncing with the remote peer succeeded
+	lastSync time.Time
+	// the remote peer elected another master, reported once until agreed, and
+	// the agreement is reported as well
+	disagreed bool
 
 	// sentinel, actually syncManager control sentinel
 	sentinel *Sentinel
+	// authenticates the sync messages, nil for plain http
+	peerAuth *auth.PeerAuth
 }
 
 func NewSyncManager(selfAddr string, peerAddr string, config *config.SyncConfig, s *Sentinel) *SyncManager {
-	return &SyncManager{
-		client: http.Client{
-			Timeout: time.Duration(config.Timeout)*time.Second,
-		},
-		singleMonitor: *NewMonitor([]string{peerAddr}, 0, config),
+	sm := &SyncManager{
+		client: http.Client{},
+		singleMonitor: NewMonitor([]string{peerAddr}, 0, config),
 		self: *model.NewPeer(selfAddr, 0),
 		sentinel: s,
 	}
+	sm.singleMonitor.SetCheckFunc(sm.Sync)
+	sm.singleMonitor.SetKind("janus")
+	return sm
 }
 
-func (sm *SyncManager) Run() {
-	ticker := time.NewTicker(time.Duration(config.ProxyConfig.Sync.Interval)*time.Second)
-	for range ticker.C {
-		sm.Sync()
-	}
+// SetPeerAuth authenticates syncing with the remote peer, it should be set before running
+func (sm *SyncManager) SetPeerAuth(pa *auth.PeerAuth) {
+	sm.peerAuth = pa
+}
+
+// Run starts syncing with the remote peer periodically
+func (sm *SyncManager) Run() error {
+	return sm.singleMonitor.Start()
+}
+
+// Stop stops syncing, it returns after the running sync exits
+func (sm *SyncManager) Stop() error {
+	return sm.singleMonitor.Stop()
 }
 
-func (sm *SyncManager) Sync() {
+// SetConfig replaces the sync config, it takes effect after restarting
+func (sm *SyncManager) SetConfig(c *config.SyncConfig) {
+	sm.singleMonitor.SetConfig(c)
+}
+
+// Restart restarts syncing, it picks up the config changes
+func (sm *SyncManager) Restart() error {
+	return sm.singleMonitor.Restart()
+}
+
+// Sync syncs the election with the remote peer once, it is the check function of
+// the remote peer monitor and returns false when the remote peer failed
+func (sm *SyncManager) Sync(ctx context.Context, remotePeer *model.PeerInfo) bool {
 	defer sm.handleError()
 
 	electPeer := &ElectPeer{}
@@ -76,18 +113,19 @@ func (sm *SyncManager) Sync() {
 
 		// if i am a sentinel master, i should tell slave who is the master of endpoint
 		if sm.IsMaster() {
-			electPeer.EPMasterId = sm.sentinel.GetMaster()
+			electPeer.EPMasterId, electPeer.EPTerm = sm.sentinel.GetMasterTerm()
 		}
 	}
+	electPeer.Backends = sm.sentinel.monitor.Membership()
 	sm.lock.Unlock()
 	if isError {
-		return
+		return true
 	}
 
 	log.Debugf("sync to remote: msg=%+v \n", electPeer)
 
-	remotePeers := sm.singleMonitor.GetHealthy()
-	if len(remotePeers) == 0 && (sm.master == nil || sm.master.PeerId != sm.self.PeerId) {
+	healthy := sm.singleMonitor.IsHealth(remotePeer.PeerId)
+	if !healthy && (sm.master == nil || sm.master.PeerId != sm.self.PeerId) {
 		// remote die, promote self
 		log.Infof("no healthy remote peer, elect self")
 		sm.lock.Lock()
@@ -95,56 +133,90 @@ func (sm *SyncManager) Sync() {
 			sm.SetMaster(&sm.self)
 			sm.electTime = time.Now()
 		}
+		sm.agree("the peer janus is down")
 		sm.lock.Unlock()
-		return
-	} else if len(remotePeers) == 0 { // remote down and do as check healthy
-		remotePeers = sm.singleMonitor.GetAll()
-	} else if len(remotePeers) > 1 {
-		log.Error("only support one remote peer now")
-		return
+		return false
 	}
+	// when remote down, keep syncing as check healthy
 
 	// sync with remotePeer
-	remotePeer := remotePeers[0]
-	url := fmt.Sprintf("http://%s/sync", remotePeer.PeerAddr)
+	scheme, client := "http", &sm.client
+	if sm.peerAuth != nil {
+		scheme, client = sm.peerAuth.Scheme(), sm.peerAuth.Client()
+	}
+	url := fmt.Sprintf("%s://%s/sync", scheme, remotePeer.PeerAddr)
 	bytesData, err := json.Marshal(electPeer)
 	if err != nil {
 		log.Errorf("encode request body error")
-		return
+		return true
 	}
 	reader := bytes.NewReader(bytesData)
-	request, err := http.NewRequest("POST", url, reader)
+	// timeout per request, so that reloading the config takes effect
+	reqCtx, cancel := context.WithTimeout(ctx, time.Duration(sm.singleMonitor.Config().Timeout))
+	defer cancel()
+	request, err := http.NewRequestWithContext(reqCtx, "POST", url, reader)
 	if err != nil {
 		log.Errorf("generate http request error: %v", err)
-		return
+		return true
 	}
 	request.Header.Set("Content-Type", "application/json;charset=UTF-8")
-	resp, err := sm.client.Do(request)
+	var nonce string
+	if sm.peerAuth != nil {
+		nonce = sm.peerAuth.SignRequest(request, bytesData)
+	}
+	start := time.Now()
+	resp, err := client.Do(request)
+	if ctx.Err() != nil { // stopped while syncing
+		if err == nil {
+			resp.Body.Close()
+		}
+		return true
+	}
+	latency := time.Since(start)
 	if err != nil { // set remote peer failed
-		sm.singleMonitor.Tick(remotePeer.PeerId, false)
+		syncTotal.Inc("failure")
+		sm.singleMonitor.Tick(remotePeer.PeerId, false, 0, err.Error())
 		log.Errorf("http failed: %v", err)
-		return
+		return false
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		sm.singleMonitor.Tick(remotePeer.PeerId, false)
+		syncTotal.Inc("failure")
+		sm.singleMonitor.Tick(remotePeer.PeerId, false, 0, fmt.Sprintf("response code = %d", resp.StatusCode))
 		log.Errorf("http failed: response code = %d", resp.StatusCode)
-		return
+		return false
 	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		sm.singleMonitor.Tick(remotePeer.PeerId, false)
+		syncTotal.Inc("failure")
+		sm.singleMonitor.Tick(remotePeer.PeerId, false, 0, fmt.Sprintf("read body failed %v", err))
 		log.Errorf("http failed: read body failed %v", err)
-		return
+		return false
+	}
+	if sm.peerAuth != nil {
+		if err := sm.peerAuth.VerifyResponse(resp, nonce, body); err != nil {
+			syncTotal.Inc("failure")
+			sm.singleMonitor.Tick(remotePeer.PeerId, false, 0, err.Error())
+			log.Errorf("http failed: %v", err)
+			return false
+		}
 	}
 
 	respPeer := &ElectPeer{}
 	if err := json.Unmarshal(body, respPeer); err != nil {
-		sm.singleMonitor.Tick(remotePeer.PeerId, false)
+		syncTotal.Inc("failure")
+		sm.singleMonitor.Tick(remotePeer.PeerId, false, 0, fmt.Sprintf("decode response body failed %v", err))
 		log.Errorf("http failed: decode response body failed %v", err)
-		return
+		return false
 	}
-	sm.singleMonitor.Tick(remotePeer.PeerId, true)
+	syncTotal.Inc("success")
+	syncLatency.Observe(latency.Seconds())
+	sm.singleMonitor.Tick(remotePeer.PeerId, true, latency, "sync succeeded")
+	sm.lock.Lock()
+	sm.lastSync = time.Now()
+	sm.lock.Unlock()
 	sm.Handle(respPeer)
+	return true
 }
 
 func (sm *SyncManager) Handle(respPeer *ElectPeer) {
@@ -157,8 +229,9 @@ func (sm *SyncManager) Handle(respPeer *ElectPeer) {
 	defer sm.lock.Unlock()
 	// check endpoint and do hook
 	if !sm.IsMaster() {
-		sm.sentinel.HookReportMaster(respPeer.EPMasterId)
+		sm.sentinel.HookReportMaster(respPeer.EPMasterId, respPeer.EPTerm)
 	}
+	sm.sentinel.HookReportBackends(respPeer.Backends)
 	if sm.master == nil {
 		if sm.self.PeerId == respPeer.PeerId {
 			sm.SetMaster(&sm.self)
@@ -184,9 +257,30 @@ func (sm *SyncManager) Handle(respPeer *ElectPeer) {
 			}
 		} else {
 			log.Errorf("waiting for syncing next time")
+			if !sm.disagreed {
+				sm.disagreed = true
+				event.Publish(event.EventSplitBrainSuspected, respPeer.PeerId, fmt.Sprintf("the peer janus elects %s but %s is elected here", respPeer.PeerId, sm.master.PeerId), map[string]string{
+					"kind": "janus",
+					"elected": sm.master.PeerId,
+					"remote": respPeer.PeerId,
+				})
+			}
 			return
 		}
 	}
+	sm.agree("the peer janus elects the same master")
+}
+
+// agree ends the disagreement with the remote peer, lock should be held
+func (sm *SyncManager) agree(reason string) {
+	if !sm.disagreed {
+		return
+	}
+	sm.disagreed = false
+	log.Infof("split brain cleared: %s", reason)
+	event.Publish(event.EventSplitBrainCleared, "", "split brain cleared: "+reason, map[string]string{
+		"kind": "janus",
+	})
 }
 
 func (sm *SyncManager) Get() *ElectPeer {
@@ -205,11 +299,12 @@ func (sm *SyncManager) Get() *ElectPeer {
 
 		// if i am a sentinel master, i should tell slave who is the master of endpoint
 		if sm.IsMaster() {
-			ep.EPMasterId = sm.sentinel.GetMaster()
+			ep.EPMasterId, ep.EPTerm = sm.sentinel.GetMasterTerm()
 		}
 	} else {
 		// error, never reach here
 	}
+	ep.Backends = sm.sentinel.monitor.Membership()
 	return ep
 }
 
@@ -241,3 +336,10 @@ func (sm *SyncManager) SetMaster(peer *model.PeerInfo) {
 func (sm *SyncManager) GetEPMaster() string {
 	return sm.sentinel.GetMaster()
 }
+
+// LastSync returns the last time syncing with the remote peer succeeded
+func (sm *SyncManager) LastSync() time.Time {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.lastSync
+}
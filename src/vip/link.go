@@ -0,0 +1,62 @@
+package vip
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Link manages the addresses of the interfaces. The default shells out to ip and
+// arping, a fake or a netlink implementation could be used instead.
+type Link interface {
+	// HasAddress returns whether the address with prefix length is on the interface
+	HasAddress(iface, addr string) (bool, error)
+	AddAddress(iface, addr string) error
+	DeleteAddress(iface, addr string) error
+	// GratuitousARP announces the ip without prefix length from the interface
+	GratuitousARP(iface, ip string, count int) error
+}
+
+// IPCommand is the Link by the ip command of iproute2 and arping of iputils
+type IPCommand struct{}
+
+func (IPCommand) HasAddress(iface, addr string) (bool, error) {
+	out, err := run("ip", "-o", "addr", "show", "dev", iface)
+	if err != nil {
+		return false, err
+	}
+	// 2: eth0    inet 192.168.1.100/24 scope global secondary eth0 ...
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if (fields[i] == "inet" || fields[i] == "inet6") && fields[i+1] == addr {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (IPCommand) AddAddress(iface, addr string) error {
+	_, err := run("ip", "addr", "add", addr, "dev", iface)
+	return err
+}
+
+func (IPCommand) DeleteAddress(iface, addr string) error {
+	_, err := run("ip", "addr", "del", addr, "dev", iface)
+	return err
+}
+
+func (IPCommand) GratuitousARP(iface, ip string, count int) error {
+	_, err := run("arping", "-U", "-c", strconv.Itoa(count), "-I", iface, ip)
+	return err
+}
+
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,204 @@
+package vip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+	"github.com/mmpei/janus/src/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var vipHeld = metrics.NewGaugeVec("janus_vip_held",
+	"Whether this janus holds the virtual ip.")
+
+// Manager takes the virtual ip when this janus becomes the sentinel master and
+// releases it when it becomes slave. It refuses taking the ip while the janus
+// nodes disagree on the master, and tries again the hold after they agree if
+// still master.
+type Manager struct {
+	lock   sync.Mutex
+	config config.VIPConfig
+	link   Link
+	ip     string
+
+	master bool
+	held   bool
+	// suspected refuses taking until the split brain is cleared, then taking is
+	// refused until heldUntil
+	suspected bool
+	heldUntil time.Time
+	retry     *time.Timer
+}
+
+func NewManager(cfg *config.VIPConfig, link Link) (*Manager, error) {
+	ip, _, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vip %s: %v", cfg.Address, err)
+	}
+	vipHeld.Set(0)
+	return &Manager{
+		config: *cfg,
+		link:   link,
+		ip:     ip.String(),
+	}, nil
+}
+
+// Start subscribes to the bus before returning, and follows the sentinel role
+// and the split brain suspects published from then on in the background until
+// ctx is done. The address left by a previous run is released first, since this
+// janus starts as slave.
+func (m *Manager) Start(ctx context.Context, bus *event.Bus) {
+	events, cancel := bus.SubscribeTypes(event.EventRoleChange, event.EventSplitBrainSuspected, event.EventSplitBrainCleared)
+
+	m.lock.Lock()
+	if has, err := m.link.HasAddress(m.config.Interface, m.config.Address); err != nil {
+		log.Errorf("check vip %s error: %v", m.config.Address, err)
+	} else if has {
+		m.held = true
+		m.release("left by a previous run")
+	}
+	m.lock.Unlock()
+	go m.run(ctx, events, cancel)
+}
+
+func (m *Manager) run(ctx context.Context, events <-chan event.Event, cancel func()) {
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			switch e.Type {
+			case event.EventRoleChange:
+				m.SetMaster(e.Data["role"] == "master")
+			case event.EventSplitBrainSuspected:
+				// the backends reporting master are demoted by the sentinel,
+				// the vip follows the janus nodes only
+				if e.Data["kind"] == "janus" {
+					m.Suspect(e.Message)
+				}
+			case event.EventSplitBrainCleared:
+				m.Clear(e.Message)
+			}
+		}
+	}
+}
+
+// SetMaster takes or releases the address by the sentinel role
+func (m *Manager) SetMaster(master bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.master = master
+	if master {
+		m.take()
+	} else {
+		m.release("sentinel slave")
+	}
+}
+
+// Suspect refuses taking the address until the split brain is cleared, the
+// address already taken is kept since the other node refuses taking it as well
+func (m *Manager) Suspect(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.suspected = true
+	log.Warningf("split brain suspected, refuse taking vip %s until it is cleared: %s", m.config.Address, reason)
+}
+
+// Clear takes the address after the hold duration if still master
+func (m *Manager) Clear(reason string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.suspected {
+		return
+	}
+	m.suspected = false
+	m.heldUntil = time.Now().Add(time.Duration(m.config.SplitBrainHold))
+	log.Infof("%s, vip %s could be taken after %v", reason, m.config.Address, m.heldUntil.Format(time.RFC3339))
+	if m.master {
+		m.take()
+	}
+}
+
+// take adds the address and announces it, lock should be held
+func (m *Manager) take() {
+	if m.held {
+		return
+	}
+	if m.suspected {
+		m.publish("refused", fmt.Sprintf("refuse taking vip %s while split brain is suspected", m.config.Address), nil)
+		return
+	}
+	if wait := time.Until(m.heldUntil); wait > 0 {
+		m.publish("refused", fmt.Sprintf("refuse taking vip %s until %v after split brain", m.config.Address, m.heldUntil.Format(time.RFC3339)), nil)
+		m.scheduleRetry(wait)
+		return
+	}
+	if err := m.link.AddAddress(m.config.Interface, m.config.Address); err != nil {
+		// it could be added by hand or another run
+		if has, _ := m.link.HasAddress(m.config.Interface, m.config.Address); !has {
+			m.publish("failed", fmt.Sprintf("take vip %s failed", m.config.Address), err)
+			return
+		}
+	}
+	m.held = true
+	vipHeld.Set(1)
+	if m.config.ARPCount > 0 {
+		if err := m.link.GratuitousARP(m.config.Interface, m.ip, m.config.ARPCount); err != nil {
+			log.Errorf("gratuitous arp for vip %s error: %v", m.ip, err)
+		}
+	}
+	m.publish("taken", fmt.Sprintf("vip %s taken on %s", m.config.Address, m.config.Interface), nil)
+}
+
+// release deletes the address, lock should be held
+func (m *Manager) release(reason string) {
+	if m.retry != nil {
+		m.retry.Stop()
+		m.retry = nil
+	}
+	if !m.held {
+		return
+	}
+	if err := m.link.DeleteAddress(m.config.Interface, m.config.Address); err != nil {
+		m.publish("failed", fmt.Sprintf("release vip %s failed", m.config.Address), err)
+		return
+	}
+	m.held = false
+	vipHeld.Set(0)
+	m.publish("released", fmt.Sprintf("vip %s released: %s", m.config.Address, reason), nil)
+}
+
+func (m *Manager) scheduleRetry(wait time.Duration) {
+	if m.retry != nil {
+		m.retry.Stop()
+	}
+	m.retry = time.AfterFunc(wait, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		m.retry = nil
+		if m.master {
+			m.take()
+		}
+	})
+}
+
+func (m *Manager) publish(action, message string, err error) {
+	data := map[string]string{
+		"action":    action,
+		"address":   m.config.Address,
+		"interface": m.config.Interface,
+	}
+	if err != nil {
+		data["error"] = err.Error()
+		log.Errorf("%s: %v", message, err)
+	} else {
+		log.Infof("%s", message)
+	}
+	event.Publish(event.EventVIP, "", message, data)
+}
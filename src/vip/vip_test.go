@@ -0,0 +1,158 @@
+package vip
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmpei/janus/src/config"
+	"github.com/mmpei/janus/src/event"
+)
+
+// fakeLink keeps the addresses in memory
+type fakeLink struct {
+	lock      sync.Mutex
+	addresses map[string]bool
+	arps      int
+}
+
+func newFakeLink() *fakeLink {
+	return &fakeLink{addresses: map[string]bool{}}
+}
+
+func (l *fakeLink) HasAddress(iface, addr string) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.addresses[iface+" "+addr], nil
+}
+
+func (l *fakeLink) AddAddress(iface, addr string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.addresses[iface+" "+addr] = true
+	return nil
+}
+
+func (l *fakeLink) DeleteAddress(iface, addr string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.addresses, iface+" "+addr)
+	return nil
+}
+
+func (l *fakeLink) GratuitousARP(iface, ip string, count int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.arps += count
+	return nil
+}
+
+func (l *fakeLink) has() bool {
+	has, _ := l.HasAddress("eth0", "192.168.1.100/24")
+	return has
+}
+
+func newTestManager(t *testing.T, hold time.Duration) (*Manager, *fakeLink) {
+	link := newFakeLink()
+	m, err := NewManager(&config.VIPConfig{
+		Address:        "192.168.1.100/24",
+		Interface:      "eth0",
+		ARPCount:       2,
+		SplitBrainHold: config.Duration(hold),
+	}, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, link
+}
+
+// eventually waits the condition for a second
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("%s not met after a second", what)
+}
+
+func TestManagerFollowsRole(t *testing.T) {
+	m, link := newTestManager(t, 0)
+	m.SetMaster(true)
+	if !link.has() || link.arps != 2 {
+		t.Fatalf("master: address %v, %d arps, want taken with 2 arps", link.has(), link.arps)
+	}
+	m.SetMaster(false)
+	if link.has() {
+		t.Fatal("slave still holds the address")
+	}
+}
+
+func TestManagerRefusesSplitBrain(t *testing.T) {
+	m, link := newTestManager(t, 50*time.Millisecond)
+	m.Suspect("janus-2 reports master")
+	m.SetMaster(true)
+	if link.has() {
+		t.Fatal("address taken while split brain is suspected")
+	}
+
+	m.Clear("split brain cleared")
+	if link.has() {
+		t.Fatal("address taken during the hold")
+	}
+	eventually(t, "address taken after the hold", link.has)
+
+	// the address taken is kept while suspected, released as slave
+	m.Suspect("janus-2 reports master")
+	if !link.has() {
+		t.Fatal("address released by the suspect")
+	}
+	m.SetMaster(false)
+	if link.has() {
+		t.Fatal("slave still holds the address")
+	}
+}
+
+func TestManagerReleasedDuringHold(t *testing.T) {
+	m, link := newTestManager(t, 50*time.Millisecond)
+	m.Suspect("janus-2 reports master")
+	m.SetMaster(true)
+	m.Clear("split brain cleared")
+	m.SetMaster(false)
+	time.Sleep(100 * time.Millisecond)
+	if link.has() {
+		t.Fatal("address taken after the hold by a slave")
+	}
+}
+
+func TestManagerStart(t *testing.T) {
+	m, link := newTestManager(t, 0)
+	// the address left by a previous run is released first
+	link.AddAddress("eth0", "192.168.1.100/24")
+	bus := event.NewBus(16)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m.Start(ctx, bus)
+	if link.has() {
+		t.Fatal("address left by a previous run is kept")
+	}
+
+	// a backend reporting master does not refuse the vip
+	bus.Publish(event.EventSplitBrainSuspected, "", "backend reports master", map[string]string{"kind": "backend"})
+	bus.Publish(event.EventRoleChange, "", "become master", map[string]string{"role": "master"})
+	eventually(t, "address taken", link.has)
+
+	bus.Publish(event.EventRoleChange, "", "become slave", map[string]string{"role": "slave"})
+	eventually(t, "address released", func() bool { return !link.has() })
+
+	bus.Publish(event.EventSplitBrainSuspected, "", "janus-2 reports master", map[string]string{"kind": "janus"})
+	bus.Publish(event.EventRoleChange, "", "become master", map[string]string{"role": "master"})
+	time.Sleep(50 * time.Millisecond)
+	if link.has() {
+		t.Fatal("address taken while split brain is suspected")
+	}
+	bus.Publish(event.EventSplitBrainCleared, "", "split brain cleared", nil)
+	eventually(t, "address taken after cleared", link.has)
+}